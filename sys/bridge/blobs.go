@@ -0,0 +1,212 @@
+package bridge
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/exp/slices"
+)
+
+//
+// Blobs (images, files, voice notes...) go over binary frames, in chunks, so big payloads never go through JSON.
+// It takes the binary capability, from the hello.
+//
+// Every binary frame is one chunk of a transfer, named by the client:
+//
+//	[transfer id: 16 bytes][chunk]
+//
+// To upload, announce it, then send the chunks in order:
+//
+//	{"v": 1, "kind": "upload", "id": "<32 hex digits>", "size": 1234}
+//
+// Once they add up to the size, the core stores the blob and answers with its CID:
+//
+//	{"v": 1, "kind": "upload", "id": "...", "blob": "<cid>"}
+//
+// To download, ask for the CID, and the core answers with the size, then the chunks:
+//
+//	{"v": 1, "kind": "download", "id": "...", "blob": "<cid>"}
+//	{"v": 1, "kind": "download", "id": "...", "blob": "<cid>", "size": 1234}
+//
+
+const (
+	TRANSFERBYTES = 16
+	CHUNK         = 64 << 10 // what the core sends
+	MAX_CHUNK     = 1 << 20  // what it accepts
+	MAX_BLOB      = 64 << 20
+	MAX_UPLOADS   = 8 // at once, per socket
+)
+
+var errUploadAborted = errors.New("upload aborted")
+
+// the core reads an upload as it comes in, through a pipe
+type upload struct {
+	size     int
+	received int
+	pipe     *io.PipeWriter
+}
+
+type OutputReceivedBlob struct {
+	Session  string
+	Client   string
+	Transfer string
+	Data     io.ReadCloser
+}
+
+type OutputBlobRequest struct {
+	Session  string
+	Client   string
+	Transfer string
+	Blob     string
+}
+
+type InputBlobStored struct {
+	Session  string
+	Client   string
+	Transfer string
+	Blob     string
+	Err      error
+}
+
+type InputSendBlob struct {
+	Session  string
+	Client   string
+	Transfer string
+	Blob     string
+	Size     int64
+	Data     io.Reader
+	Err      error
+}
+
+// whether a socket may transfer blobs, telling it why not
+func (sock *socket) canTransfer(session string, kind string) bool {
+	switch {
+	case !slices.Contains(sock.caps, BINARY):
+		sock.fail(ERR_CAPABILITY, kind, "blobs take the binary capability")
+	case session == "":
+		sock.fail(ERR_NO_SESSION, kind, "begin or resume a session first")
+	default:
+		return true
+	}
+	return false
+}
+
+func (sock *socket) validTransfer(e envelope) bool {
+	b, err := hex.DecodeString(e.Id)
+	if err != nil || len(b) != TRANSFERBYTES {
+		sock.fail(ERR_TRANSFER, e.Kind, fmt.Sprintf("a transfer id is %d bytes, in hex", TRANSFERBYTES))
+		return false
+	}
+	return true
+}
+
+func (bridge *Bridge) startUpload(sock *socket, session string, e envelope) {
+	if _, there := sock.uploads[e.Id]; there {
+		sock.failTransfer(ERR_TRANSFER, e.Kind, e.Id, "transfer already started")
+		return
+	}
+	if len(sock.uploads) >= MAX_UPLOADS {
+		sock.failTransfer(ERR_TRANSFER, e.Kind, e.Id, "too many uploads at once")
+		return
+	}
+	if e.Size < 0 || e.Size > MAX_BLOB {
+		sock.failTransfer(ERR_TRANSFER, e.Kind, e.Id, fmt.Sprintf("blobs go up to %d bytes", MAX_BLOB))
+		return
+	}
+
+	r, w := io.Pipe()
+
+	bridge.Output <- OutputReceivedBlob{session, sock.client, e.Id, r}
+
+	if e.Size == 0 {
+		w.Close()
+		return
+	}
+
+	sock.uploads[e.Id] = &upload{size: e.Size, pipe: w}
+}
+
+func (bridge *Bridge) receiveChunk(sock *socket, session string, frame []byte) {
+	if len(frame) < TRANSFERBYTES {
+		sock.fail(ERR_TRANSFER, UPLOAD, "chunk without a transfer id")
+		return
+	}
+
+	id := hex.EncodeToString(frame[:TRANSFERBYTES])
+	chunk := frame[TRANSFERBYTES:]
+
+	u, there := sock.uploads[id]
+	if !there {
+		sock.failTransfer(ERR_TRANSFER, UPLOAD, id, "no such upload")
+		return
+	}
+
+	if u.received+len(chunk) > u.size {
+		delete(sock.uploads, id)
+		u.pipe.CloseWithError(errUploadAborted)
+		sock.failTransfer(ERR_TRANSFER, UPLOAD, id, "more bytes than the upload's size")
+		return
+	}
+
+	// the core has its own copy by the time this returns, since the pipe doesn't buffer
+	if _, err := u.pipe.Write(chunk); err != nil {
+		delete(sock.uploads, id)
+		return // the core tells the client what went wrong
+	}
+
+	u.received += len(chunk)
+
+	if u.received == u.size {
+		delete(sock.uploads, id)
+		u.pipe.Close()
+	}
+}
+
+// when the socket goes
+func (sock *socket) abortUploads() {
+	for id, u := range sock.uploads {
+		u.pipe.CloseWithError(errUploadAborted)
+		delete(sock.uploads, id)
+	}
+}
+
+// the size, then the chunks
+func (sock *socket) sendBlob(m InputSendBlob) {
+	if m.Err != nil {
+		sock.failTransfer(ERR_BLOB, DOWNLOAD, m.Transfer, m.Err.Error())
+		return
+	}
+
+	err := sock.send(envelope{Kind: DOWNLOAD, Id: m.Transfer, Blob: m.Blob, Size: int(m.Size)})
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	id, _ := hex.DecodeString(m.Transfer)
+
+	frame := make([]byte, TRANSFERBYTES+CHUNK)
+	copy(frame, id)
+
+	for {
+		n, err := io.ReadFull(m.Data, frame[TRANSFERBYTES:])
+		if n > 0 {
+			if err := sock.write(websocket.BinaryMessage, frame[:TRANSFERBYTES+n]); err != nil {
+				log.Debug(err)
+				return
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		}
+		if err != nil {
+			// the client has the size, so it can tell the blob was cut short
+			sock.failTransfer(ERR_BLOB, DOWNLOAD, m.Transfer, err.Error())
+			return
+		}
+	}
+}
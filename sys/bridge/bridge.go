@@ -1,20 +1,36 @@
 package bridge
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	logging "github.com/ipfs/go-log/v2"
 	nanoid "github.com/matoous/go-nanoid/v2"
 	"github.com/projectdiscovery/sslcert"
+	"golang.org/x/exp/slices"
+	"lukechampine.com/frand"
 
 	"slater/core/msg"
 )
 
-var log = logging.Logger("slater:bridge")
+var (
+	log      = logging.Logger("slater:bridge")
+	security = logging.Logger("slater:security")
+)
+
+const (
+	TOKENBYTES = 32
+	TOKENFILE  = "bridge-token"
+)
 
 func init() {
 	logging.SetAllLoggers(logging.LevelDebug)
@@ -23,8 +39,22 @@ func init() {
 type Bridge struct {
 	Input    chan any
 	Output   chan any
-	Sessions map[string]*websocket.Conn
+	Sessions map[string][]*socket
+	lock     *sync.RWMutex
 	upgrader websocket.Upgrader
+	token    string
+	origins  []string
+}
+
+// a websocket, and what it negotiated in its hello
+// (gorilla allows one writer at a time, hence the lock)
+// Several sockets may share a session, and the core tells them apart by client.
+type socket struct {
+	client  string
+	conn    *websocket.Conn
+	lock    *sync.Mutex
+	caps    []string
+	uploads map[string]*upload // only touched by the reading goroutine
 }
 
 // TODO prob use some other identifier for sessions...
@@ -34,16 +64,43 @@ type InputSendMessage struct {
 	Message *msg.Message
 }
 
+type InputSendSession struct {
+	Session string
+}
+
+type InputSendSlate struct {
+	Session string
+	Slate   string
+}
+
+// to one client of the session, or to all of them if there's no Client
+type InputSendPage struct {
+	Session string
+	Client  string
+	Slate   string
+	From    int
+	Total   int
+	Page    []*msg.Message
+}
+
+type InputSendLayout struct {
+	Session string
+	Slates  []LayoutSlate
+}
+
 type OutputSessionStart struct {
 	Session string
+	Client  string
 }
 
 type OutputSessionResume struct {
 	Session string
+	Client  string
 }
 
 type OutputSessionQuit struct {
 	Session string
+	Client  string
 }
 
 type OutputReceivedMessage struct {
@@ -51,28 +108,25 @@ type OutputReceivedMessage struct {
 	Message *msg.Message
 }
 
-func Start() *Bridge {
-	bridge := &Bridge{
-		Input:    make(chan any),
-		Output:   make(chan any),
-		Sessions: make(map[string]*websocket.Conn),
-		upgrader: websocket.Upgrader{
-			// TODO Examine buffer sizes.
-			// This is a quick guess aiming at mostly small messages,
-			// and accepting a big increase in latency for larger messages like blobs.
-			ReadBufferSize:  256,
-			WriteBufferSize: 256,
+// Count messages before the cursor (or from it on, if not Before)
+type OutputPageRequest struct {
+	Session string
+	Client  string
+	Slate   string
+	Cursor  int
+	Count   int
+	Before  bool
+}
 
-			// TODO I'm not sure if compression is worth the overhead for local IPC,
-			// but what about over the LAN? (docs/bridge.md)
-			//EnableCompression: true,
+// Start the bridge, accepting websockets from localhost and from the given origins.
+// Every handshake has to present the token, which is new each launch.
+// It's written to a file in the root (readable only by the user), and the port and that file's path are printed.
+func Start(root string, origins []string) *Bridge {
+	bridge := newBridge(origins)
 
-			// TODO Check that connection is from localhost,
-			// or a host in the whitelist. (docs/bridge.md)
-			//CheckOrigin: func(r *http.Request) bool {
-			//	return true
-			//},
-		},
+	tokenPath, err := bridge.writeToken(root)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	http.HandleFunc("/", bridge.Session)
@@ -95,7 +149,7 @@ func Start() *Bridge {
 		}
 
 		port := listener.Addr().(*net.TCPAddr).Port
-		fmt.Println(port)
+		fmt.Println(port, tokenPath)
 
 		err = server.ServeTLS(listener, "", "")
 
@@ -111,17 +165,45 @@ func Start() *Bridge {
 			case input := <-bridge.Input:
 				switch input.(type) {
 				case InputSendMessage:
-					mess := input.(InputSendMessage)
+					m := input.(InputSendMessage)
+					bridge.send(m.Session, envelope{Kind: MSG, Msg: (*wireMessage)(m.Message)})
+
+				case InputSendSession:
+					m := input.(InputSendSession)
+					bridge.send(m.Session, envelope{Kind: SESSION, Session: m.Session})
+
+				case InputSendSlate:
+					m := input.(InputSendSlate)
+					bridge.send(m.Session, envelope{Kind: SLATE, Slate: m.Slate})
 
-					sock, there := bridge.Sessions[mess.Session]
+				case InputSendPage:
+					m := input.(InputSendPage)
+					bridge.sendPage(m)
+
+				case InputSendLayout:
+					m := input.(InputSendLayout)
+					bridge.send(m.Session, envelope{Kind: LAYOUT, Layout: m.Slates})
+
+				case InputBlobStored:
+					m := input.(InputBlobStored)
+					sock, there := bridge.client(m.Session, m.Client)
 					if !there {
 						continue
 					}
-
-					err := sock.WriteJSON(mess.Message)
-					if err != nil {
+					if m.Err != nil {
+						sock.failTransfer(ERR_BLOB, UPLOAD, m.Transfer, m.Err.Error())
+						continue
+					}
+					if err := sock.send(envelope{Kind: UPLOAD, Id: m.Transfer, Blob: m.Blob}); err != nil {
 						log.Debug(err)
 					}
+
+				case InputSendBlob:
+					m := input.(InputSendBlob)
+					sock, there := bridge.client(m.Session, m.Client)
+					if there {
+						go sock.sendBlob(m)
+					}
 				}
 			}
 		}
@@ -130,89 +212,372 @@ func Start() *Bridge {
 	return bridge
 }
 
+func newBridge(origins []string) *Bridge {
+	bridge := &Bridge{
+		Input:    make(chan any),
+		Output:   make(chan any),
+		Sessions: make(map[string][]*socket),
+		lock:     &sync.RWMutex{},
+		token:    fmt.Sprintf("%x", frand.Bytes(TOKENBYTES)),
+		origins:  origins,
+		upgrader: websocket.Upgrader{
+			// TODO Examine buffer sizes.
+			// This is a quick guess aiming at mostly small messages,
+			// and accepting a big increase in latency for larger messages like blobs.
+			ReadBufferSize:  256,
+			WriteBufferSize: 256,
+
+			// TODO I'm not sure if compression is worth the overhead for local IPC,
+			// but what about over the LAN? (docs/bridge.md)
+			//EnableCompression: true,
+
+		},
+	}
+
+	bridge.upgrader.CheckOrigin = bridge.checkOrigin
+
+	return bridge
+}
+
+// (written again each launch, so it's only ever this launch's)
+func (bridge *Bridge) writeToken(root string) (string, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", err
+	}
+
+	path, err := filepath.Abs(filepath.Join(root, TOKENFILE))
+	if err != nil {
+		return "", err
+	}
+
+	// (removed first, so the file is made again with its permissions)
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	return path, os.WriteFile(path, []byte(bridge.token), 0600)
+}
+
+// every socket on a session
+func (bridge *Bridge) sockets(session string) []*socket {
+	bridge.lock.RLock()
+	defer bridge.lock.RUnlock()
+
+	return slices.Clone(bridge.Sessions[session])
+}
+
+func (bridge *Bridge) client(session, client string) (*socket, bool) {
+	for _, sock := range bridge.sockets(session) {
+		if sock.client == client {
+			return sock, true
+		}
+	}
+	return nil, false
+}
+
+func (bridge *Bridge) send(session string, e envelope) {
+	for _, sock := range bridge.sockets(session) {
+		if err := sock.send(e); err != nil {
+			log.Debug(err)
+		}
+	}
+}
+
+func (sock *socket) send(e envelope) error {
+	e.V = VERSION
+
+	sock.lock.Lock()
+	defer sock.lock.Unlock()
+
+	return sock.conn.WriteJSON(e)
+}
+
+func (sock *socket) write(mt int, frame []byte) error {
+	sock.lock.Lock()
+	defer sock.lock.Unlock()
+
+	return sock.conn.WriteMessage(mt, frame)
+}
+
+// a page for a client which didn't ask for pages gets its messages one by one
+func (bridge *Bridge) sendPage(m InputSendPage) {
+	socks := bridge.sockets(m.Session)
+	if m.Client != "" {
+		sock, there := bridge.client(m.Session, m.Client)
+		if !there {
+			return
+		}
+		socks = []*socket{sock}
+	}
+
+	for _, sock := range socks {
+		sock.sendPage(m)
+	}
+}
+
+func (sock *socket) sendPage(m InputSendPage) {
+	if !slices.Contains(sock.caps, PAGE) {
+		for _, pm := range m.Page {
+			if err := sock.send(envelope{Kind: MSG, Msg: (*wireMessage)(pm)}); err != nil {
+				log.Debug(err)
+				return
+			}
+		}
+		return
+	}
+
+	page := make([]*wireMessage, len(m.Page))
+	for i, pm := range m.Page {
+		page[i] = (*wireMessage)(pm)
+	}
+
+	from := m.From
+	if err := sock.send(envelope{Kind: PAGE, Slate: m.Slate, Page: page, From: &from, Total: m.Total}); err != nil {
+		log.Debug(err)
+	}
+}
+
+func (sock *socket) canPage(session string, e envelope) bool {
+	switch {
+	case !slices.Contains(sock.caps, PAGE):
+		sock.fail(ERR_CAPABILITY, e.Kind, "asking for pages takes the page capability")
+	case session == "":
+		sock.fail(ERR_NO_SESSION, e.Kind, "begin or resume a session first")
+	case e.Slate == "":
+		sock.fail(ERR_PAGE, e.Kind, "missing slate")
+	case (e.Before == nil) == (e.After == nil):
+		sock.fail(ERR_PAGE, e.Kind, "a page is either before or after a cursor")
+	case e.Count < 1 || e.Count > MAX_PAGE:
+		sock.fail(ERR_PAGE, e.Kind, fmt.Sprintf("pages go up to %d messages", MAX_PAGE))
+	default:
+		return true
+	}
+	return false
+}
+
+// tell the client what went wrong, and carry on
+func (sock *socket) fail(code, kind, message string) {
+	sock.failTransfer(code, kind, "", message)
+}
+
+func (sock *socket) failTransfer(code, kind, transfer, message string) {
+	log.Debugf("ui input: %s: %s", code, message)
+
+	e := errorEnvelope(code, kind, message)
+	e.Id = transfer
+
+	if err := sock.send(e); err != nil {
+		log.Debug(err)
+	}
+}
+
 func (bridge *Bridge) Session(w http.ResponseWriter, r *http.Request) {
-	sock, err := bridge.upgrader.Upgrade(w, r, nil)
+	conn, err := bridge.upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
 		log.Debugf("websocket:", err)
 		return
 	}
 
-	defer sock.Close()
+	defer conn.Close()
+
+	conn.SetReadLimit(TRANSFERBYTES + MAX_CHUNK)
+
+	client, err := nanoid.New()
+	if err != nil {
+		log.Fatal("could not generate id!\n", err)
+	}
+
+	sock := &socket{client: client, conn: conn, lock: &sync.Mutex{}, uploads: make(map[string]*upload)}
+	defer sock.abortUploads()
 
 	var id string = ""
 
+	// whichever session the socket ends up with, the core is told it went
+	defer func() { bridge.quit(id, sock) }()
+
 	for {
-		mt, mess, err := sock.ReadMessage()
+		mt, frame, err := conn.ReadMessage()
 
 		if err != nil {
-			log.Debug(err)
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debugf("session %s closed its socket", id)
+			} else {
+				log.Debug(err)
+			}
 			break
 		}
 
 		switch mt {
 		case websocket.TextMessage:
-			var bm map[string]any
+			var e envelope
 
-			err := json.Unmarshal(mess, &bm)
-			if err != nil {
-				log.Debugf("failed to unmarshal ui input!!")
-				return
+			if err := json.Unmarshal(frame, &e); err != nil {
+				if errors.Is(err, errBadMessage) {
+					sock.fail(ERR_BAD_MESSAGE, e.Kind, err.Error())
+				} else {
+					sock.fail(ERR_BAD_JSON, e.Kind, err.Error())
+				}
+				continue
 			}
 
-			kindField, there := bm["kind"]
-			if !there {
-				log.Debugf("missing kind!")
-				return
+			if e.Kind == HELLO {
+				if e.V < 1 {
+					sock.fail(ERR_VERSION, e.Kind, fmt.Sprintf("this core speaks version %d", VERSION))
+					continue
+				}
+
+				// a newer client can fall back to our version, if it still speaks it
+				sock.caps = negotiate(e.Caps)
+				if err := sock.send(envelope{Kind: HELLO, Caps: sock.caps}); err != nil {
+					log.Debug(err)
+				}
+				continue
 			}
-			kind, ok := kindField.(string)
-			if !ok {
-				log.Debugf("bad kind value!")
-				return
+
+			if e.V != VERSION {
+				sock.fail(ERR_VERSION, e.Kind, fmt.Sprintf("this core speaks version %d", VERSION))
+				continue
+			}
+
+			switch e.Kind {
+			case BEGIN, RESUME:
+				if !bridge.authorized(e.Token) {
+					security.Warnf("bad token in %s handshake from %s (origin %q)", e.Kind, r.RemoteAddr, r.Header.Get("Origin"))
+					sock.fail(ERR_UNAUTHORIZED, e.Kind, "bad token")
+					continue
+				}
 			}
 
-			switch kind {
-			case "begin":
+			switch e.Kind {
+			case BEGIN:
+				bridge.quit(id, sock)
+
 				id, err = nanoid.New()
 				if err != nil {
 					log.Fatal("could not generate id!\n", err)
 				}
 
-				bridge.Sessions[id] = sock
-				bridge.Output <- OutputSessionStart{id}
+				bridge.join(id, sock)
+
+				bridge.Output <- OutputSessionStart{id, sock.client}
 
-			case "resume":
-				sessionField, there := bm["session"]
-				if !there {
-					log.Debug("missing session!")
-					return
+			case RESUME:
+				if e.Session == "" {
+					sock.fail(ERR_NO_SESSION, e.Kind, "missing session")
+					continue
 				}
-				session, ok := sessionField.(string)
-				if !ok {
-					log.Debug("bad session value!")
-					return
+
+				if e.Session != id {
+					bridge.quit(id, sock)
 				}
-				bridge.Sessions[session] = sock
-				bridge.Output <- OutputSessionResume{session}
 
-			default:
-				if id != "" {
-					messageField, there := bm["message"]
-					if !there {
-						log.Debug("missing message!")
-						return
-					}
-					message, ok := messageField.(msg.Message)
-					if !ok {
-						log.Debug("bad message!")
-						return
+				id = e.Session
+
+				bridge.join(id, sock)
+
+				bridge.Output <- OutputSessionResume{id, sock.client}
+
+			case MSG:
+				if id == "" {
+					sock.fail(ERR_NO_SESSION, e.Kind, "begin or resume a session first")
+					continue
+				}
+				if e.Msg == nil {
+					sock.fail(ERR_BAD_MESSAGE, e.Kind, "missing msg")
+					continue
+				}
+
+				bridge.Output <- OutputReceivedMessage{id, (*msg.Message)(e.Msg)}
+
+			case PAGE:
+				if sock.canPage(id, e) {
+					cursor, before := e.After, false
+					if e.Before != nil {
+						cursor, before = e.Before, true
 					}
-					bridge.Output <- OutputReceivedMessage{id, &message}
+					bridge.Output <- OutputPageRequest{id, sock.client, e.Slate, *cursor, e.Count, before}
+				}
+
+			case UPLOAD:
+				if sock.canTransfer(id, e.Kind) && sock.validTransfer(e) {
+					bridge.startUpload(sock, id, e)
+				}
+
+			case DOWNLOAD:
+				if sock.canTransfer(id, e.Kind) && sock.validTransfer(e) {
+					bridge.Output <- OutputBlobRequest{id, sock.client, e.Id, e.Blob}
 				}
+
+			default:
+				sock.fail(ERR_KIND, e.Kind, fmt.Sprintf("unknown kind %q", e.Kind))
 			}
 
 		case websocket.BinaryMessage:
-			log.Debugf("binary messages not implemented...")
+			if sock.canTransfer(id, UPLOAD) {
+				bridge.receiveChunk(sock, id, frame)
+			}
 		}
 	}
 }
+
+func (bridge *Bridge) join(session string, sock *socket) {
+	bridge.lock.Lock()
+	defer bridge.lock.Unlock()
+
+	if !slices.Contains(bridge.Sessions[session], sock) {
+		bridge.Sessions[session] = append(bridge.Sessions[session], sock)
+	}
+}
+
+// the socket is gone, or onto another session (the session stays as long as it has other sockets)
+func (bridge *Bridge) quit(session string, sock *socket) {
+	if session == "" {
+		return
+	}
+
+	bridge.lock.Lock()
+	socks := bridge.Sessions[session]
+	i := slices.Index(socks, sock)
+	if i != -1 {
+		socks = slices.Delete(slices.Clone(socks), i, i+1)
+		if len(socks) == 0 {
+			delete(bridge.Sessions, session)
+		} else {
+			bridge.Sessions[session] = socks
+		}
+	}
+	bridge.lock.Unlock()
+
+	if i != -1 {
+		bridge.Output <- OutputSessionQuit{session, sock.client}
+	}
+}
+
+// Browsers always send an origin, so only pages on localhost or on the allow-list get through.
+// Other clients may send none, and then only the token stands in their way.
+func (bridge *Bridge) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if slices.Contains(bridge.origins, origin) {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil {
+		switch u.Hostname() {
+		case "localhost", "127.0.0.1", "::1":
+			return true
+		}
+	}
+
+	security.Warnf("rejected websocket from %s with origin %q", r.RemoteAddr, origin)
+	return false
+}
+
+func (bridge *Bridge) authorized(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(bridge.token)) == 1
+}
@@ -0,0 +1,111 @@
+package bridge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestToken(t *testing.T) {
+	bridge := newBridge(nil)
+
+	server := httptest.NewServer(http.HandlerFunc(bridge.Session))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	roundTrip := func(e envelope) envelope {
+		if err := conn.WriteJSON(e); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var got envelope
+		if err := conn.ReadJSON(&got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	for _, e := range []envelope{
+		{V: VERSION, Kind: BEGIN},
+		{V: VERSION, Kind: BEGIN, Token: "nope"},
+		{V: VERSION, Kind: BEGIN, Token: bridge.token[1:]},
+		{V: VERSION, Kind: RESUME, Session: "someone-else"},
+		{V: VERSION, Kind: RESUME, Session: "someone-else", Token: strings.ToUpper(bridge.token)},
+	} {
+		got := roundTrip(e)
+		if got.Kind != ERROR || got.Error.Code != ERR_UNAUTHORIZED || got.Error.Kind != e.Kind {
+			t.Fatalf("%s with token %q: got %+v", e.Kind, e.Token, got)
+		}
+	}
+
+	// and none of them got a session
+	got := roundTrip(envelope{V: VERSION, Kind: MSG, Msg: &wireMessage{Slate: "setup", Kind: "text"}})
+	if got.Kind != ERROR || got.Error.Code != ERR_NO_SESSION {
+		t.Fatalf("got %+v", got)
+	}
+
+	bridge.lock.RLock()
+	sessions := len(bridge.Sessions)
+	bridge.lock.RUnlock()
+	if sessions != 0 {
+		t.Fatal("joined", sessions, "sessions")
+	}
+
+	// with the token, it's through
+	if err = conn.WriteJSON(envelope{V: VERSION, Kind: BEGIN, Token: bridge.token}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case out := <-bridge.Output:
+		if _, ok := out.(OutputSessionStart); !ok {
+			t.Fatalf("got %T", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't begin")
+	}
+}
+
+func TestWriteToken(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "slater")
+	bridge := newBridge(nil)
+
+	// a file left from before, which anyone could read
+	if err := os.MkdirAll(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, TOKENFILE), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := bridge.writeToken(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(path) {
+		t.Fatal("not an absolute path", path)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil || string(b) != bridge.token {
+		t.Fatal("didn't write the token", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("token file is %v", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,191 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/exp/slices"
+
+	"slater/core/msg"
+)
+
+//
+// The wire protocol between the core and the interface (see docs/bridge.md).
+//
+// Every text frame is one JSON envelope, with the protocol version and a kind:
+//
+//	{"v": 1, "kind": "msg", "msg": {"slate": "setup", "kind": "text", "body": "hi"}}
+//
+// Messages are flat on the wire: the fields of a msg.Message in lowercase,
+// with its content right alongside them.
+//
+
+const VERSION = 1
+
+// kinds of envelope
+const (
+	HELLO    = "hello"
+	BEGIN    = "begin"
+	RESUME   = "resume"
+	MSG      = "msg"
+	PAGE     = "page"
+	SLATE    = "slate"
+	SESSION  = "session"
+	ERROR    = "error"
+	UPLOAD   = "upload"
+	DOWNLOAD = "download"
+	LAYOUT   = "layout"
+)
+
+// capabilities
+const BINARY = "binary"
+
+// error codes
+const (
+	ERR_BAD_JSON     = "bad_json"
+	ERR_VERSION      = "version"
+	ERR_KIND         = "kind"
+	ERR_UNAUTHORIZED = "unauthorized"
+	ERR_NO_SESSION   = "no_session"
+	ERR_BAD_MESSAGE  = "bad_message"
+	ERR_CAPABILITY   = "capability"
+	ERR_TRANSFER     = "transfer"
+	ERR_BLOB         = "blob"
+	ERR_PAGE         = "page"
+)
+
+const MAX_PAGE = 200 // messages
+
+// optional parts of the protocol, which a client asks for in its hello
+var capabilities = []string{PAGE, BINARY}
+
+var errBadMessage = errors.New("bad message")
+
+type envelope struct {
+	V       int            `json:"v"`
+	Kind    string         `json:"kind"`
+	Token   string         `json:"token,omitempty"`
+	Session string         `json:"session,omitempty"`
+	Slate   string         `json:"slate,omitempty"`
+	Msg     *wireMessage   `json:"msg,omitempty"`
+	Page    []*wireMessage `json:"page,omitempty"`
+	Caps    []string       `json:"caps,omitempty"`
+	Error   *wireError     `json:"error,omitempty"`
+	Id      string         `json:"id,omitempty"` // of a transfer (see blobs.go)
+	Blob    string         `json:"blob,omitempty"`
+	Size    int            `json:"size,omitempty"`
+	Layout  []LayoutSlate  `json:"layout,omitempty"`
+	Before  *int           `json:"before,omitempty"` // cursors, for a page
+	After   *int           `json:"after,omitempty"`
+	Count   int            `json:"count,omitempty"`
+	From    *int           `json:"from,omitempty"` // where a page starts on its slate
+	Total   int            `json:"total,omitempty"`
+}
+
+// a slate in the user's layout (see core/layout.go)
+type LayoutSlate struct {
+	Slate    string `json:"slate"`
+	Title    string `json:"title"`
+	Open     bool   `json:"open"`
+	Archived bool   `json:"archived"`
+}
+
+type wireError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Kind    string `json:"kind,omitempty"` // of the envelope it's about
+}
+
+type wireMessage msg.Message
+
+func errorEnvelope(code, kind, message string) envelope {
+	return envelope{Kind: ERROR, Error: &wireError{code, message, kind}}
+}
+
+// the capabilities both sides have, in the order we list them
+func negotiate(asked []string) []string {
+	agreed := make([]string, 0)
+	for _, c := range capabilities {
+		if slices.Contains(asked, c) {
+			agreed = append(agreed, c)
+		}
+	}
+	return agreed
+}
+
+func (m *wireMessage) MarshalJSON() ([]byte, error) {
+	flat := make(map[string]any, len(m.Content)+7)
+	for k, v := range m.Content {
+		flat[k] = v
+	}
+
+	flat["slate"] = m.Slate
+	flat["kind"] = m.Kind
+	flat["sent"] = m.Sent
+
+	if m.User != "" {
+		flat["author"] = m.User
+	}
+	if m.Device != "" {
+		flat["device"] = m.Device
+		flat["seq"] = m.Seq
+	}
+	if m.Event != "" {
+		flat["event"] = m.Event
+	}
+
+	return json.Marshal(flat)
+}
+
+// the interface only gets to say what a message is about and what's in it,
+// so the fields the core fills in (author, device, seq, and so on) are dropped
+func (m *wireMessage) UnmarshalJSON(b []byte) error {
+	var flat map[string]any
+	if err := json.Unmarshal(b, &flat); err != nil {
+		return err
+	}
+
+	str := func(key string) (string, error) {
+		field, there := flat[key]
+		delete(flat, key)
+		if !there || field == nil {
+			return "", nil
+		}
+		s, ok := field.(string)
+		if !ok {
+			return "", errBadMessage
+		}
+		return s, nil
+	}
+
+	var err error
+	if m.Slate, err = str("slate"); err != nil {
+		return err
+	}
+	if m.Kind, err = str("kind"); err != nil {
+		return err
+	}
+	if m.Event, err = str("event"); err != nil {
+		return err
+	}
+
+	if m.Kind == "" {
+		return errBadMessage
+	}
+
+	if sentField, there := flat["sent"]; there {
+		sent, ok := sentField.(float64)
+		if !ok {
+			return errBadMessage
+		}
+		m.Sent = int64(sent)
+	}
+
+	for _, key := range []string{"author", "sent", "device", "seq", "stamp", "prev", "next"} {
+		delete(flat, key)
+	}
+
+	m.Content = flat
+
+	return nil
+}
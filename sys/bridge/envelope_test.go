@@ -0,0 +1,59 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"slater/core/msg"
+)
+
+func TestEnvelope(t *testing.T) {
+	frame := `{"v": 1, "kind": "msg", "msg": {"slate": "setup", "kind": "choice", "event": "setup:ready?", "choice": 1, "device": "sneaky", "author": "system", "body": "Yes"}}`
+
+	var e envelope
+	if err := json.Unmarshal([]byte(frame), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	m := (*msg.Message)(e.Msg)
+	if m.Slate != "setup" || m.Kind != "choice" || m.Event != "setup:ready?" {
+		t.Fatalf("bad fields: %+v", m)
+	}
+	if m.Device != "" || m.User != "" {
+		t.Fatal("took a device or an author from the interface")
+	}
+	if m.Content["choice"] != float64(1) || m.Content["body"] != "Yes" {
+		t.Fatalf("bad content: %v", m.Content)
+	}
+	if _, there := m.Content["kind"]; there {
+		t.Fatal("fields leaked into content")
+	}
+
+	out, err := json.Marshal(envelope{V: VERSION, Kind: MSG, Msg: &wireMessage{
+		Slate:   "setup",
+		User:    "system",
+		Kind:    "text",
+		Sent:    42,
+		Content: map[string]any{"body": "hi"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var flat struct {
+		Kind string
+		Msg  map[string]any
+	}
+	if err = json.Unmarshal(out, &flat); err != nil {
+		t.Fatal(err)
+	}
+	if flat.Kind != MSG || flat.Msg["author"] != "system" || flat.Msg["body"] != "hi" || flat.Msg["sent"] != float64(42) {
+		t.Fatalf("bad envelope: %s", out)
+	}
+
+	err = json.Unmarshal([]byte(`{"v": 1, "kind": "msg", "msg": {"slate": 3}}`), &e)
+	if !errors.Is(err, errBadMessage) {
+		t.Fatalf("expected a bad message, got %v", err)
+	}
+}
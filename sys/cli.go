@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	Core "slater/core"
+)
+
+//
+// Commands which run without the bridge:
+//
+//	slater backup <session> <file> [root]
+//	slater restore <session> <file> [root]
+//
+// Both ask for the passphrase and PIN on stdin.
+// A session must not be running while it's backed up.
+// Attachments aren't in backups (see core/backup.go).
+//
+
+func command(args []string, rootPath string) bool {
+	if len(args) < 1 {
+		return false
+	}
+
+	switch args[0] {
+	case "backup", "restore":
+	default:
+		return false
+	}
+
+	if len(args) < 3 {
+		fmt.Fprintf(os.Stderr, "usage: slater %s <session> <file> [root]\n", args[0])
+		os.Exit(2)
+	}
+
+	session, file := args[1], args[2]
+	if len(args) > 3 {
+		rootPath = args[3]
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	phrase := ask(in, "passphrase: ")
+	pin := ask(in, "PIN: ")
+
+	var err error
+
+	switch args[0] {
+	case "backup":
+		err = backup(rootPath, session, phrase, pin, file)
+	case "restore":
+		err = restore(rootPath, session, phrase, pin, file)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "😬", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Done.")
+	if args[0] == "backup" {
+		fmt.Println("Attachments (images, files, voice notes...) aren't in the backup: after a restore, they're fetched from your other devices.")
+	}
+	return true
+}
+
+func ask(in *bufio.Reader, prompt string) string {
+	fmt.Print(prompt)
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return strings.TrimSpace(line)
+}
+
+func backup(rootPath, session, phrase, pin, file string) error {
+	// write beside the file, so a failed backup never replaces a good one
+	tmp := file + ".partial"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = Core.Backup(rootPath, session, phrase, pin, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func restore(rootPath, session, phrase, pin, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return Core.Restore(rootPath, session, phrase, pin, f)
+}
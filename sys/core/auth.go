@@ -2,10 +2,12 @@ package core
 
 import (
 	"crypto/ed25519"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
 	"hash"
 	"io"
@@ -55,12 +57,41 @@ const (
 	DISCOVERY_PREFIX = "slater"
 	SALT             = "salt"
 	HASH             = "hash"
+	PENDING          = ".new"
 
-	ARGON_TIME   = 1
-	ARGON_MEM    = 64 * 1024
-	ARGON_KEYLEN = 32
+	ARGON_TIME    = 1
+	ARGON_MEM     = 64 * 1024
+	ARGON_THREADS = 4 // fixed, since a key has to stretch the same on every device
+	ARGON_KEYLEN  = 32
+	SALT_SIZE     = 16
 )
 
+// how a key is stretched
+type kdf struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+var argonKDF = kdf{ARGON_TIME, ARGON_MEM, ARGON_THREADS}
+
+// what keys were stretched with before the threads were fixed (only good on a device with the same number of cores)
+func legacyKDF() kdf {
+	return kdf{ARGON_TIME, ARGON_MEM, uint8(runtime.NumCPU())}
+}
+
+// whether it's worth stretching with (the parameters may come from a file)
+func (p kdf) sane() bool {
+	return p.Time >= 1 && p.Time <= 16*ARGON_TIME &&
+		p.Threads >= 1 &&
+		p.Memory >= 8*uint32(p.Threads) && p.Memory <= 16*ARGON_MEM
+}
+
+func (p kdf) stretch(salt []byte, things ...string) []byte {
+	s := strings.Join(things, "")
+	return argon2.IDKey([]byte(s), salt, p.Time, p.Memory, p.Threads, ARGON_KEYLEN)
+}
+
 func generateSessionName() string {
 	return humid.GenerateWithOptions(&humid.Options{
 		List:           wordlist.Animals,
@@ -93,13 +124,54 @@ func discoveryKey(parts ...string) string {
 }
 
 func createMasterKey(rootPath, sessionID, phrase, pin string) string {
-	salt, _ := createSalt(rootPath, sessionID)
+	k, commit, err := prepareMasterKey(rootPath, sessionID, phrase, pin)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err = commit(); err != nil {
+		log.Panic(err)
+	}
+	return k
+}
+
+// Derive a master key with a new salt, saving the new salt and hash beside the current ones.
+// They only replace the current ones when commit is called,
+// so the data key can be rewrapped in between without risking the only working salt.
+func prepareMasterKey(rootPath, sessionID, phrase, pin string) (string, func() error, error) {
+	salt := newSalt()
 	k := stretch(salt, sessionID, phrase, pin)
+	commit, err := prepareStretchedKey(rootPath, sessionID, salt, k)
+	return string(k), commit, err
+}
+
+// the same, for a key stretched on another device (see rotate.go)
+func prepareStretchedKey(rootPath, sessionID string, salt, k []byte) (func() error, error) {
+	dpath := filepath.Join(rootPath, sessionID)
+	if err := os.MkdirAll(dpath, 0700); err != nil {
+		return nil, err
+	}
+
 	hash := blake2b.Sum256(k)
 	s := hex.EncodeToString(hash[:])
-	path := filepath.Join(rootPath, sessionID, HASH)
-	ioutil.WriteFile(path, []byte(s), 0600)
-	return string(k)
+
+	saltPath := filepath.Join(dpath, SALT)
+	hashPath := filepath.Join(dpath, HASH)
+
+	if err := ioutil.WriteFile(saltPath+PENDING, salt, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(hashPath+PENDING, []byte(s), 0600); err != nil {
+		return nil, err
+	}
+
+	commit := func() error {
+		if err := os.Rename(saltPath+PENDING, saltPath); err != nil {
+			return err
+		}
+		return os.Rename(hashPath+PENDING, hashPath)
+	}
+
+	return commit, nil
 }
 
 func getMasterKey(rootPath, sessionID, phrase, pin string) (string, error) {
@@ -134,11 +206,41 @@ func getMasterKey(rootPath, sessionID, phrase, pin string) (string, error) {
 		}
 	}
 	if s != string(savedHash) {
+		// a rotation may have been interrupted while committing the new salt and hash
+		if k, err := getPendingMasterKey(rootPath, sessionID, phrase, pin); err == nil {
+			return k, nil
+		}
+		return "", errAuthFail
+	}
+	return string(k), nil
+}
+
+// (part of a pending salt and hash may have been committed already)
+func getPendingMasterKey(rootPath, sessionID, phrase, pin string) (string, error) {
+	salt, err := readPending(filepath.Join(rootPath, sessionID, SALT))
+	if err != nil {
+		return "", err
+	}
+	savedHash, err := readPending(filepath.Join(rootPath, sessionID, HASH))
+	if err != nil {
+		return "", err
+	}
+	k := stretch(salt, sessionID, phrase, pin)
+	hash := blake2b.Sum256(k)
+	if hex.EncodeToString(hash[:]) != string(savedHash) {
 		return "", errAuthFail
 	}
 	return string(k), nil
 }
 
+func readPending(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path + PENDING)
+	if errors.Is(err, os.ErrNotExist) {
+		return ioutil.ReadFile(path)
+	}
+	return b, err
+}
+
 func deriveSignatureKey(sessionID, phrase, pin string) (ed25519.PrivateKey, error) {
 	seed := make([]byte, ed25519.SeedSize)
 	secret := []byte(sessionID + phrase + pin)
@@ -153,28 +255,70 @@ func deriveSignatureKey(sessionID, phrase, pin string) (ed25519.PrivateKey, erro
 	return key, nil
 }
 
+// the symmetric key for payloads on the discovery topic, so only devices can read them
+func deriveTopicKey(sessionID, phrase, pin string) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	secret := framed(sessionID, phrase, pin)
+	info := []byte("yeah, slater! topic")
+	hashFunc := func() hash.Hash { h, _ := blake2b.New256(nil); return h }
+	hkdf := hkdf.New(hashFunc, secret, nil, info)
+	if _, err := io.ReadFull(hkdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// each part after its length, so one can't run into the next
+// ("ab"+"c" and "a"+"bc" are different secrets)
+func framed(parts ...string) []byte {
+	out := make([]byte, 0)
+	size := make([]byte, 4)
+	for _, part := range parts {
+		binary.BigEndian.PutUint32(size, uint32(len(part)))
+		out = append(append(out, size...), part...)
+	}
+	return out
+}
+
+// what the credentials are to the network
+// (so a rotation can hand these to the other devices, instead of the passphrase and PIN themselves)
+type netKeys struct {
+	DiscoveryKey string
+	TopicKey     []byte
+	SignSeed     []byte
+}
+
+func deriveNetKeys(sessionID, phrase, pin string) (netKeys, error) {
+	signKey, err := deriveSignatureKey(sessionID, phrase, pin)
+	if err != nil {
+		return netKeys{}, err
+	}
+
+	topicKey, err := deriveTopicKey(sessionID, phrase, pin)
+	if err != nil {
+		return netKeys{}, err
+	}
+
+	return netKeys{discoveryKey(sessionID, phrase, pin), topicKey, signKey.Seed()}, nil
+}
+
 var errLostSalt = errors.New("☠️ salt file missing")
 var errLostHash = errors.New("☠️ hash file missing")
 var errAuthFail = errors.New("passphrase and pin verification failed")
 
-func stretch(salt []byte, things ...string) []byte {
-	threads := uint8(runtime.NumCPU())
-	s := strings.Join(things, "")
-	return argon2.IDKey([]byte(s), salt, ARGON_TIME, ARGON_MEM, threads, ARGON_KEYLEN)
+// A salt file holds the salt, then the threads it's stretched with.
+// Salt files from before the threads were fixed are just the salt.
+func newSalt() []byte {
+	return append(frand.Bytes(SALT_SIZE), ARGON_THREADS)
 }
 
-func createSalt(rootPath, sessionID string) (salt []byte, err error) {
-	dpath := filepath.Join(rootPath, sessionID)
-	fpath := filepath.Join(dpath, SALT)
-	if err = os.MkdirAll(dpath, 0700); err != nil {
-		return nil, err
-	}
-	salt = frand.Bytes(16)
-	err = ioutil.WriteFile(fpath, salt, 0600)
-	if err != nil {
-		return nil, err
+func stretch(salt []byte, things ...string) []byte {
+	if len(salt) == SALT_SIZE+1 {
+		p := argonKDF
+		p.Threads = salt[SALT_SIZE]
+		return p.stretch(salt[:SALT_SIZE], things...)
 	}
-	return
+	return legacyKDF().stretch(salt, things...)
 }
 
 func getSalt(rootPath, sessionID string) (salt []byte, err error) {
@@ -0,0 +1,399 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/frand"
+
+	"slater/core/msg"
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+//
+// Backups of a whole identity, in one encrypted file.
+//
+// A backup is:
+//
+//	[magic: "slater-backup"][version: 1 byte][time: 4 bytes][memory: 4 bytes][threads: 1 byte][salt: 16 bytes][sealed archive]
+//
+// The archive is sealed (see seal.go) with a key stretched from the credentials
+// with the Argon2 parameters and salt in the header, and the header is authenticated along with it.
+// (Version 1 had no parameters, and stretched with as many threads as the device had cores.)
+// It holds the salt, hash and keyring from the session directory, the libp2p key, the roster,
+// and every message of every persistent slate.
+//
+// Attachments are NOT backed up: blobs (see store/blob.go) would make the archive too big to build in memory.
+// A restored session still refers to them, and wants them again from the other devices (see blobSync.go),
+// so they only come back if another device is still around with them.
+//
+// Restoring checks everything in the archive before writing anything,
+// and never writes over a session which already exists.
+//
+
+const (
+	BACKUP_MAGIC   = "slater-backup"
+	BACKUP_VERSION = 2
+	BACKUP_SALT    = 16
+	BACKUP_KDF     = 4 + 4 + 1
+)
+
+var (
+	errBadBackup     = errors.New("not a slater backup, or a damaged one")
+	errBackupVersion = errors.New("backup is from a newer version of slater")
+	errSessionExists = errors.New("session already exists")
+)
+
+type archive struct {
+	Session string
+	Created int64
+	Salt    []byte
+	Hash    []byte
+	Keyring []byte
+	Key     []byte
+	Roster  []byte
+	Slates  map[string][][]byte
+}
+
+func backupKey(p kdf, salt []byte, sessionID, phrase, pin string) string {
+	return string(p.stretch(salt, "backup", sessionID, phrase, pin))
+}
+
+func backupHeader(p kdf, salt []byte) []byte {
+	params := make([]byte, BACKUP_KDF)
+	binary.BigEndian.PutUint32(params, p.Time)
+	binary.BigEndian.PutUint32(params[4:], p.Memory)
+	params[8] = p.Threads
+
+	header := append([]byte(BACKUP_MAGIC), BACKUP_VERSION)
+	header = append(header, params...)
+	return append(header, salt...)
+}
+
+// the header of a backup, and what to stretch its key with
+func readHeader(b []byte) (header []byte, p kdf, salt []byte, err error) {
+	n := len(BACKUP_MAGIC)
+	if len(b) < n+1 || !bytes.HasPrefix(b, []byte(BACKUP_MAGIC)) {
+		return nil, p, nil, errBadBackup
+	}
+
+	version := b[n]
+	if version > BACKUP_VERSION {
+		return nil, p, nil, errBackupVersion
+	}
+	n++
+
+	if version == 1 {
+		p = legacyKDF()
+	} else {
+		if len(b) < n+BACKUP_KDF {
+			return nil, p, nil, errBadBackup
+		}
+		p.Time = binary.BigEndian.Uint32(b[n:])
+		p.Memory = binary.BigEndian.Uint32(b[n+4:])
+		p.Threads = b[n+8]
+		n += BACKUP_KDF
+		if !p.sane() {
+			return nil, p, nil, errBadBackup
+		}
+	}
+
+	if len(b) < n+BACKUP_SALT {
+		return nil, p, nil, errBadBackup
+	}
+	n += BACKUP_SALT
+
+	return b[:n], p, b[n-BACKUP_SALT : n], nil
+}
+
+// write a backup of a session, which must not be running
+func Backup(rootPath, sessionID, phrase, pin string, w io.Writer) error {
+	masterKey, err := getMasterKey(rootPath, sessionID, phrase, pin)
+	if err != nil {
+		return err
+	}
+
+	db, _, err := openSessionStore(rootPath, sessionID, masterKey)
+	if err != nil {
+		return err
+	}
+	defer db.Store.Close()
+
+	dpath := filepath.Join(rootPath, sessionID)
+
+	a := archive{
+		Session: sessionID,
+		Created: msg.Timestamp(),
+		Slates:  make(map[string][][]byte),
+	}
+
+	if a.Salt, err = getSalt(rootPath, sessionID); err != nil {
+		return err
+	}
+	if a.Hash, err = ioutil.ReadFile(filepath.Join(dpath, HASH)); err != nil {
+		return err
+	}
+	if a.Keyring, err = ioutil.ReadFile(filepath.Join(dpath, KEYRING)); err != nil {
+		return err
+	}
+	if a.Key, err = db.Get(KEYKEY); err != nil {
+		return err
+	}
+	if a.Roster, err = db.Get(DEVICESKEY); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+
+	names, err := listSlates(db)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		s := slate.NewPersistentSlate(name, "", db)
+
+		msgs, err := s.GetRange(0, int(s.Count())-1)
+		if err != nil {
+			return err
+		}
+
+		encoded := make([][]byte, 0, len(msgs))
+		for _, m := range msgs {
+			b, err := msg.Encode(m)
+			if err != nil {
+				return err
+			}
+			encoded = append(encoded, b)
+		}
+
+		a.Slates[name] = encoded
+	}
+
+	plain, err := cbor.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	salt := frand.Bytes(BACKUP_SALT)
+	header := backupHeader(argonKDF, salt)
+
+	s, err := keySealer(backupKey(argonKDF, salt, sessionID, phrase, pin))
+	if err != nil {
+		return err
+	}
+
+	sealed, err := s.seal(string(header), plain)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// restore a session from a backup, as long as there isn't one by that name already
+func Restore(rootPath, sessionID, phrase, pin string, r io.Reader) error {
+	dpath := filepath.Join(rootPath, sessionID)
+
+	if _, err := os.Stat(dpath); err == nil {
+		return errSessionExists
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	header, p, salt, err := readHeader(b)
+	if err != nil {
+		return err
+	}
+
+	s, err := keySealer(backupKey(p, salt, sessionID, phrase, pin))
+	if err != nil {
+		return err
+	}
+
+	plain, err := s.open(string(header), b[len(header):])
+	if err != nil {
+		return errAuthFail // or damaged, there's no telling which
+	}
+
+	a, msgs, dataKey, err := checkArchive(plain, sessionID, phrase, pin)
+	if err != nil {
+		return err
+	}
+
+	// everything checks out, so write it
+
+	err = writeArchive(rootPath, a, msgs, dataKey)
+	if err != nil {
+		os.RemoveAll(dpath)
+	}
+
+	return err
+}
+
+// decode everything in an archive, so that nothing is written unless all of it is good
+func checkArchive(plain []byte, sessionID, phrase, pin string) (*archive, map[string][]*msg.Message, string, error) {
+	a := new(archive)
+	if err := cbor.Unmarshal(plain, a); err != nil {
+		return nil, nil, "", errBadBackup
+	}
+
+	if a.Session != sessionID {
+		return nil, nil, "", errBadBackup
+	}
+
+	k := stretch(a.Salt, sessionID, phrase, pin)
+	hash := blake2b.Sum256(k)
+	if hex.EncodeToString(hash[:]) != string(a.Hash) {
+		return nil, nil, "", errBadBackup
+	}
+
+	ring := new(keyring)
+	if err := cbor.Unmarshal(a.Keyring, ring); err != nil {
+		return nil, nil, "", errBadBackup
+	}
+	dataKey, err := ring.unwrap(PASSWORD_SLOT, string(k))
+	if err != nil {
+		return nil, nil, "", errBadBackup
+	}
+
+	if _, err := crypto.UnmarshalPrivateKey(a.Key); err != nil {
+		return nil, nil, "", errBadBackup
+	}
+
+	if a.Roster != nil {
+		signKey, err := deriveSignatureKey(sessionID, phrase, pin)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		entries, err := decodeRoster(a.Roster)
+		if err != nil {
+			return nil, nil, "", errBadBackup
+		}
+		for _, e := range entries {
+			if !e.verify(signKey.Public().(ed25519.PublicKey)) {
+				return nil, nil, "", errBadBackup
+			}
+		}
+	}
+
+	msgs := make(map[string][]*msg.Message)
+	for name, encoded := range a.Slates {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, nil, "", errBadBackup
+		}
+		for _, b := range encoded {
+			m, err := msg.Decode(b)
+			if err != nil || m.Slate != name {
+				return nil, nil, "", errBadBackup
+			}
+			msgs[name] = append(msgs[name], m)
+		}
+	}
+
+	return a, msgs, dataKey, nil
+}
+
+func writeArchive(rootPath string, a *archive, msgs map[string][]*msg.Message, dataKey string) error {
+	dpath := filepath.Join(rootPath, a.Session)
+
+	if err := os.MkdirAll(dpath, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dpath, SALT), a.Salt, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dpath, HASH), a.Hash, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dpath, KEYRING), a.Keyring, 0600); err != nil {
+		return err
+	}
+
+	db, err := store.OpenStore(rootPath, a.Session, dataKey)
+	if err != nil {
+		return err
+	}
+	defer db.Store.Close()
+
+	if err = db.Put([]string{KEYKEY}, a.Key); err != nil {
+		return err
+	}
+	if a.Roster != nil {
+		if err = db.Put([]string{DEVICESKEY}, a.Roster); err != nil {
+			return err
+		}
+	}
+
+	privKey, _ := crypto.UnmarshalPrivateKey(a.Key)
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(a.Slates))
+	for name := range a.Slates {
+		names = append(names, name)
+	}
+
+	bytes, err := cbor.Marshal(names)
+	if err != nil {
+		return err
+	}
+	if err = db.Put([]string{SLATESKEY}, bytes); err != nil {
+		return err
+	}
+
+	// attachments aren't in the archive, so they're wanted from the other devices
+	wants := make(map[string]string)
+
+	for _, name := range names {
+		s := slate.NewPersistentSlate(name, id.String(), db)
+		for _, m := range msgs[name] {
+			if err = s.Recv(m); err != nil {
+				return err
+			}
+
+			blob, ok := m.Content[BLOBFIELD].(string)
+			if !ok {
+				continue
+			}
+			c, err := store.ParseBlob(blob)
+			if err != nil {
+				continue
+			}
+			if err = db.Ref(c); err != nil {
+				return err
+			}
+			wants[c.String()] = name
+		}
+	}
+
+	if len(wants) == 0 {
+		return nil
+	}
+
+	bytes, err = cbor.Marshal(wants)
+	if err != nil {
+		return err
+	}
+	return db.Put([]string{WANTSKEY}, bytes)
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"lukechampine.com/frand"
+
+	"slater/core/msg"
+	"slater/core/slate"
+)
+
+func TestBackupRestore(t *testing.T) {
+	root := t.TempDir()
+	name, phrase, pin := "brave-little-otter", "one two three four five six", "1234"
+
+	key := createMasterKey(root, name, phrase, pin)
+
+	db, _, err := openSessionStore(root, name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privKey, _, err := crypto.GenerateEd25519Key(frand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := crypto.MarshalPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]string{KEYKEY}, keyBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	signKey, err := deriveSignatureKey(name, phrase, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = newRoster().load(db, signKey, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := slate.NewPersistentSlate("chat", "a", db)
+	for _, body := range []string{"one", "two", "three"} {
+		if err = s.Write(&msg.Message{Slate: "chat", Kind: "text", Content: map[string]any{"body": body}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := db.WriteBlob(bytes.NewReader([]byte("a picture of a cat")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Write(&msg.Message{Slate: "chat", Kind: "image", Content: map[string]any{BLOBFIELD: c.String()}}); err != nil {
+		t.Fatal(err)
+	}
+	names, err := cbor.Marshal([]string{"chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]string{SLATESKEY}, names); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Store.Close()
+
+	var b bytes.Buffer
+	if err = Backup(root, name, phrase, pin, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Restore(root, name, phrase, pin, bytes.NewReader(b.Bytes())); !errors.Is(err, errSessionExists) {
+		t.Fatalf("expected %v, got %v", errSessionExists, err)
+	}
+
+	other := t.TempDir()
+
+	if err = Restore(other, name, phrase, "4321", bytes.NewReader(b.Bytes())); !errors.Is(err, errAuthFail) {
+		t.Fatalf("expected %v, got %v", errAuthFail, err)
+	}
+
+	damaged := append([]byte{}, b.Bytes()...)
+	damaged[len(damaged)-1] ^= 1
+	if err = Restore(other, name, phrase, pin, bytes.NewReader(damaged)); err == nil {
+		t.Fatal("restored a damaged backup")
+	}
+
+	if _, err = os.Stat(filepath.Join(other, name)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("a failed restore wrote something")
+	}
+
+	if err = Restore(other, name, phrase, pin, bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err = getMasterKey(other, name, phrase, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, _, err = openSessionStore(other, name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Store.Close()
+
+	restored, err := db.Get(KEYKEY)
+	if err != nil || !bytes.Equal(restored, keyBytes) {
+		t.Fatal("libp2p key was not restored")
+	}
+
+	r := newRoster()
+	if err = r.load(db, signKey, "a"); err != nil || !r.isDevice("a") {
+		t.Fatal("roster was not restored")
+	}
+
+	msgs, err := slate.NewPersistentSlate("chat", "a", db).GetRange(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, body := range []string{"one", "two", "three"} {
+		if msgs[i].Content["body"] != body {
+			t.Fatalf("expected %s at %d, got %v", body, i, msgs[i].Content["body"])
+		}
+	}
+
+	// attachments aren't backed up, but they're wanted
+	core := &Core{store: db}
+	wants, err := core.loadWants()
+	if err != nil || wants[c.String()] != "chat" {
+		t.Fatalf("blob isn't wanted: %v, %v", wants, err)
+	}
+	if there, err := db.HasBlob(c); err != nil || there {
+		t.Fatalf("blob was restored: %v, %v", there, err)
+	}
+}
+
+func TestBackupHeader(t *testing.T) {
+	salt := frand.Bytes(BACKUP_SALT)
+
+	header, p, s, err := readHeader(append(backupHeader(argonKDF, salt), "sealed"...))
+	if err != nil || p != argonKDF || !bytes.Equal(s, salt) || len(header) != len(BACKUP_MAGIC)+1+BACKUP_KDF+BACKUP_SALT {
+		t.Fatalf("header didn't read back: %v, %v", p, err)
+	}
+
+	// version 1 had no parameters
+	old := append(append([]byte(BACKUP_MAGIC), 1), salt...)
+	if _, p, s, err = readHeader(old); err != nil || p != legacyKDF() || !bytes.Equal(s, salt) {
+		t.Fatalf("version 1 header didn't read: %v, %v", p, err)
+	}
+
+	for _, bad := range []kdf{
+		{ARGON_TIME, ARGON_MEM, 0},
+		{0, ARGON_MEM, ARGON_THREADS},
+		{ARGON_TIME, 1 << 30, ARGON_THREADS},
+	} {
+		if _, _, _, err = readHeader(backupHeader(bad, salt)); !errors.Is(err, errBadBackup) {
+			t.Fatalf("read a header with %v: %v", bad, err)
+		}
+	}
+
+	if _, _, _, err = readHeader(backupHeader(argonKDF, salt)[:20]); !errors.Is(err, errBadBackup) {
+		t.Fatalf("read a short header: %v", err)
+	}
+}
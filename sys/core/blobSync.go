@@ -0,0 +1,439 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"slater/core/msg"
+	"slater/core/store"
+)
+
+//
+// Blob transfer between devices, Bitswap style.
+//
+// When a message arrives referring to a blob this device doesn't have, the device wants the blob:
+// first its manifest, then whichever of its chunks are missing (see store/blob.go).
+// It asks the other devices for them in want lists, a few lists at a time, spread over the devices it's connected to,
+// and checks every block against its CID before keeping it.
+// Blocks are kept as they arrive, so an interrupted transfer picks up where it left off,
+// and wanted blobs are saved, so transfers carry on after a restart too.
+//
+// The requesting device writes one wantList frame and closes its side of the stream.
+// The other device answers with one block frame per want, in order, with no data for the ones it doesn't have.
+//
+// Progress goes to the interface as blob:progress messages on the slate the blob is attached on
+// (just to the interface, they're not written on the slate).
+//
+
+const (
+	BLOBS_PROTOCOL = "/slater/blobs/1.0.0"
+	WANTSKEY       = "w"
+	WANT_BATCH     = 16 // blocks per want list
+	BLOB_TRANSFERS = 4  // want lists in flight at once, per blob
+	BLOB_RETRIES   = 5
+	BLOB_PROGRESS  = "blob:progress"
+)
+
+var (
+	errNoDevices  = errors.New("blobs: no devices connected")
+	errIncomplete = errors.New("blobs: still missing chunks")
+)
+
+type wantList struct {
+	Wants [][]byte
+}
+
+type block struct {
+	Cid  []byte
+	Data []byte
+}
+
+func (core *Core) handleBlobsStream(stream network.Stream) {
+	defer stream.Close()
+
+	remote := stream.Conn().RemotePeer().String()
+	if !core.roster.isDevice(remote) {
+		log.Debugf("blobs stream from unknown peer %s", remote)
+		stream.Reset()
+		return
+	}
+
+	stream.SetReadDeadline(time.Now().Add(SYNC_TIMEOUT))
+
+	var wants wantList
+	if err := cbor.NewDecoder(stream).Decode(&wants); err != nil || len(wants.Wants) > WANT_BATCH {
+		log.Debug("bad want list from ", remote)
+		stream.Reset()
+		return
+	}
+
+	enc := cbor.NewEncoder(stream)
+
+	for _, want := range wants.Wants {
+		b := block{Cid: want}
+
+		c, err := cid.Cast(want)
+		if err == nil {
+			switch c.Type() {
+			case cid.Raw:
+				b.Data, err = core.store.GetChunk(c)
+			case cid.DagCBOR:
+				b.Data, err = core.store.ManifestBytes(c)
+			}
+		}
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Error(err)
+		}
+
+		stream.SetWriteDeadline(time.Now().Add(SYNC_TIMEOUT))
+		if err = enc.Encode(b); err != nil {
+			log.Debug(err)
+			stream.Reset()
+			return
+		}
+	}
+}
+
+// ask another device for blocks, handing each one it has to fn
+func (core *Core) want(pid peer.ID, cids []cid.Cid, fn func(cid.Cid, []byte) error) error {
+	host := core.getHost()
+
+	ctx, cancel := context.WithTimeout(host.ctx, SYNC_TIMEOUT)
+	defer cancel()
+
+	stream, err := host.host.NewStream(ctx, pid, BLOBS_PROTOCOL)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	wants := wantList{Wants: make([][]byte, len(cids))}
+	for i, c := range cids {
+		wants.Wants[i] = c.Bytes()
+	}
+
+	stream.SetWriteDeadline(time.Now().Add(SYNC_TIMEOUT))
+	if err = cbor.NewEncoder(stream).Encode(wants); err != nil {
+		stream.Reset()
+		return err
+	}
+	if err = stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return err
+	}
+
+	dec := cbor.NewDecoder(bufio.NewReader(stream))
+
+	for _, c := range cids {
+		stream.SetReadDeadline(time.Now().Add(SYNC_TIMEOUT))
+
+		var b block
+		if err = dec.Decode(&b); err != nil {
+			stream.Reset()
+			return err
+		}
+
+		if !c.Equals(cidOf(b.Cid)) {
+			stream.Reset()
+			return errBadFrame
+		}
+
+		if len(b.Data) == 0 {
+			continue // they don't have it either
+		}
+
+		if err = fn(c, b.Data); err != nil {
+			stream.Reset()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cidOf(b []byte) cid.Cid {
+	c, err := cid.Cast(b)
+	if err != nil {
+		return cid.Undef
+	}
+	return c
+}
+
+// a message arrived from another device, so count it as a reference to its blob, and fetch the blob if need be
+func (core *Core) wantBlob(slateName string, m *msg.Message) {
+	field, there := m.Content[BLOBFIELD]
+	if !there {
+		return
+	}
+	blob, ok := field.(string)
+	if !ok {
+		return
+	}
+	c, err := store.ParseBlob(blob)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	if err = core.store.Ref(c); err != nil {
+		log.Error(err)
+		return
+	}
+
+	there, err = core.store.HasBlob(c)
+	if err != nil || there {
+		return
+	}
+
+	if err = core.saveWant(c, slateName); err != nil {
+		log.Error(err)
+	}
+
+	go core.fetchBlob(c, slateName)
+}
+
+// blob cid -> the slate it's attached on
+func (core *Core) loadWants() (map[string]string, error) {
+	wants := make(map[string]string)
+
+	bytes, err := core.store.Get(WANTSKEY)
+	if errors.Is(err, store.ErrNotFound) {
+		return wants, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = cbor.Unmarshal(bytes, &wants)
+	return wants, err
+}
+
+func (core *Core) saveWant(c cid.Cid, slateName string) error {
+	return core.changeWants(func(wants map[string]string) {
+		wants[c.String()] = slateName
+	})
+}
+
+func (core *Core) dropWant(c cid.Cid) error {
+	return core.changeWants(func(wants map[string]string) {
+		delete(wants, c.String())
+	})
+}
+
+func (core *Core) changeWants(change func(map[string]string)) error {
+	core.wantsLock.Lock()
+	defer core.wantsLock.Unlock()
+
+	wants, err := core.loadWants()
+	if err != nil {
+		return err
+	}
+
+	change(wants)
+
+	bytes, err := cbor.Marshal(wants)
+	if err != nil {
+		return err
+	}
+	return core.store.Put([]string{WANTSKEY}, bytes)
+}
+
+// carry on with the transfers from before a restart (or a reconnect)
+func (core *Core) resumeBlobs() {
+	core.wantsLock.Lock()
+	wants, err := core.loadWants()
+	core.wantsLock.Unlock()
+
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for blob, slateName := range wants {
+		c, err := store.ParseBlob(blob)
+		if err != nil {
+			log.Debug(err)
+			continue
+		}
+		go core.fetchBlob(c, slateName)
+	}
+}
+
+func (core *Core) fetchBlob(c cid.Cid, slateName string) {
+	key := c.String()
+
+	core.lock.Lock()
+	if core.fetches[key] {
+		core.lock.Unlock()
+		return
+	}
+	core.fetches[key] = true
+	core.lock.Unlock()
+
+	defer func() {
+		core.lock.Lock()
+		delete(core.fetches, key)
+		core.lock.Unlock()
+	}()
+
+	for attempt := 1; attempt <= BLOB_RETRIES; attempt++ {
+		err := core.fetchBlocks(c, slateName)
+		if err == nil {
+			if err = core.dropWant(c); err != nil {
+				log.Error(err)
+			}
+			return
+		}
+
+		log.Debugf("transfer of blob %s interrupted (attempt %d): %s", c, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	// it's still wanted, so it's tried again when another device turns up, or on a restart
+}
+
+func (core *Core) fetchBlocks(c cid.Cid, slateName string) error {
+	devices := core.connectedDevices()
+	if len(devices) == 0 {
+		return errNoDevices
+	}
+
+	manifest, err := core.store.GetManifest(c)
+	if errors.Is(err, store.ErrNotFound) {
+		for _, pid := range devices {
+			err = core.want(pid, []cid.Cid{c}, core.store.PutManifest)
+			if err == nil {
+				manifest, err = core.store.GetManifest(c)
+			}
+			if err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	missing, err := core.store.MissingChunks(c)
+	if err != nil {
+		return err
+	}
+
+	sizes := make(map[string]int64, len(manifest.Chunks))
+	for _, chunk := range manifest.Chunks {
+		sizes[string(chunk.Cid)] = int64(chunk.Size)
+	}
+
+	received := manifest.Size
+	for _, m := range missing {
+		received -= sizes[string(m.Bytes())]
+	}
+
+	progress := &sync.Mutex{}
+	core.blobProgress(slateName, c, received, manifest.Size)
+
+	batches := make(chan []cid.Cid, len(missing)/WANT_BATCH+1)
+	for from := 0; from < len(missing); from += WANT_BATCH {
+		to := from + WANT_BATCH
+		if to > len(missing) {
+			to = len(missing)
+		}
+		batches <- missing[from:to]
+	}
+	close(batches)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < BLOB_TRANSFERS; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			// each transfer starts on a different device, and moves on to the next one when a list fails
+			for batch := range batches {
+				for j := range devices {
+					pid := devices[(i+j)%len(devices)]
+
+					err := core.want(pid, batch, func(cc cid.Cid, data []byte) error {
+						if err := core.store.PutChunk(cc, data); err != nil {
+							return err
+						}
+
+						progress.Lock()
+						received += int64(len(data))
+						core.blobProgress(slateName, c, received, manifest.Size)
+						progress.Unlock()
+
+						return nil
+					})
+					if err == nil {
+						break
+					}
+					log.Debugf("want list to %s failed: %s", pid, err)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if missing, err = core.store.MissingChunks(c); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errIncomplete
+	}
+
+	return nil
+}
+
+// just to the interface, in the views with the slate open
+func (core *Core) blobProgress(slateName string, c cid.Cid, received, size int64) {
+	m := &msg.Message{
+		Slate: slateName,
+		User:  "system",
+		Kind:  BLOB_PROGRESS,
+		Sent:  msg.Timestamp(),
+		Content: map[string]any{
+			"blob":     c.String(),
+			"received": received,
+			"size":     size,
+		},
+	}
+
+	core.toViews(m)
+}
+
+// the devices on the roster this device is connected to right now
+func (core *Core) connectedDevices() []peer.ID {
+	host := core.getHost()
+	self := host.host.ID().String()
+
+	connected := make([]peer.ID, 0)
+
+	for _, device := range core.roster.devices() {
+		if device == self {
+			continue
+		}
+
+		pid, err := peer.Decode(device)
+		if err != nil {
+			continue
+		}
+
+		if host.host.Network().Connectedness(pid) == network.Connected {
+			connected = append(connected, pid)
+		}
+	}
+
+	return connected
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"slater/core/msg"
+	"slater/core/store"
+)
+
+//
+// Blobs to and from the interface (the bridge carries them in binary frames, see docs/bridge.md).
+//
+// A message refers to a blob by its CID, alongside whatever describes it:
+//
+//	{"kind": "image", "blob": "<cid>", "size": 1234, "mime": "image/png", "name": "cat.png"}
+//
+// The blob itself goes in the blob store (see store/blob.go), so it never goes through JSON.
+// Messages on persistent slates count as references to their blobs, and unreferenced blobs get collected.
+// Messages are never dropped (an archived slate keeps them, and a backup is only ever restored into a new session),
+// so a blob that made it onto a persistent slate is kept for good; only a message which fails to be written lets go of its blob.
+//
+
+const (
+	BLOBFIELD       = "blob"
+	BLOB_GRACE      = 24 * time.Hour // for an upload to be referred to
+	BLOB_COLLECTION = time.Hour
+)
+
+var errNoStore = errors.New("not set up yet")
+
+func (core *Core) handleUIBlob(sid, client, transfer string, data io.ReadCloser) {
+	defer data.Close()
+
+	if core.store.Store == nil {
+		core.Output <- OutputBlobStored{sid, client, transfer, "", errNoStore}
+		return
+	}
+
+	c, err := core.store.WriteBlob(data)
+	if err != nil {
+		log.Debug(err)
+		core.Output <- OutputBlobStored{sid, client, transfer, "", err}
+		return
+	}
+
+	core.Output <- OutputBlobStored{sid, client, transfer, c.String(), nil}
+}
+
+func (core *Core) handleBlobRequest(sid, client, transfer, blob string) {
+	if core.store.Store == nil {
+		core.Output <- OutputBlob{sid, client, transfer, blob, 0, nil, errNoStore}
+		return
+	}
+
+	c, err := store.ParseBlob(blob)
+	if err != nil {
+		core.Output <- OutputBlob{sid, client, transfer, blob, 0, nil, err}
+		return
+	}
+
+	r, err := core.store.OpenBlob(c)
+	if err != nil {
+		core.Output <- OutputBlob{sid, client, transfer, blob, 0, nil, err}
+		return
+	}
+
+	core.Output <- OutputBlob{sid, client, transfer, blob, r.Size(), r, nil}
+}
+
+// whether the blob a message refers to (if any) is all here, counting the message as a reference to it
+func (core *Core) refBlob(m *msg.Message, persistent bool) bool {
+	field, there := m.Content[BLOBFIELD]
+	if !there {
+		return true
+	}
+
+	blob, ok := field.(string)
+	if !ok || core.store.Store == nil {
+		return false
+	}
+
+	c, err := store.ParseBlob(blob)
+	if err != nil {
+		return false
+	}
+
+	there, err = core.store.HasBlob(c)
+	if err != nil || !there {
+		return false
+	}
+
+	// messages on ephemeral slates don't keep blobs, so they go once the grace period is up
+	if persistent {
+		if err = core.store.Ref(c); err != nil {
+			log.Error(err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// a message counted by refBlob didn't make it onto its slate after all
+func (core *Core) releaseBlob(m *msg.Message) {
+	blob, _ := m.Content[BLOBFIELD].(string)
+
+	c, err := store.ParseBlob(blob)
+	if err != nil {
+		return
+	}
+
+	if err = core.store.Release(c); err != nil {
+		log.Error(err)
+	}
+}
+
+// every so often
+func (core *Core) collectBlobs() {
+	if core.store.Store == nil {
+		return
+	}
+
+	collected, err := core.store.CollectGarbage(BLOB_GRACE)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if collected > 0 {
+		log.Debugf("collected %d unreferenced blobs", collected)
+	}
+}
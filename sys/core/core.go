@@ -1,7 +1,11 @@
 package core
 
 import (
+	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 
@@ -12,14 +16,32 @@ import (
 
 var log = logging.Logger("slater:core")
 
+// whoever's at the interface (which doesn't get to say who wrote what, see bridge/envelope.go)
+const USER = "user"
+
 type Core struct {
-	root     string
-	store    store.Store
-	host     *node
-	devices  []string
-	sessions map[string]session
-	Input    chan any
-	Output   chan any
+	root          string
+	name          string
+	key           string
+	store         store.Store
+	host          *node
+	roster        *roster
+	sessions      map[string]session
+	slates        map[string]*slate.PersistentSlate
+	pulls         map[string]bool
+	fetches       map[string]bool   // blobs
+	scripts       map[string]func() // detach, by slate/name
+	operators     map[string]func() // stop passing a slate to an operator, by topic
+	merged        mergedLayout      // see loadLayout
+	lock          *sync.RWMutex
+	rotating      *sync.Mutex
+	wantsLock     *sync.Mutex // each for its record in the store (see changeWants, changeLayout, and so on)
+	layoutLock    *sync.Mutex
+	scriptsLock   *sync.Mutex
+	operatorsLock *sync.Mutex
+	draftsLock    *sync.Mutex
+	Input         chan any
+	Output        chan any
 }
 
 func Start(rootPath string) Core {
@@ -30,11 +52,23 @@ func Start(rootPath string) Core {
 	}
 
 	core := Core{
-		root:     rootPath,
-		devices:  make([]string, 0),
-		sessions: make(map[string]session),
-		Input:    make(chan any, 128),
-		Output:   make(chan any, 128),
+		root:          rootPath,
+		roster:        newRoster(),
+		sessions:      make(map[string]session),
+		slates:        make(map[string]*slate.PersistentSlate),
+		pulls:         make(map[string]bool),
+		fetches:       make(map[string]bool),
+		scripts:       make(map[string]func()),
+		operators:     make(map[string]func()),
+		lock:          &sync.RWMutex{},
+		rotating:      &sync.Mutex{},
+		wantsLock:     &sync.Mutex{},
+		layoutLock:    &sync.Mutex{},
+		scriptsLock:   &sync.Mutex{},
+		operatorsLock: &sync.Mutex{},
+		draftsLock:    &sync.Mutex{},
+		Input:         make(chan any, 128),
+		Output:        make(chan any, 128),
 	}
 
 	go core.Run()
@@ -43,36 +77,67 @@ func Start(rootPath string) Core {
 }
 
 func (core *Core) Run() {
+	collection := time.NewTicker(BLOB_COLLECTION)
+	expiry := time.NewTicker(SESSION_EXPIRY)
+
 	for {
 		select {
+		case <-collection.C:
+			go core.collectBlobs()
+
+		case <-expiry.C:
+			go core.expireSessions()
+
 		case input := <-core.Input:
 			switch input.(type) {
 			case InputUISessionStart:
 				msg := input.(InputUISessionStart)
-				session := msg.Session
-				go core.connect(session)
+				go core.connect(msg.Session, msg.Client)
 
 			case InputUISessionResume:
 				msg := input.(InputUISessionResume)
-				session := msg.Session
-				go core.resumeSession(session)
+				go core.resumeSession(msg.Session, msg.Client)
+
+			case InputUISessionQuit:
+				msg := input.(InputUISessionQuit)
+				go core.quitSession(msg.Session, msg.Client)
 
 			case InputUIMessage:
 				msg := input.(InputUIMessage)
 				session := msg.Session
 				message := msg.Message
 				go core.handleUIMessage(session, message)
+
+			case InputUIPageRequest:
+				msg := input.(InputUIPageRequest)
+				go core.handlePageRequest(msg.Session, msg.Client, msg.Slate, msg.Cursor, msg.Count, msg.Before)
+
+			case InputUIBlob:
+				msg := input.(InputUIBlob)
+				go core.handleUIBlob(msg.Session, msg.Client, msg.Transfer, msg.Data)
+
+			case InputUIBlobRequest:
+				msg := input.(InputUIBlobRequest)
+				go core.handleBlobRequest(msg.Session, msg.Client, msg.Transfer, msg.Blob)
 			}
 		}
 	}
 }
 
+// several interfaces (clients) may share a session, each on its own socket
 type InputUISessionStart struct {
 	Session string
+	Client  string
 }
 
 type InputUISessionResume struct {
 	Session string
+	Client  string
+}
+
+type InputUISessionQuit struct {
+	Session string
+	Client  string
 }
 
 type InputUIMessage struct {
@@ -80,18 +145,88 @@ type InputUIMessage struct {
 	Message *msg.Message
 }
 
+// see view.go
+type InputUIPageRequest struct {
+	Session string
+	Client  string
+	Slate   string
+	Cursor  int
+	Count   int
+	Before  bool
+}
+
+// blobs going to and from the interface, by transfer id (see blobs.go)
+type InputUIBlob struct {
+	Session  string
+	Client   string
+	Transfer string
+	Data     io.ReadCloser
+}
+
+type InputUIBlobRequest struct {
+	Session  string
+	Client   string
+	Transfer string
+	Blob     string
+}
+
 type OutputUIMessage struct {
 	Session string
 	Message *msg.Message
 }
 
+type OutputSessionID struct {
+	Session string
+}
+
+type OutputAddSlate struct {
+	Session string
+	Slate   string
+}
+
+// to one client of the session, or to all of them if there's no Client
+type OutputPage struct {
+	Session string
+	Client  string
+	Slate   string
+	From    int
+	Total   int
+	Page    []*msg.Message
+}
+
+type OutputLayout struct {
+	Session string
+	Slates  []SlateInfo
+}
+
+type OutputBlobStored struct {
+	Session  string
+	Client   string
+	Transfer string
+	Blob     string
+	Err      error
+}
+
+type OutputBlob struct {
+	Session  string
+	Client   string
+	Transfer string
+	Blob     string
+	Size     int64
+	Data     io.Reader
+	Err      error
+}
+
 type OutputConnectedOtherDevice struct {
 	device string
 }
 
-func (core *Core) connect(sid string) {
+func (core *Core) connect(sid, client string) {
 	session := newSession(sid)
+
+	core.lock.Lock()
 	core.sessions[sid] = session
+	core.lock.Unlock()
 
 	core.sendSessionID(sid)
 
@@ -99,78 +234,202 @@ func (core *Core) connect(sid string) {
 	core.sendAddSlate(sid, setup)
 
 	feed := session.view.slates[setup]
+	core.attach(sid, client, feed)
 
-	feed.On(slate.ALL, func(m *msg.Message) {
-		core.sendMessage(sid, m)
-	})
+	// another session set up the core already (or this one did, and expired), so there's only the layout to show
+	if core.setUp() {
+		core.reshowLayout(sid, client)
+		return
+	}
 
 	store, host := runSetup(core, feed)
+	core.lock.Lock()
 	core.store = store
 	core.host = host
+	core.lock.Unlock()
 
-	core.handleNet()
+	core.online()
+
+	if core.recovering() {
+		core.recoverData(sayer(feed), RECOVER_POLL, RECOVER_REMINDER)
+	}
+
+	core.showLayout()
+	core.activateScripts()
+
+	core.advertiseHorizons()
+}
+
+// whether setup has finished, and connected
+func (core *Core) setUp() bool {
+	return core.getHost() != nil
 }
 
-func (core *Core) resumeSession(sid string) {
+// the node as it is now (a rotation swaps it for another, see reconnect)
+func (core *Core) getHost() *node {
+	core.lock.RLock()
+	defer core.lock.RUnlock()
+	return core.host
+}
+
+// handle the network, once setup (or a rotation) has connected it
+func (core *Core) online() {
+	host := core.getHost()
+
+	if core.roster.isRevoked(host.host.ID().String()) {
+		core.revoked()
+		return
+	}
+
+	host.host.SetStreamHandler(SYNC_PROTOCOL, core.handleSyncStream)
+	host.host.SetStreamHandler(HORIZONS_PROTOCOL, core.handleHorizonsStream)
+	host.host.SetStreamHandler(ROTATE_PROTOCOL, core.handleRotateStream)
+	host.host.SetStreamHandler(BLOBS_PROTOCOL, core.handleBlobsStream)
+
+	core.relayOldTopics()
+	core.rejoinOperators()
+
+	go core.resumeBlobs()
+
+	go core.handleNet(host)
+}
+
+func (core *Core) resumeSession(sid, client string) {
+	core.lock.RLock()
 	session, there := core.sessions[sid]
+	core.lock.RUnlock()
 
 	if !there {
-		core.connect(sid)
+		core.connect(sid, client)
 		return
 	}
 
 	setup := "setup"
 	core.sendAddSlate(sid, setup)
 
-	s := session.view.slates[setup]
+	core.attach(sid, client, session.view.slates[setup])
+	core.sendLatest(sid, client, session.view.slates[setup])
 
-	// send everything on slate setup TODO PAGINATION!
-	msgs, err := s.GetRange(0, -1)
-	if err != nil {
-		log.Debug(err)
-	}
-	for _, msg := range msgs {
-		core.sendMessage(sid, msg)
+	if core.setUp() {
+		core.reshowLayout(sid, client)
 	}
 }
 
 func (core *Core) handleUIMessage(sid string, m *msg.Message) {
 	//log.Debugf("message from session %v:\n%v", sid, m)
 
+	core.lock.RLock()
 	session, there := core.sessions[sid]
+	core.lock.RUnlock()
 
 	if !there {
 		log.Debug("discarded uiMessage from uninitialized session!")
 		return
 	}
 
+	m.User = USER
+
 	switch m.Kind {
-	case "msg":
-		content := m.Content
+	case "revoke":
+		feed := session.view.slates["setup"]
+		go revokeDevice(core, feed, sayer(feed))
 
-		slateField, there := content["slate"]
+	case "rotate":
+		feed := session.view.slates["setup"]
+		go rotateCredentials(core, feed, sayer(feed))
+
+	case "recovery":
+		feed := session.view.slates["setup"]
+		go setupRecovery(core, feed, sayer(feed))
+
+	case "slate:create", "slate:rename", "slate:move", "slate:close", "slate:open", "slate:archive":
+		go core.handleLayoutCommand(m)
+
+	case "script:attach", "script:detach", "script:rollback", "script:replay":
+		go core.handleScriptCommand(m)
+
+	case "operator:invite", "operator:revoke", "operator:join", "operator:leave", "operator:accept", "operator:audit":
+		go core.handleOperatorCommand(m)
+
+	default:
+		if m.Slate == AUDIT_SLATE {
+			log.Debug("discarded write to the audit slate")
+			return
+		}
+
+		// script versions and errors are only ever written by the core (see scripts.go)
+		if m.Kind == SCRIPT_KIND || m.Kind == SCRIPT_ERROR {
+			log.Debugf("discarded %s from the interface", m.Kind)
+			return
+		}
+
+		if core.store.Store != nil {
+			if j, operating := core.operating(m.Slate); operating {
+				go core.operatorReply(j, m)
+				return
+			}
+		}
+
+		core.lock.RLock()
+		sl8, there := session.view.slates[m.Slate]
+		core.lock.RUnlock()
 		if !there {
-			log.Debug("missing slate field")
+			log.Debugf("failed write to missing slate %s", m.Slate)
 			return
 		}
-		slateName, ok := slateField.(string)
-		if !ok {
-			log.Debug("bad slate field")
+
+		_, persistent := sl8.(*slate.PersistentSlate)
+		if !core.refBlob(m, persistent) {
+			log.Debugf("discarded message referring to a missing blob")
 			return
 		}
 
-		slate, there := session.view.slates[slateName]
-		if there {
-			slate.Write(m)
-		} else {
-			log.Debugf("failed write to missing slate %s", slateName)
+		if err := sl8.Write(m); err != nil {
+			log.Error(err)
+			if persistent {
+				core.releaseBlob(m)
+			}
 		}
 	}
 }
 
-func (core *Core) handleNet() {
+// until the node is closed
+// until the node is closed (when a rotation starts another, it has a handleNet of its own)
+func (core *Core) handleNet(host *node) {
 	for {
-		m := <-core.host.output
+		var r received
+
+		select {
+		case r = <-host.output:
+		case <-host.done:
+			return
+		}
+
+		m := r.m
+
+		// an operator's topic only carries the operator's side of things (see operator.go)
+		operatorTopic := strings.HasPrefix(r.topic, OPERATOR_TOPIC)
+		if operatorTopic != strings.HasPrefix(m.Kind, "operator:") {
+			log.Debugf("discarded %s on %s", m.Kind, r.topic)
+			continue
+		}
+		if operatorTopic {
+			go core.handleOperatorNet(m, r.topic)
+			continue
+		}
+
+		switch m.Kind {
+		case "horizon":
+			go core.handleHorizon(m)
+			continue
+		case "sync":
+			core.handleSync(m)
+			continue
+		case "roster":
+			core.handleRoster(m)
+			continue
+		}
+
 		content := m.Content
 
 		slateField, there := content["slate"]
@@ -185,44 +444,45 @@ func (core *Core) handleNet() {
 		}
 
 		if m.Kind == "signet" {
-			core.host.send(core.host.discoveryKey, &msg.Message{
+			host.send(host.discoveryKey, &msg.Message{
 				Slate: "setup",
 				Kind:  "signet",
 				Content: map[string]any{
-					"signet": core.host.signet,
+					"signet": host.signet,
 				},
 			})
 
 			core.Output <- OutputConnectedOtherDevice{device: m.Device}
+
+			go core.resumeBlobs() // there's somewhere to get them from now
 		}
 
-		for _, session := range core.sessions {
-			sl8, there := session.view.slates[slateName]
-			if there {
-				sl8.Write(m)
-				break
-			} else {
-				continue
-			}
+		for _, sl8 := range core.viewSlates(slateName) {
+			sl8.Write(m)
+			break
 		}
 	}
 }
 
+// say something on the setup slate of every session
+func (core *Core) announce(things ...string) {
+	for _, feed := range core.viewSlates("setup") {
+		sayer(feed)(things...)
+	}
+}
+
 func (core *Core) sendMessage(sid string, m *msg.Message) {
 	core.Output <- OutputUIMessage{sid, m}
 }
 
 func (core *Core) sendSessionID(sid string) {
-	m := msg.Message{Kind: "session", Content: map[string]any{"session": sid}}
-	core.Output <- OutputUIMessage{sid, &m}
+	core.Output <- OutputSessionID{sid}
 }
 
 func (core *Core) sendAddSlate(sid string, slate string) {
-	m := msg.Message{Kind: "slate", Content: map[string]any{"slate": slate}}
-	core.Output <- OutputUIMessage{sid, &m}
+	core.Output <- OutputAddSlate{sid, slate}
 }
 
-func (core *Core) sendPage(sid string, page []*msg.Message) {
-	m := msg.Message{Kind: "page", Content: map[string]any{"page": page}}
-	core.Output <- OutputUIMessage{sid, &m}
+func (core *Core) sendPage(sid, client, slate string, from, total int, page []*msg.Message) {
+	core.Output <- OutputPage{sid, client, slate, from, total, page}
 }
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+
+	"slater/core/msg"
+	"slater/core/slate"
+)
+
+// a core with a store, and the slates it's given already open (so nothing needs the network),
+// as device "a" of a roster
+func testCore(t *testing.T, slates ...string) *Core {
+	root := t.TempDir()
+	name, phrase, pin := "brave-little-otter", "one two three four five six", "1234"
+
+	db, _, err := openSessionStore(root, name, createMasterKey(root, name, phrase, pin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Store.Close() })
+
+	signKey, err := deriveSignatureKey(name, phrase, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core := &Core{
+		name:          name,
+		root:          root,
+		store:         db,
+		roster:        newRoster(),
+		slates:        make(map[string]*slate.PersistentSlate),
+		scripts:       make(map[string]func()),
+		operators:     make(map[string]func()),
+		lock:          &sync.RWMutex{},
+		wantsLock:     &sync.Mutex{},
+		layoutLock:    &sync.Mutex{},
+		scriptsLock:   &sync.Mutex{},
+		operatorsLock: &sync.Mutex{},
+		draftsLock:    &sync.Mutex{},
+	}
+	if err = core.roster.load(db, signKey, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range slates {
+		core.slates[s] = slate.NewPersistentSlate(s, "a", db)
+	}
+
+	return core
+}
+
+// the signature key of testCore's credentials
+func testSignKey(t *testing.T, core *Core) ed25519.PrivateKey {
+	key, err := deriveSignatureKey(core.name, "one two three four five six", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// a node for a core, on a host of its own (see testHost), with pubsub but no discovery
+func testNode(t *testing.T, core *Core) *node {
+	h := testHost(t)
+
+	psub, err := pubsub.NewGossipSub(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &node{
+		host:     h,
+		psub:     psub,
+		ctx:      context.Background(),
+		channels: make(map[string]channel),
+		sealers:  make(map[string]*sealer),
+		lock:     &sync.RWMutex{},
+		output:   make(chan received),
+		done:     make(chan struct{}),
+		signKey:  testSignKey(t, core),
+	}
+}
+
+// everything on a slate, oldest first
+func all(t *testing.T, s *slate.PersistentSlate) []*msg.Message {
+	msgs, err := s.GetRange(0, int(s.Count())-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+// the event and kind of the latest prompt on the feed, if it's the latest message
+func lastPrompt(feed *slate.EphemeralSlate) (string, string) {
+	n := feed.Count()
+	if n == 0 {
+		return "", ""
+	}
+	m, _ := feed.Get(n - 1)
+	prompt, _ := m.Content["prompt"].(map[string]any)
+	evt, _ := prompt["event"].(string)
+	kind, _ := prompt["kind"].(string)
+	return evt, kind
+}
+
+// keep answering the latest prompt while it's one of these, until the test's done
+// (again and again, since the prompt only listens once it's written, and an answer nobody listens for is dropped)
+func answer(t *testing.T, feed *slate.EphemeralSlate, replies map[string]any) {
+	fields := map[string]string{"text": "body", "secretText": "secretText", "choice": "choice"}
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			evt, kind := lastPrompt(feed)
+			if reply, there := replies[evt]; there {
+				feed.Emitter.Emit(&msg.Message{Slate: feed.Name(), Kind: kind, Event: evt, Content: map[string]any{fields[kind]: reply}})
+			}
+		}
+	}()
+}
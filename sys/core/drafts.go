@@ -0,0 +1,282 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"slater/core/msg"
+	"slater/core/script"
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+//
+// Drafts, scripts proposed to an operator who keeps saying the same things (see operator.go, and script/draft.go).
+//
+// When the operator replies on a slate, the device which invited them writes down what the reply answered:
+// the last message before it (that isn't the operator's, the system's, or a script's).
+// Answered messages are clustered by kind, event, and prompt (the body of the last message which prompted for that event,
+// see prompt in setup.go), and once a cluster has DRAFT_AFTER replies, the operator gets a draft for it:
+//
+//	operator:draft   draft, name, on, source       to the operator, who sees it on their slate
+//	operator:accept  draft                         from the operator, to attach it onto the user's slate
+//
+// A draft is only proposed again when it changes. Accepting one attaches it as a new version of its script,
+// written by the user's device (so the operator only ever picks among drafts, they never write one).
+// Drafts listen to the event of their cluster (or to its kind, for messages without one).
+// Proposals and acceptances go on the audit slate.
+//
+
+const (
+	DRAFTSKEY   = "p"
+	DRAFT_AFTER = 3  // replies in a cluster before there's a draft for it
+	DRAFT_PAIRS = 32 // replies remembered per cluster (the latest)
+)
+
+var errNoDraft = errors.New("drafts: no such draft")
+
+// a cluster of messages, and what the operator answered them
+type pattern struct {
+	Kind   string
+	Event  string
+	Prompt string
+	Pairs  []script.Pair
+	Draft  draft // the latest one proposed
+}
+
+type draft struct {
+	ID     string
+	Name   string
+	On     string
+	Source string
+}
+
+// slate -> cluster -> pattern
+func (core *Core) loadPatterns() (map[string]map[string]pattern, error) {
+	patterns := make(map[string]map[string]pattern)
+
+	bytes, err := core.store.Get(DRAFTSKEY)
+	if errors.Is(err, store.ErrNotFound) {
+		return patterns, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = cbor.Unmarshal(bytes, &patterns)
+	return patterns, err
+}
+
+func (core *Core) changePatterns(change func(map[string]map[string]pattern) error) error {
+	core.draftsLock.Lock()
+	defer core.draftsLock.Unlock()
+
+	patterns, err := core.loadPatterns()
+	if err != nil {
+		return err
+	}
+
+	if err = change(patterns); err != nil {
+		return err
+	}
+
+	bytes, err := cbor.Marshal(patterns)
+	if err != nil {
+		return err
+	}
+
+	return core.store.Put([]string{DRAFTSKEY}, bytes)
+}
+
+// write down what the operator's reply (the last message on the slate) answered, and propose a draft if there's a new one
+func (core *Core) recordReply(inv invite, s *slate.PersistentSlate, body string) {
+	answered, prompt, err := lastAnswered(s)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if answered == nil {
+		return
+	}
+
+	in, _ := answered.Content["body"].(string)
+
+	key := clusterKey(answered, prompt)
+
+	var proposed *draft
+	var replies int
+
+	err = core.changePatterns(func(patterns map[string]map[string]pattern) error {
+		clusters, there := patterns[inv.Slate]
+		if !there {
+			clusters = make(map[string]pattern)
+			patterns[inv.Slate] = clusters
+		}
+
+		p, there := clusters[key]
+		if !there {
+			p = pattern{Kind: answered.Kind, Event: answered.Event, Prompt: prompt}
+		}
+
+		p.Pairs = append(p.Pairs, script.Pair{In: in, Out: body})
+		if len(p.Pairs) > DRAFT_PAIRS {
+			p.Pairs = p.Pairs[len(p.Pairs)-DRAFT_PAIRS:]
+		}
+
+		if len(p.Pairs) >= DRAFT_AFTER {
+			if d := p.draft(); d.ID != p.Draft.ID {
+				p.Draft = d
+				proposed = &d
+				replies = len(p.Pairs)
+			}
+		}
+
+		clusters[key] = p
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if proposed == nil {
+		return
+	}
+
+	host := core.getHost()
+
+	host.send(inv.Topic, &msg.Message{
+		Kind: "operator:draft",
+		Sent: msg.Timestamp(),
+		Content: map[string]any{
+			"topic":   inv.Topic,
+			"draft":   proposed.ID,
+			"name":    proposed.Name,
+			"on":      proposed.On,
+			"source":  proposed.Source,
+			"replies": replies,
+		},
+	})
+
+	core.audit("propose", inv.Slate, host.host.ID().String(), "proposed %s to the operator, from %d replies", proposed.Name, replies)
+}
+
+// answered messages are clustered by kind, event, and prompt
+func clusterKey(answered *msg.Message, prompt string) string {
+	return strings.Join([]string{answered.Kind, answered.Event, prompt}, "\x00")
+}
+
+func (p pattern) draft() draft {
+	on := p.Event
+	if on == "" {
+		on = p.Kind
+	}
+
+	name := "operator-" + strings.NewReplacer(":", "-", "/", "-", " ", "-").Replace(on)
+	if p.Prompt != "" {
+		sum := sha256.Sum256([]byte(p.Prompt))
+		name += "-" + hex.EncodeToString(sum[:3])
+	}
+
+	source := script.Draft(p.Kind, p.Event, p.Pairs)
+	sum := sha256.Sum256([]byte(name + "\x00" + on + "\x00" + source))
+
+	return draft{hex.EncodeToString(sum[:6]), name, on, source}
+}
+
+// the message the last one on the slate answered (unless it was answered already), and what prompted it
+func lastAnswered(s *slate.PersistentSlate) (*msg.Message, string, error) {
+	count := int(s.Count())
+	from := count - HISTORY
+	if from < 0 {
+		from = 0
+	}
+	if count < 2 {
+		return nil, "", nil
+	}
+
+	// (the last one's the reply)
+	recent, err := s.GetRange(from, count-2)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var answered *msg.Message
+	for i := len(recent) - 1; i >= 0; i-- {
+		m := recent[i]
+
+		if answered == nil {
+			switch {
+			case m.User == OPERATOR_USER:
+				return nil, "", nil // just more to say to the same thing
+			case m.User == "system" || m.Kind == SCRIPT_KIND || script.FromScript(m):
+				continue
+			}
+
+			answered = m
+			if m.Event == "" {
+				return answered, "", nil
+			}
+			continue
+		}
+
+		if promptEvent(m) == answered.Event {
+			body, _ := m.Content["body"].(string)
+			return answered, body, nil
+		}
+	}
+
+	return answered, "", nil
+}
+
+// the event a message prompts for, if it does
+func promptEvent(m *msg.Message) string {
+	switch p := m.Content["prompt"].(type) {
+	case map[string]any:
+		event, _ := p["event"].(string)
+		return event
+	case map[any]any:
+		event, _ := p["event"].(string)
+		return event
+	}
+	return ""
+}
+
+// the operator took a draft, so attach it
+func (core *Core) acceptDraft(inv invite, operator, id string) {
+	core.draftsLock.Lock()
+	patterns, err := core.loadPatterns()
+	core.draftsLock.Unlock()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	var d *draft
+	for _, p := range patterns[inv.Slate] {
+		if p.Draft.ID == id {
+			d = &p.Draft
+			break
+		}
+	}
+	if d == nil {
+		log.Debug(errNoDraft)
+		return
+	}
+
+	core.editScript(d.Name, &msg.Message{
+		Slate: inv.Slate,
+		Kind:  "script:attach",
+		Content: map[string]any{
+			"name":   d.Name,
+			"on":     d.On,
+			"source": d.Source,
+		},
+	})
+
+	core.audit("accept", inv.Slate, operator, "the operator accepted %s (draft %s)", d.Name, d.ID)
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"testing"
+
+	"slater/core/msg"
+	"slater/core/script"
+)
+
+func TestLastAnswered(t *testing.T) {
+	core := testCore(t, "chat")
+	s := core.slates["chat"]
+
+	write := func(user, event, body string, content map[string]any) {
+		if content == nil {
+			content = make(map[string]any)
+		}
+		content["body"] = body
+		if err := s.Write(&msg.Message{User: user, Kind: "text", Event: event, Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(expected, expectedPrompt string) {
+		t.Helper()
+		answered, prompt, err := lastAnswered(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := ""
+		if answered != nil {
+			body, _ = answered.Content["body"].(string)
+		}
+		if body != expected || prompt != expectedPrompt {
+			t.Fatalf("answered %q (prompted by %q), expected %q (prompted by %q)", body, prompt, expected, expectedPrompt)
+		}
+	}
+
+	write(USER, "", "hi", nil)
+	check("", "") // nothing's answered it yet
+
+	write(OPERATOR_USER, "", "hello", nil)
+	check("hi", "")
+
+	write(OPERATOR_USER, "", "how are you?", nil)
+	check("", "") // still answering the same thing
+
+	write("system", "", "What's your name?", map[string]any{"prompt": map[string]any{"event": "ask:name"}})
+	write(USER, "ask:name", "Ada", nil)
+	write("hi", "", "a script's reply", map[string]any{script.FIELD: "hi"})
+	write(OPERATOR_USER, "", "nice to meet you", nil)
+	check("Ada", "What's your name?")
+}
+
+func TestClusterKey(t *testing.T) {
+	text := &msg.Message{Kind: "text"}
+	named := &msg.Message{Kind: "text", Event: "ask:name"}
+
+	if clusterKey(named, "What's your name?") != clusterKey(&msg.Message{Kind: "text", Event: "ask:name"}, "What's your name?") {
+		t.Fatal("the same message clustered apart")
+	}
+
+	keys := map[string]bool{}
+	for _, key := range []string{
+		clusterKey(text, ""),
+		clusterKey(named, ""),
+		clusterKey(named, "What's your name?"),
+		clusterKey(named, "Who are you?"),
+		clusterKey(&msg.Message{Kind: "web"}, ""),
+		clusterKey(&msg.Message{Kind: "text", Event: "ask"}, ":name"), // no running into each other
+	} {
+		if keys[key] {
+			t.Fatalf("%q clusters with another", key)
+		}
+		keys[key] = true
+	}
+}
+
+func TestAcceptDraft(t *testing.T) {
+	core := testCore(t, "chat", AUDIT_SLATE)
+
+	inv := invite{Topic: OPERATOR_TOPIC + "test", Slate: "chat", Operator: "op"}
+
+	p := pattern{Kind: "text", Pairs: []script.Pair{{In: "hi", Out: "hello"}, {In: "hey", Out: "hello"}, {In: "yo", Out: "hello"}}}
+	p.Draft = p.draft()
+
+	err := core.changePatterns(func(patterns map[string]map[string]pattern) error {
+		patterns["chat"] = map[string]pattern{clusterKey(&msg.Message{Kind: "text"}, ""): p}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core.acceptDraft(inv, "op", "nope")
+	core.acceptDraft(inv, "op", p.Draft.ID)
+
+	written := all(t, core.slates["chat"])
+	if len(written) != 1 {
+		t.Fatalf("wrote %d messages", len(written))
+	}
+
+	v, ok := parseScriptVersion(written[0])
+	if !ok || v.Name != p.Draft.Name || v.On != "text" || v.Source != p.Draft.Source || !v.Active || v.Version != 1 {
+		t.Fatalf("attached %+v", v)
+	}
+
+	audited := all(t, core.slates[AUDIT_SLATE])
+	if len(audited) != 1 || audited[0].Content["action"] != "accept" || audited[0].Content["by"] != "op" {
+		t.Fatalf("audited %v", audited)
+	}
+}
@@ -0,0 +1,321 @@
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/frand"
+
+	"slater/core/store"
+)
+
+//
+// Envelope encryption for the store.
+//
+// The store is encrypted with a random data key, which never changes.
+// The data key is kept in the keyring file in the session directory, beside the salt and hash,
+// wrapped (sealed, see seal.go) under one or more wrapping keys, each in a named slot.
+// The master key from the passphrase and PIN wraps it in the "password" slot,
+// and other keys (a recovery key, say) can wrap it in slots of their own.
+//
+// So unlocking only unwraps the data key, and changing the credentials only rewraps it.
+//
+
+const (
+	KEYRING         = "keyring"
+	KEYRING_VERSION = 1
+	DATA_KEY_SIZE   = 32
+
+	PASSWORD_SLOT = "password"
+)
+
+type keyring struct {
+	Version byte
+	Slots   map[string][]byte
+}
+
+var errNoSlot = errors.New("keyring: no such slot")
+
+func keyringPath(rootPath, sessionID string) string {
+	return filepath.Join(rootPath, sessionID, KEYRING)
+}
+
+func readKeyring(path string) (*keyring, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ring := new(keyring)
+	if err = cbor.Unmarshal(bytes, ring); err != nil {
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+func writeKeyring(path string, ring *keyring) error {
+	bytes, err := cbor.Marshal(ring)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0600)
+}
+
+func keySealer(key string) (*sealer, error) {
+	s := newSealer()
+	err := s.use(KEYRING_VERSION, []byte(key))
+	return s, err
+}
+
+func (ring *keyring) wrap(slot, wrappingKey, dataKey string) error {
+	s, err := keySealer(wrappingKey)
+	if err != nil {
+		return err
+	}
+
+	// the slot is authenticated along with the key, so a wrapped key can't be moved to another slot
+	sealed, err := s.seal(slot, []byte(dataKey))
+	if err != nil {
+		return err
+	}
+
+	ring.Slots[slot] = sealed
+
+	return nil
+}
+
+func (ring *keyring) unwrap(slot, wrappingKey string) (string, error) {
+	sealed, there := ring.Slots[slot]
+	if !there {
+		return "", errNoSlot
+	}
+
+	s, err := keySealer(wrappingKey)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := s.open(slot, sealed)
+	if err != nil {
+		return "", errAuthFail
+	}
+
+	return string(dataKey), nil
+}
+
+// make a new data key, wrapped under the master key
+func createDataKey(rootPath, sessionID, masterKey string) (string, error) {
+	dataKey := string(frand.Bytes(DATA_KEY_SIZE))
+
+	ring := &keyring{
+		Version: KEYRING_VERSION,
+		Slots:   make(map[string][]byte),
+	}
+
+	if err := ring.wrap(PASSWORD_SLOT, masterKey, dataKey); err != nil {
+		return "", err
+	}
+
+	if err := writeKeyring(keyringPath(rootPath, sessionID), ring); err != nil {
+		return "", err
+	}
+
+	return dataKey, nil
+}
+
+func getDataKey(rootPath, sessionID, slot, wrappingKey string) (string, error) {
+	path := keyringPath(rootPath, sessionID)
+
+	ring, err := readKeyring(path)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := ring.unwrap(slot, wrappingKey)
+	if err == nil {
+		return dataKey, nil
+	}
+
+	// a rotation may have been interrupted before the keyring was committed
+	if pending, pendingErr := readKeyring(path + PENDING); pendingErr == nil {
+		if dataKey, pendingErr := pending.unwrap(slot, wrappingKey); pendingErr == nil {
+			return dataKey, nil
+		}
+	}
+
+	return "", err
+}
+
+func hasSlot(rootPath, sessionID, slot string) bool {
+	ring, err := readKeyring(keyringPath(rootPath, sessionID))
+	if err != nil {
+		return false
+	}
+
+	_, there := ring.Slots[slot]
+	return there
+}
+
+// Wrap the data key in a slot, in a new keyring beside the current one.
+// It only replaces the current one when commit is called.
+func prepareWrappingKey(rootPath, sessionID, dataKey, slot, wrappingKey string) (func() error, error) {
+	path := keyringPath(rootPath, sessionID)
+
+	ring, err := readKeyring(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ring.wrap(slot, wrappingKey, dataKey); err != nil {
+		return nil, err
+	}
+
+	if err = writeKeyring(path+PENDING, ring); err != nil {
+		return nil, err
+	}
+
+	commit := func() error {
+		return os.Rename(path+PENDING, path)
+	}
+
+	return commit, nil
+}
+
+func addWrappingKey(rootPath, sessionID, dataKey, slot, wrappingKey string) error {
+	commit, err := prepareWrappingKey(rootPath, sessionID, dataKey, slot, wrappingKey)
+	if err != nil {
+		return err
+	}
+	return commit()
+}
+
+func removeWrappingKey(rootPath, sessionID, slot string) error {
+	if slot == PASSWORD_SLOT {
+		return errors.New("keyring: can't remove the password slot")
+	}
+
+	path := keyringPath(rootPath, sessionID)
+
+	ring, err := readKeyring(path)
+	if err != nil {
+		return err
+	}
+
+	delete(ring.Slots, slot)
+
+	if err = writeKeyring(path+PENDING, ring); err != nil {
+		return err
+	}
+
+	return os.Rename(path+PENDING, path)
+}
+
+// open a session's store with its data key
+func openSessionStore(rootPath, sessionID, masterKey string) (store.Store, string, error) {
+	dataKey, err := getDataKey(rootPath, sessionID, PASSWORD_SLOT, masterKey)
+
+	if errors.Is(err, os.ErrNotExist) {
+		dataKey, err = migrateDataKey(rootPath, sessionID, masterKey)
+	}
+
+	if err != nil {
+		return store.Store{}, "", err
+	}
+
+	db, err := store.OpenStore(rootPath, sessionID, dataKey)
+
+	return db, dataKey, err
+}
+
+// Stores from before the keyring are encrypted with the master key itself,
+// so move them onto a data key.
+// The new keyring is written before re-keying the store, and committed after,
+// so if this is interrupted, it picks up with the same data key next time.
+func migrateDataKey(rootPath, sessionID, masterKey string) (string, error) {
+	path := keyringPath(rootPath, sessionID)
+
+	var dataKey string
+
+	pending, err := readKeyring(path + PENDING)
+	if err == nil {
+		dataKey, err = pending.unwrap(PASSWORD_SLOT, masterKey)
+	}
+
+	if err != nil {
+		dataKey = string(frand.Bytes(DATA_KEY_SIZE))
+
+		ring := &keyring{
+			Version: KEYRING_VERSION,
+			Slots:   make(map[string][]byte),
+		}
+		if err = ring.wrap(PASSWORD_SLOT, masterKey, dataKey); err != nil {
+			return "", err
+		}
+		if err = writeKeyring(path+PENDING, ring); err != nil {
+			return "", err
+		}
+	}
+
+	// no store yet, so nothing to re-key
+	if _, err = os.Stat(filepath.Join(rootPath, sessionID, store.DB)); errors.Is(err, os.ErrNotExist) {
+		return dataKey, os.Rename(path+PENDING, path)
+	}
+
+	// a mismatch means the store was re-keyed already (or is still plaintext, which OpenStore takes care of)
+	err = store.Rekey(rootPath, sessionID, masterKey, dataKey)
+	if err != nil && !errors.Is(err, store.ErrKeyMismatch) {
+		return "", err
+	}
+
+	log.Info("moved store ", sessionID, " onto a data key")
+
+	return dataKey, os.Rename(path+PENDING, path)
+}
+
+// The hash file only checks the credentials before unwrapping the data key,
+// and unwrapping checks them anyway, so a lost hash file can be written again.
+// (A store from before the keyring is encrypted with the master key itself, so opening it checks them instead.)
+func rebuildHash(rootPath, sessionID, phrase, pin string) (string, error) {
+	salt, err := getSalt(rootPath, sessionID)
+	if err != nil {
+		return "", errLostSalt
+	}
+
+	k := stretch(salt, sessionID, phrase, pin)
+
+	_, err = getDataKey(rootPath, sessionID, PASSWORD_SLOT, string(k))
+	if errors.Is(err, os.ErrNotExist) {
+		err = checkStoreKey(rootPath, sessionID, string(k))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hash := blake2b.Sum256(k)
+	s := hex.EncodeToString(hash[:])
+
+	return string(k), ioutil.WriteFile(filepath.Join(rootPath, sessionID, HASH), []byte(s), 0600)
+}
+
+func checkStoreKey(rootPath, sessionID, masterKey string) error {
+	// (with no store either, there's nothing to check them with)
+	if _, err := os.Stat(filepath.Join(rootPath, sessionID, store.DB)); err != nil {
+		return errLostHash
+	}
+
+	db, err := store.OpenStore(rootPath, sessionID, masterKey)
+	if errors.Is(err, store.ErrKeyMismatch) {
+		return errAuthFail
+	}
+	if err != nil {
+		return err
+	}
+
+	return db.Store.Close()
+}
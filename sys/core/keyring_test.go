@@ -0,0 +1,203 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lukechampine.com/frand"
+
+	"slater/core/store"
+)
+
+func TestKeyringSlots(t *testing.T) {
+	ring := &keyring{Version: KEYRING_VERSION, Slots: make(map[string][]byte)}
+	wrapping, other := string(frand.Bytes(32)), string(frand.Bytes(32))
+	dataKey := string(frand.Bytes(DATA_KEY_SIZE))
+
+	if err := ring.wrap(PASSWORD_SLOT, wrapping, dataKey); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ring.unwrap(PASSWORD_SLOT, wrapping)
+	if err != nil || got != dataKey {
+		t.Fatal("didn't unwrap the data key", err)
+	}
+
+	if _, err = ring.unwrap(PASSWORD_SLOT, other); !errors.Is(err, errAuthFail) {
+		t.Fatal("unwrapped with the wrong key", err)
+	}
+	if _, err = ring.unwrap("recovery", wrapping); !errors.Is(err, errNoSlot) {
+		t.Fatal("unwrapped an empty slot", err)
+	}
+
+	// a wrapped key only opens in its own slot
+	ring.Slots["recovery"] = ring.Slots[PASSWORD_SLOT]
+	if _, err = ring.unwrap("recovery", wrapping); !errors.Is(err, errAuthFail) {
+		t.Fatal("unwrapped a key moved to another slot", err)
+	}
+}
+
+func TestKeyringFile(t *testing.T) {
+	root := t.TempDir()
+	name := "brave-little-otter"
+	if err := os.MkdirAll(filepath.Join(root, name), 0700); err != nil {
+		t.Fatal(err)
+	}
+	master, recovery := string(frand.Bytes(32)), string(frand.Bytes(32))
+
+	dataKey, err := createDataKey(root, name, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = addWrappingKey(root, name, dataKey, "recovery", recovery); err != nil {
+		t.Fatal(err)
+	}
+	if !hasSlot(root, name, "recovery") {
+		t.Fatal("no recovery slot")
+	}
+
+	for _, c := range []struct{ slot, key string }{{PASSWORD_SLOT, master}, {"recovery", recovery}} {
+		if got, err := getDataKey(root, name, c.slot, c.key); err != nil || got != dataKey {
+			t.Fatal(c.slot, "didn't unwrap the data key", err)
+		}
+	}
+
+	if err = removeWrappingKey(root, name, PASSWORD_SLOT); err == nil {
+		t.Fatal("removed the password slot")
+	}
+	if err = removeWrappingKey(root, name, "recovery"); err != nil {
+		t.Fatal(err)
+	}
+	if hasSlot(root, name, "recovery") {
+		t.Fatal("recovery slot still there")
+	}
+}
+
+// new credentials, with a rotation interrupted before the keyring was committed
+func TestDataKeyPending(t *testing.T) {
+	root := t.TempDir()
+	name := "brave-little-otter"
+	if err := os.MkdirAll(filepath.Join(root, name), 0700); err != nil {
+		t.Fatal(err)
+	}
+	old, next := string(frand.Bytes(32)), string(frand.Bytes(32))
+
+	dataKey, err := createDataKey(root, name, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := prepareWrappingKey(root, name, dataKey, PASSWORD_SLOT, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// either works until then
+	for _, key := range []string{old, next} {
+		if got, err := getDataKey(root, name, PASSWORD_SLOT, key); err != nil || got != dataKey {
+			t.Fatal("didn't unwrap the data key", err)
+		}
+	}
+
+	if err = commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := getDataKey(root, name, PASSWORD_SLOT, next); err != nil || got != dataKey {
+		t.Fatal("didn't unwrap the data key", err)
+	}
+	if _, err = getDataKey(root, name, PASSWORD_SLOT, old); !errors.Is(err, errAuthFail) {
+		t.Fatal("the old key still works", err)
+	}
+}
+
+func TestMigrateDataKey(t *testing.T) {
+	root := t.TempDir()
+	name, phrase, pin := "brave-little-otter", "one two three four five six", "1234"
+	master := createMasterKey(root, name, phrase, pin)
+
+	// a store from before the keyring, encrypted with the master key itself
+	db, err := store.OpenStore(root, name, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]string{"thing"}, []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	db.Store.Close()
+
+	open := func() string {
+		db, dataKey, err := openSessionStore(root, name, master)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Store.Close()
+
+		if v, err := db.Get("thing"); err != nil || string(v) != "kept" {
+			t.Fatal("lost the data", err)
+		}
+		return dataKey
+	}
+
+	dataKey := open()
+	if dataKey == master || !hasSlot(root, name, PASSWORD_SLOT) {
+		t.Fatal("not moved onto a data key")
+	}
+	if _, err = store.OpenStore(root, name, master); !errors.Is(err, store.ErrKeyMismatch) {
+		t.Fatal("still opens with the master key", err)
+	}
+
+	// interrupted after re-keying, before the keyring was committed: it carries on with the same data key
+	path := keyringPath(root, name)
+	if err = os.Rename(path, path+PENDING); err != nil {
+		t.Fatal(err)
+	}
+	if again := open(); again != dataKey {
+		t.Fatal("picked another data key")
+	}
+	if _, err = os.Stat(path + PENDING); !os.IsNotExist(err) {
+		t.Fatal("pending keyring not committed", err)
+	}
+}
+
+func TestRebuildHash(t *testing.T) {
+	root := t.TempDir()
+	name, phrase, pin := "brave-little-otter", "one two three four five six", "1234"
+
+	master := createMasterKey(root, name, phrase, pin)
+	db, _, err := openSessionStore(root, name, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Store.Close()
+
+	if err = os.Remove(filepath.Join(root, name, HASH)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getMasterKey(root, name, phrase, pin); !errors.Is(err, errLostHash) {
+		t.Fatal("expected a lost hash", err)
+	}
+
+	if _, err = rebuildHash(root, name, phrase, "4321"); !errors.Is(err, errAuthFail) {
+		t.Fatal("wrong credentials should fail", err)
+	}
+
+	key, err := rebuildHash(root, name, phrase, pin)
+	if err != nil || key != master {
+		t.Fatal("didn't rebuild it", err)
+	}
+	if got, err := getMasterKey(root, name, phrase, pin); err != nil || got != master {
+		t.Fatal("hash not written again", err)
+	}
+
+	// without the salt, there's nothing to rebuild it from
+	if err = os.Remove(filepath.Join(root, name, SALT)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rebuildHash(root, name, phrase, pin); !errors.Is(err, errLostSalt) {
+		t.Fatal("expected a lost salt", err)
+	}
+}
@@ -0,0 +1,488 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"golang.org/x/exp/slices"
+
+	"slater/core/msg"
+	"slater/core/slate"
+)
+
+//
+// The layout of the user's workspace: which slates are open, in what order, and what they're called.
+//
+// It's kept on a persistent slate of its own, so it's in the store, and it replicates to the other devices like any other slate.
+// Every change writes the whole layout as a new message, and the layout is every message merged in slate order
+// (slates are ordered by stamp, so every device agrees on it): each slate keeps its latest change,
+// and the open slates are those of the last message, plus any slates its writer didn't know about yet,
+// so slates created on two devices at once both make it.
+// A change is as late as the stamp of the message it's on, whatever the clocks of the devices say.
+//
+// The merged layout is kept on the core, and only the messages after it are merged in,
+// unless one has arrived from before the last one it merged.
+//
+// Slates are named by random ids, so renaming one only changes its title.
+// Every view shows the setup slate first, then the open slates of the layout.
+//
+// Commands from the interface are messages:
+//
+//	slate:create   title
+//	slate:rename   slate, title
+//	slate:move     slate, index (among the open slates)
+//	slate:close    slate
+//	slate:open     slate
+//	slate:archive  slate (closes it too)
+//
+
+const (
+	LAYOUT_SLATE = "layout"
+	LAYOUT_KIND  = "layout"
+	HISTORY      = 50 // messages in the first page of a slate (see view.go)
+)
+
+var (
+	errNoSuchSlate = errors.New("layout: no such slate")
+	errBadCommand  = errors.New("layout: bad command")
+)
+
+type layout struct {
+	Open    []string
+	Slates  map[string]slateInfo
+	Changed []string // the slates the message it's written on changed (see decodeLayout)
+}
+
+type slateInfo struct {
+	Title    string
+	Archived bool
+	Stamp    msg.Stamp // of the message which last changed the title or archived
+}
+
+// the layout merged so far, up to which message
+type mergedLayout struct {
+	layout layout
+	count  int
+	last   string
+}
+
+// a slate, for the interface
+type SlateInfo struct {
+	Slate    string
+	Title    string
+	Open     bool
+	Archived bool
+}
+
+func newLayout() layout {
+	return layout{
+		Open:   make([]string, 0),
+		Slates: make(map[string]slateInfo),
+	}
+}
+
+func (core *Core) loadLayout() (layout, error) {
+	l := newLayout()
+
+	s, err := core.openSlate(LAYOUT_SLATE)
+	if err != nil {
+		return l, err
+	}
+
+	core.lock.RLock()
+	merged := core.merged
+	core.lock.RUnlock()
+
+	count := int(s.Count())
+
+	from := 0
+	if merged.count > 0 && merged.count <= count {
+		m, err := s.Get(uint64(merged.count - 1))
+		if err != nil {
+			return l, err
+		}
+		if layoutMark(m) == merged.last {
+			l = merged.layout.copy()
+			from = merged.count
+		}
+	}
+
+	if from == count {
+		return l, nil
+	}
+
+	msgs, err := s.GetRange(from, count-1)
+	if err != nil {
+		return l, err
+	}
+
+	for _, m := range msgs {
+		later, err := decodeLayout(m)
+		if err != nil {
+			return l, err
+		}
+		l.merge(later)
+	}
+
+	core.lock.Lock()
+	core.merged = mergedLayout{l.copy(), count, layoutMark(msgs[len(msgs)-1])}
+	core.lock.Unlock()
+
+	return l, nil
+}
+
+func decodeLayout(m *msg.Message) (layout, error) {
+	l := newLayout()
+
+	bytes, ok := m.Content[LAYOUT_KIND].([]byte)
+	if !ok {
+		return l, errBadCommand
+	}
+	if err := cbor.Unmarshal(bytes, &l); err != nil {
+		return l, err
+	}
+
+	for _, id := range l.Changed {
+		if info, there := l.Slates[id]; there {
+			info.Stamp = m.Order()
+			l.Slates[id] = info
+		}
+	}
+	l.Changed = nil
+
+	return l, nil
+}
+
+// which message a merged layout goes up to
+func layoutMark(m *msg.Message) string {
+	return fmt.Sprintf("%s/%d", m.Device, m.Seq)
+}
+
+func (l layout) copy() layout {
+	c := newLayout()
+	c.Open = append(c.Open, l.Open...)
+	for id, info := range l.Slates {
+		c.Slates[id] = info
+	}
+	return c
+}
+
+// merge a layout written later into this one
+func (l *layout) merge(later layout) {
+	for id, info := range later.Slates {
+		if ours, there := l.Slates[id]; !there || !info.Stamp.Before(ours.Stamp) {
+			l.Slates[id] = info
+		}
+	}
+
+	open := make([]string, 0, len(l.Open))
+	for _, id := range later.Open {
+		if !slices.Contains(open, id) {
+			open = append(open, id)
+		}
+	}
+	for _, id := range l.Open {
+		if _, known := later.Slates[id]; !known && !slices.Contains(open, id) {
+			open = append(open, id)
+		}
+	}
+
+	// (an archive from before may have won over the later layout's)
+	l.Open = make([]string, 0, len(open))
+	for _, id := range open {
+		if info, there := l.Slates[id]; there && !info.Archived {
+			l.Open = append(l.Open, id)
+		}
+	}
+}
+
+// change the layout, and write it down (every view is updated once it's written, see openSlate)
+func (core *Core) changeLayout(change func(*layout) error) error {
+	core.layoutLock.Lock()
+	defer core.layoutLock.Unlock()
+
+	l, err := core.loadLayout()
+	if err != nil {
+		return err
+	}
+
+	before := make(map[string]slateInfo, len(l.Slates))
+	for id, info := range l.Slates {
+		before[id] = info
+	}
+
+	if err = change(&l); err != nil {
+		return err
+	}
+
+	// (they're stamped when the message is, see decodeLayout)
+	l.Changed = make([]string, 0)
+	for id, info := range l.Slates {
+		if old, there := before[id]; !there || old != info {
+			l.Changed = append(l.Changed, id)
+		}
+	}
+
+	bytes, err := cbor.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	s, err := core.openSlate(LAYOUT_SLATE)
+	if err != nil {
+		return err
+	}
+
+	return s.Write(&msg.Message{
+		User: "system",
+		Kind: LAYOUT_KIND,
+		Sent: msg.Timestamp(),
+		Content: map[string]any{
+			LAYOUT_KIND: bytes,
+		},
+	})
+}
+
+func (core *Core) handleLayoutCommand(m *msg.Message) {
+	if core.store.Store == nil {
+		log.Debugf("discarded %s before setup", m.Kind)
+		return
+	}
+
+	title, _ := m.Content["title"].(string)
+	title = strings.TrimSpace(title)
+
+	var err error
+
+	switch m.Kind {
+	case "slate:create":
+		id, idErr := nanoid.New()
+		if idErr != nil {
+			log.Panic(idErr)
+		}
+		if title == "" {
+			title = "untitled"
+		}
+
+		err = core.changeLayout(func(l *layout) error {
+			l.Slates[id] = slateInfo{Title: title}
+			l.Open = append(l.Open, id)
+			return nil
+		})
+
+	case "slate:rename":
+		err = core.changeSlate(m.Slate, func(l *layout, info *slateInfo) error {
+			if title == "" {
+				return errBadCommand
+			}
+			info.Title = title
+			return nil
+		})
+
+	case "slate:move":
+		index, ok := m.Content["index"].(float64)
+		if !ok {
+			err = errBadCommand
+			break
+		}
+
+		err = core.changeSlate(m.Slate, func(l *layout, info *slateInfo) error {
+			from := slices.Index(l.Open, m.Slate)
+			if from == -1 {
+				return errNoSuchSlate
+			}
+
+			l.Open = slices.Delete(l.Open, from, from+1)
+
+			to := int(index)
+			if to < 0 {
+				to = 0
+			}
+			if to > len(l.Open) {
+				to = len(l.Open)
+			}
+
+			l.Open = slices.Insert(l.Open, to, m.Slate)
+			return nil
+		})
+
+	case "slate:close":
+		err = core.changeSlate(m.Slate, func(l *layout, info *slateInfo) error {
+			l.Open = without(l.Open, m.Slate)
+			return nil
+		})
+
+	case "slate:open":
+		err = core.changeSlate(m.Slate, func(l *layout, info *slateInfo) error {
+			info.Archived = false
+			if !slices.Contains(l.Open, m.Slate) {
+				l.Open = append(l.Open, m.Slate)
+			}
+			return nil
+		})
+
+	case "slate:archive":
+		err = core.changeSlate(m.Slate, func(l *layout, info *slateInfo) error {
+			info.Archived = true
+			l.Open = without(l.Open, m.Slate)
+			return nil
+		})
+	}
+
+	if err != nil {
+		log.Debugf("%s: %s", m.Kind, err)
+	}
+}
+
+func (core *Core) changeSlate(id string, change func(*layout, *slateInfo) error) error {
+	return core.changeLayout(func(l *layout) error {
+		info, there := l.Slates[id]
+		if !there {
+			return errNoSuchSlate
+		}
+		if err := change(l, &info); err != nil {
+			return err
+		}
+		l.Slates[id] = info
+		return nil
+	})
+}
+
+func without(open []string, id string) []string {
+	if i := slices.Index(open, id); i != -1 {
+		return slices.Delete(open, i, i+1)
+	}
+	return open
+}
+
+// bring every view up to date with the layout
+func (core *Core) showLayout() {
+	l, err := core.loadLayout()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, sid := range core.sessionIDs() {
+		core.showLayoutIn(sid, l, "")
+	}
+}
+
+// send a view all over again, for a client coming back
+func (core *Core) reshowLayout(sid, client string) {
+	l, err := core.loadLayout()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	core.showLayoutIn(sid, l, client)
+}
+
+// open and close slates in a view to match the layout, and send the layout to the session,
+// with the recent history of the slates it didn't have open (and of all of them, for a client coming back)
+func (core *Core) showLayoutIn(sid string, l layout, client string) {
+	opened := make([]*slate.PersistentSlate, 0)
+	shown := make([]*slate.PersistentSlate, 0)
+
+	for _, id := range l.Open {
+		s, err := core.openSlate(id)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		core.lock.Lock()
+		session, there := core.sessions[sid]
+		if !there {
+			core.lock.Unlock()
+			return
+		}
+		if _, open := session.view.slates[id]; !open {
+			opened = append(opened, s)
+		} else {
+			shown = append(shown, s)
+		}
+		session.view.slates[id] = s
+		core.lock.Unlock()
+	}
+
+	core.lock.Lock()
+	session, there := core.sessions[sid]
+	if !there {
+		core.lock.Unlock()
+		return
+	}
+	for id := range session.view.slates {
+		if id != "setup" && !slices.Contains(l.Open, id) {
+			delete(session.view.slates, id)
+		}
+	}
+	session.view.layout = append([]string{"setup"}, l.Open...)
+	core.sessions[sid] = session
+	core.lock.Unlock()
+
+	core.Output <- OutputLayout{sid, slateInfos(l)}
+
+	for _, s := range opened {
+		core.sendLatest(sid, "", s)
+	}
+	if client != "" {
+		for _, s := range shown {
+			core.sendLatest(sid, client, s)
+		}
+	}
+}
+
+// open slates in order, then the rest by title
+func slateInfos(l layout) []SlateInfo {
+	infos := make([]SlateInfo, 0, len(l.Slates))
+
+	for _, id := range l.Open {
+		info := l.Slates[id]
+		infos = append(infos, SlateInfo{id, info.Title, true, info.Archived})
+	}
+
+	rest := make([]SlateInfo, 0)
+	for id, info := range l.Slates {
+		if !slices.Contains(l.Open, id) {
+			rest = append(rest, SlateInfo{id, info.Title, false, info.Archived})
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		return rest[i].Title < rest[j].Title
+	})
+
+	return append(infos, rest...)
+}
+
+// messages on a persistent slate go to every view it's open in
+func (core *Core) toViews(m *msg.Message) {
+	core.lock.RLock()
+	sids := make([]string, 0)
+	for sid, session := range core.sessions {
+		if _, there := session.view.slates[m.Slate]; there && session.away.IsZero() {
+			sids = append(sids, sid)
+		}
+	}
+	core.lock.RUnlock()
+
+	for _, sid := range sids {
+		core.sendMessage(sid, m)
+	}
+}
+
+func (core *Core) sessionIDs() []string {
+	core.lock.RLock()
+	defer core.lock.RUnlock()
+
+	sids := make([]string, 0, len(core.sessions))
+	for sid := range core.sessions {
+		sids = append(sids, sid)
+	}
+	return sids
+}
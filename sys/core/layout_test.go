@@ -0,0 +1,191 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"slater/core/msg"
+	"slater/core/slate"
+)
+
+func TestLayout(t *testing.T) {
+	l := newLayout()
+	l.Slates["a"] = slateInfo{Title: "zebra"}
+	l.Slates["b"] = slateInfo{Title: "apple", Archived: true}
+	l.Slates["c"] = slateInfo{Title: "mango"}
+	l.Slates["d"] = slateInfo{Title: "kiwi"}
+	l.Open = []string{"c", "a"}
+
+	bytes, err := cbor.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got layout
+	if err = cbor.Unmarshal(bytes, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := slateInfos(got)
+
+	expected := []SlateInfo{
+		{"c", "mango", true, false},
+		{"a", "zebra", true, false},
+		{"b", "apple", false, true},
+		{"d", "kiwi", false, false},
+	}
+
+	if len(infos) != len(expected) {
+		t.Fatalf("got %d slates, expected %d", len(infos), len(expected))
+	}
+	for i := range expected {
+		if infos[i] != expected[i] {
+			t.Fatalf("slate %d: got %v, expected %v", i, infos[i], expected[i])
+		}
+	}
+
+	if open := without(got.Open, "c"); len(open) != 1 || open[0] != "a" {
+		t.Fatalf("closing c left %v", open)
+	}
+}
+
+func TestLayoutCommands(t *testing.T) {
+	core := testCore(t, LAYOUT_SLATE)
+
+	command := func(kind, id string, content map[string]any) {
+		core.handleLayoutCommand(&msg.Message{Slate: id, Kind: kind, Content: content})
+	}
+
+	load := func() layout {
+		l, err := core.loadLayout()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	find := func(l layout, title string) string {
+		for id, info := range l.Slates {
+			if info.Title == title {
+				return id
+			}
+		}
+		t.Fatalf("no slate called %s", title)
+		return ""
+	}
+
+	for _, title := range []string{"one", "two", "three"} {
+		command("slate:create", "", map[string]any{"title": title})
+	}
+
+	l := load()
+	one, two, three := find(l, "one"), find(l, "two"), find(l, "three")
+	if len(l.Open) != 3 || l.Open[0] != one || l.Open[2] != three {
+		t.Fatalf("created %v", l.Open)
+	}
+
+	command("slate:rename", two, map[string]any{"title": "deux"})
+	command("slate:move", three, map[string]any{"index": float64(0)})
+	command("slate:archive", one, map[string]any{})
+
+	// as it's read back on another start
+	core.slates[LAYOUT_SLATE] = slate.NewPersistentSlate(LAYOUT_SLATE, "a", core.store)
+	core.merged = mergedLayout{}
+	l = load()
+
+	if l.Slates[two].Title != "deux" {
+		t.Fatalf("renamed to %s", l.Slates[two].Title)
+	}
+	if !l.Slates[one].Archived || len(l.Open) != 2 || l.Open[0] != three || l.Open[1] != two {
+		t.Fatalf("got %v, %+v", l.Open, l.Slates)
+	}
+
+	command("slate:open", one, map[string]any{})
+	if l = load(); l.Slates[one].Archived || len(l.Open) != 3 || l.Open[2] != one {
+		t.Fatalf("reopened to %v, %+v", l.Open, l.Slates)
+	}
+}
+
+func TestLayoutMerge(t *testing.T) {
+	base := newLayout()
+	base.Slates["a"] = slateInfo{Title: "a", Stamp: msg.Stamp{Wall: 1}}
+	base.Open = []string{"a"}
+
+	// two devices change the same layout at once
+	fork := func(change func(*layout)) layout {
+		l := newLayout()
+		l.merge(base)
+		change(&l)
+		return l
+	}
+	first := fork(func(l *layout) {
+		l.Slates["b"] = slateInfo{Title: "b", Stamp: msg.Stamp{Wall: 2}}
+		l.Open = append(l.Open, "b")
+	})
+	second := fork(func(l *layout) {
+		l.Slates["a"] = slateInfo{Title: "renamed", Stamp: msg.Stamp{Wall: 2, Logical: 1}}
+		l.Slates["c"] = slateInfo{Title: "c", Stamp: msg.Stamp{Wall: 2, Logical: 1}}
+		l.Open = append(l.Open, "c")
+	})
+
+	l := newLayout()
+	for _, next := range []layout{base, second, first} {
+		l.merge(next)
+	}
+
+	if len(l.Slates) != 3 || l.Slates["a"].Title != "renamed" {
+		t.Fatalf("merged %+v", l.Slates)
+	}
+	if len(l.Open) != 3 || l.Open[0] != "a" || l.Open[1] != "b" || l.Open[2] != "c" {
+		t.Fatalf("merged open %v", l.Open)
+	}
+}
+
+func TestLayoutStamps(t *testing.T) {
+	core := testCore(t, LAYOUT_SLATE)
+	s := core.slates[LAYOUT_SLATE]
+
+	core.handleLayoutCommand(&msg.Message{Kind: "slate:create", Content: map[string]any{"title": "one"}})
+
+	l, err := core.loadLayout()
+	if err != nil || len(l.Open) != 1 {
+		t.Fatalf("created %v, %v", l.Open, err)
+	}
+	one := l.Open[0]
+
+	created := all(t, s)[0]
+	if l.Slates[one].Stamp != created.Stamp {
+		t.Fatalf("stamped %v, the message was %v", l.Slates[one].Stamp, created.Stamp)
+	}
+
+	// another device created a slate before this one did, and it arrives late
+	theirs := newLayout()
+	theirs.Slates["two"] = slateInfo{Title: "two"}
+	theirs.Open = []string{"two"}
+	theirs.Changed = []string{"two"}
+	bytes, err := cbor.Marshal(theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	early := msg.Stamp{Wall: created.Stamp.Wall - 1}
+	if err = s.Recv(&msg.Message{Device: "b", Seq: 1, Stamp: early, Kind: LAYOUT_KIND, Content: map[string]any{LAYOUT_KIND: bytes}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = core.loadLayout(); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Open) != 2 || l.Open[0] != one || l.Open[1] != "two" || l.Slates["two"].Stamp != early {
+		t.Fatalf("merged %v, %+v", l.Open, l.Slates)
+	}
+	if core.merged.count != 2 {
+		t.Fatalf("merged up to %d", core.merged.count)
+	}
+
+	// a change made on the loaded layout doesn't touch the one kept on the core
+	l.Open = nil
+	if l, err = core.loadLayout(); err != nil || len(l.Open) != 2 {
+		t.Fatalf("kept %v, %v", l.Open, err)
+	}
+}
@@ -0,0 +1,37 @@
+package msg
+
+// A hybrid logical clock stamp: wall clock milliseconds, plus a counter for
+// when the wall clock hasn't moved past the latest stamp we've seen.
+// Stamps only ever move forward, so a message is always stamped after everything
+// its device had seen when it was written, however skewed the device's clock is.
+//
+// A stamp from another device can only be so far ahead of our own clock (MAX_DRIFT),
+// or one device with its clock way off would drag every stamp after it along.
+type Stamp struct {
+	Wall    int64
+	Logical uint32
+}
+
+// a stamp after latest, and as close to the wall clock as possible
+func NextStamp(latest Stamp) Stamp {
+	now := Timestamp()
+	if now > latest.Wall {
+		return Stamp{Wall: now}
+	}
+	return Stamp{Wall: latest.Wall, Logical: latest.Logical + 1}
+}
+
+// how far ahead of the wall clock a stamp from another device can be, in milliseconds
+const MAX_DRIFT = 10 * 60 * 1000
+
+// whether a stamp from another device is too far ahead of our clock to take (yet)
+func (a Stamp) Ahead() bool {
+	return a.Wall > Timestamp()+MAX_DRIFT
+}
+
+func (a Stamp) Before(b Stamp) bool {
+	if a.Wall == b.Wall {
+		return a.Logical < b.Logical
+	}
+	return a.Wall < b.Wall
+}
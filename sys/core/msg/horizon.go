@@ -26,3 +26,13 @@ func DecodeHorizon(b []byte) (*Horizon, error) {
 func (h *Horizon) Update(device string, seq uint64) {
 	(*h)[device] = seq
 }
+
+// whether other has seen messages which h has not
+func (h *Horizon) Behind(other *Horizon) bool {
+	for device, seq := range *other {
+		if (*h)[device] < seq {
+			return true
+		}
+	}
+	return false
+}
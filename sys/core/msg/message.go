@@ -11,6 +11,7 @@ type Message struct {
 	Device  string
 	Seq     uint64
 	Sent    int64
+	Stamp   Stamp
 	Prev    string
 	Next    string
 	Kind    string
@@ -18,6 +19,15 @@ type Message struct {
 	Content map[string]any
 }
 
+// the stamp a message is ordered by
+// (messages written before there were stamps only have Sent)
+func (m *Message) Order() Stamp {
+	if m.Stamp == (Stamp{}) {
+		return Stamp{Wall: m.Sent}
+	}
+	return m.Stamp
+}
+
 // Using fxmacker's defaults for now...
 // (there was something I wanted to configure later on, but can't remember what right now...)
 
@@ -2,6 +2,8 @@ package core
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"sync"
 	"time"
 
@@ -37,10 +39,22 @@ type node struct {
 	psub     *pubsub.PubSub
 	ctx      context.Context
 	channels map[string]channel
-	output   chan *msg.Message
+	sealers  map[string]*sealer
+	lock     *sync.RWMutex // channels and sealers
+	output   chan received
+	done     chan struct{}
+	mdns     mdns.Service
 
 	discoveryKey string
+	topicKey     []byte
 	signet       []byte
+	signKey      ed25519.PrivateKey
+}
+
+// a message, and the topic it came in on
+type received struct {
+	topic string
+	m     *msg.Message
 }
 
 type channel struct {
@@ -48,7 +62,16 @@ type channel struct {
 	sub   *pubsub.Subscription
 }
 
-func (n node) close() error {
+func (n *node) close() error {
+	close(n.done)
+	if n.mdns != nil {
+		n.mdns.Close()
+	}
+	if n.dht != nil {
+		if err := n.dht.Close(); err != nil {
+			log.Debug(err)
+		}
+	}
 	return n.host.Close()
 }
 
@@ -121,7 +144,10 @@ func startNet(key crypto.PrivKey, db store.Store) (*node, error) {
 		psub:     psub,
 		ctx:      background,
 		channels: make(map[string]channel),
-		output:   make(chan *msg.Message),
+		sealers:  make(map[string]*sealer),
+		lock:     &sync.RWMutex{},
+		output:   make(chan received),
+		done:     make(chan struct{}),
 	}
 
 	n.bootstrap(bootstrapNodes)
@@ -201,8 +227,60 @@ func (n *discoveryNotifee) HandlePeerFound(pi peer.AddrInfo) {
 }
 
 func runMdns(n *node) error {
-	s := mdns.NewMdnsService(n.host, DiscoveryServiceTag, &discoveryNotifee{n.host})
-	return s.Start()
+	n.mdns = mdns.NewMdnsService(n.host, DiscoveryServiceTag, &discoveryNotifee{n.host})
+	return n.mdns.Start()
+}
+
+// add a key for sealing payloads on a topic
+func (n *node) addTopicKey(topic string, version byte, key []byte) error {
+	n.lock.Lock()
+	s, there := n.sealers[topic]
+	if !there {
+		s = newSealer()
+		n.sealers[topic] = s
+	}
+	n.lock.Unlock()
+
+	return s.use(version, key)
+}
+
+func (n *node) seal(topic string, plain []byte) ([]byte, error) {
+	n.lock.RLock()
+	s, there := n.sealers[topic]
+	n.lock.RUnlock()
+
+	if !there {
+		return nil, errors.New("no key for topic " + topic)
+	}
+
+	return s.seal(topic, plain)
+}
+
+func (n *node) open(topic string, sealed []byte) ([]byte, error) {
+	n.lock.RLock()
+	s, there := n.sealers[topic]
+	n.lock.RUnlock()
+
+	if !there {
+		return nil, errUnsealed
+	}
+
+	return s.open(topic, sealed)
+}
+
+// stop talking to a revoked device
+func (n *node) banish(device string) {
+	pid, err := peer.Decode(device)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	n.psub.BlacklistPeer(pid)
+
+	if err := n.host.Network().ClosePeer(pid); err != nil {
+		log.Debug(err)
+	}
 }
 
 func (n *node) join(k string, f pubsub.ValidatorEx) {
@@ -211,18 +289,41 @@ func (n *node) join(k string, f pubsub.ValidatorEx) {
 	topic, err := n.psub.Join(k)
 	if err != nil {
 		log.Error(err)
+		return
 	}
 
 	sub, err := topic.Subscribe()
 	if err != nil {
 		log.Error(err)
+		return
 	}
 
+	n.lock.Lock()
 	n.channels[k] = channel{topic, sub}
+	n.lock.Unlock()
 
 	go run(n, sub)
 }
 
+func (n *node) leave(k string) {
+	n.lock.Lock()
+	c, there := n.channels[k]
+	delete(n.channels, k)
+	n.lock.Unlock()
+
+	if !there {
+		return
+	}
+
+	c.sub.Cancel()
+
+	if err := c.topic.Close(); err != nil {
+		log.Debug(err)
+	}
+
+	n.psub.UnregisterTopicValidator(k)
+}
+
 func (n *node) send(topic string, m *msg.Message) {
 	bytes, err := msg.Encode(m)
 	if err != nil {
@@ -230,7 +331,24 @@ func (n *node) send(topic string, m *msg.Message) {
 		return
 	}
 
-	n.channels[topic].topic.Publish(n.ctx, bytes)
+	sealed, err := n.seal(topic, bytes)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	n.lock.RLock()
+	c, there := n.channels[topic]
+	n.lock.RUnlock()
+
+	if !there {
+		log.Debugf("not on %s", topic)
+		return
+	}
+
+	if err = c.topic.Publish(n.ctx, sealed); err != nil {
+		log.Debug(err)
+	}
 }
 
 func run(n *node, sub *pubsub.Subscription) {
@@ -239,7 +357,13 @@ func run(n *node, sub *pubsub.Subscription) {
 
 		if err != nil {
 			log.Error("NET shutting down, cuz", err)
-			delete(n.channels, sub.Topic())
+
+			// (unless it's been joined again since)
+			n.lock.Lock()
+			if c, there := n.channels[sub.Topic()]; there && c.sub == sub {
+				delete(n.channels, sub.Topic())
+			}
+			n.lock.Unlock()
 			return
 		}
 
@@ -247,14 +371,20 @@ func run(n *node, sub *pubsub.Subscription) {
 			continue
 		}
 
-		m, err := msg.Decode(pmsg.Data)
+		bytes, err := n.open(sub.Topic(), pmsg.Data)
+		if err != nil {
+			log.Error("NET", err)
+			continue
+		}
+
+		m, err := msg.Decode(bytes)
 		if err != nil {
 			log.Error("NET", err)
 			continue
 		}
 
-		m.Device = pmsg.ReceivedFrom.Pretty()
+		m.Device = pmsg.GetFrom().Pretty()
 
-		n.output <- m
+		n.output <- received{sub.Topic(), m}
 	}
 }
@@ -0,0 +1,836 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	_peer "github.com/libp2p/go-libp2p/core/peer"
+	nanoid "github.com/matoous/go-nanoid/v2"
+	"golang.org/x/exp/slices"
+	"lukechampine.com/frand"
+
+	"slater/core/msg"
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+//
+// Operators, for pretending to be the software (Wizard of Oz style): someone else answering on one of the user's slates.
+//
+// The user invites an operator onto a slate, and hands them the invite out of band.
+// The invite names a topic of its own, with a key of its own, so the operator never sees the discovery topic,
+// and nothing but that slate goes over it. Only the device which made the invite talks to the operator.
+//
+//	user                                   operator
+//	operator:invite  slate         ->      (an invite, just to the interface)
+//	                                <-     operator:join  invite           (a slate of their own, for it)
+//	                 operator:hello <-
+//	operator:msg     the recent history, then every message on the slate, as it comes
+//	                 operator:reply <-     whatever the operator writes on their slate
+//	operator:revoke  slate          ->     operator:end
+//	                 operator:leave <-     operator:leave  slate
+//
+// Replies go on the user's slate as the operator, OPERATOR_USER, never as the user.
+// The first peer to say hello on an invite is its operator, and nobody else gets in on it.
+// When the operator keeps saying the same things, they get drafts of scripts to say them instead (see drafts.go).
+//
+// Every step, on either side, goes on the audit slate (the user's devices have it, but it's only written by the core),
+// which the interface can open with operator:audit.
+//
+
+const (
+	OPERATORSKEY  = "o"
+	OPERATOR_USER = "operator"
+	AUDIT_SLATE   = "audit"
+	AUDIT_KIND    = "audit"
+
+	OPERATOR_TOPIC = "slater-operator-"
+	HELLO_TIMEOUT  = time.Minute
+	LEAVE_GRACE    = 5 * time.Second // for the last message on a topic to get out
+)
+
+var (
+	errBadInvite     = errors.New("operator: bad invite")
+	errNoInvite      = errors.New("operator: no such invite")
+	errNotOperator   = errors.New("operator: not the operator")
+	errOperatorSlate = errors.New("operator: not a slate to invite onto")
+)
+
+// what this device has going on with operators, both ways
+type operators struct {
+	Invites map[string]invite // by topic, on the user's side
+	Joined  map[string]joined // by topic, on the operator's side
+}
+
+type invite struct {
+	Topic    string
+	Key      []byte
+	Slate    string
+	Operator string // once they've said hello
+	Created  int64
+}
+
+type joined struct {
+	Topic  string
+	Key    []byte
+	Device string // the user's device
+	Slate  string // the operator's own slate for it
+	Seen   map[string]uint64
+}
+
+// what's handed to the operator
+type inviteCode struct {
+	Topic  string
+	Key    []byte
+	Device string
+	Title  string
+}
+
+func (core *Core) loadOperators() (operators, error) {
+	ops := operators{make(map[string]invite), make(map[string]joined)}
+
+	bytes, err := core.store.Get(OPERATORSKEY)
+	if errors.Is(err, store.ErrNotFound) {
+		return ops, nil
+	}
+	if err != nil {
+		return ops, err
+	}
+
+	if err = cbor.Unmarshal(bytes, &ops); err != nil {
+		return ops, err
+	}
+	if ops.Invites == nil {
+		ops.Invites = make(map[string]invite)
+	}
+	if ops.Joined == nil {
+		ops.Joined = make(map[string]joined)
+	}
+
+	return ops, nil
+}
+
+func (core *Core) changeOperators(change func(*operators) error) error {
+	core.operatorsLock.Lock()
+	defer core.operatorsLock.Unlock()
+
+	ops, err := core.loadOperators()
+	if err != nil {
+		return err
+	}
+
+	if err = change(&ops); err != nil {
+		return err
+	}
+
+	bytes, err := cbor.Marshal(ops)
+	if err != nil {
+		return err
+	}
+
+	return core.store.Put([]string{OPERATORSKEY}, bytes)
+}
+
+func (core *Core) handleOperatorCommand(m *msg.Message) {
+	if !core.setUp() {
+		log.Debugf("discarded %s before setup", m.Kind)
+		return
+	}
+
+	var err error
+
+	switch m.Kind {
+	case "operator:invite":
+		err = core.inviteOperator(m.Slate)
+	case "operator:revoke":
+		err = core.revokeOperators(m.Slate)
+	case "operator:join":
+		code, _ := m.Content["invite"].(string)
+		err = core.joinAsOperator(strings.TrimSpace(code))
+	case "operator:leave":
+		err = core.leaveAsOperator(m.Slate)
+	case "operator:accept":
+		id, _ := m.Content["draft"].(string)
+		err = core.acceptAsOperator(m.Slate, strings.TrimSpace(id))
+	case "operator:audit":
+		err = core.showAudit()
+	}
+
+	if err != nil {
+		log.Debugf("%s: %s", m.Kind, err)
+		for _, s := range core.viewSlates(m.Slate) {
+			sayer(s)(fmt.Sprintf("😬 %s", err))
+			break
+		}
+	}
+}
+
+func (core *Core) inviteOperator(slateName string) error {
+	if slateName == "setup" || slateName == LAYOUT_SLATE || slateName == AUDIT_SLATE || len(core.viewSlates(slateName)) == 0 {
+		return errOperatorSlate
+	}
+
+	s, err := core.openSlate(slateName)
+	if err != nil {
+		return err
+	}
+
+	l, err := core.loadLayout()
+	if err != nil {
+		return err
+	}
+
+	inv := invite{
+		Topic:   OPERATOR_TOPIC + hex.EncodeToString(frand.Bytes(16)),
+		Key:     frand.Bytes(32),
+		Slate:   slateName,
+		Created: msg.Timestamp(),
+	}
+
+	err = core.changeOperators(func(ops *operators) error {
+		ops.Invites[inv.Topic] = inv
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	self := core.getHost().host.ID().String()
+
+	bytes, err := cbor.Marshal(inviteCode{inv.Topic, inv.Key, self, l.Slates[slateName].Title})
+	if err != nil {
+		return err
+	}
+	code := base64.RawURLEncoding.EncodeToString(bytes)
+
+	core.hostInvite(s, inv)
+	core.audit("invite", slateName, self, "invited an operator onto %q", l.Slates[slateName].Title)
+
+	// just to the interface, only the user should hand it out
+	core.toViews(&msg.Message{
+		Slate: slateName,
+		User:  "system",
+		Kind:  "operator:invite",
+		Sent:  msg.Timestamp(),
+		Content: map[string]any{
+			"body":   "Hand this to the operator (anyone who has it can answer here until it's revoked): `" + code + "`",
+			"invite": code,
+		},
+	})
+
+	return nil
+}
+
+// listen on the invite's topic, and pass the slate along
+func (core *Core) hostInvite(s *slate.PersistentSlate, inv invite) {
+	host := core.getHost()
+	self := host.host.ID().String()
+
+	if err := host.addTopicKey(inv.Topic, TOPIC_KEY_VERSION, inv.Key); err != nil {
+		log.Error(err)
+		return
+	}
+
+	host.join(inv.Topic, func(ctx context.Context, pid _peer.ID, pmsg *pubsub.Message) pubsub.ValidationResult {
+		p := pid.String()
+		if p == self {
+			return pubsub.ValidationAccept
+		}
+
+		// without the invite's key, there's no way to write a valid payload
+		if _, err := host.open(inv.Topic, pmsg.Data); err != nil {
+			return pubsub.ValidationReject
+		}
+
+		if operator := core.operatorOf(inv.Topic); operator != "" && operator != p {
+			return pubsub.ValidationReject
+		}
+
+		return pubsub.ValidationAccept
+	})
+
+	detach := s.On(slate.ALL, func(m *msg.Message) {
+		core.forward(inv.Topic, m)
+	})
+
+	core.lock.Lock()
+	if old, there := core.operators[inv.Topic]; there {
+		old()
+	}
+	core.operators[inv.Topic] = detach
+	core.lock.Unlock()
+}
+
+func (core *Core) operatorOf(topic string) string {
+	core.operatorsLock.Lock()
+	defer core.operatorsLock.Unlock()
+
+	ops, err := core.loadOperators()
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+	return ops.Invites[topic].Operator
+}
+
+func (core *Core) forward(topic string, m *msg.Message) {
+	// scripts stay with the user
+	if m.Kind == SCRIPT_KIND {
+		return
+	}
+
+	bytes, err := msg.Encode(m)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	core.getHost().send(topic, &msg.Message{
+		Kind: "operator:msg",
+		Sent: msg.Timestamp(),
+		Content: map[string]any{
+			"topic":   topic,
+			"message": bytes,
+		},
+	})
+}
+
+func (core *Core) revokeOperators(slateName string) error {
+	revoked := make([]invite, 0)
+
+	err := core.changeOperators(func(ops *operators) error {
+		for topic, inv := range ops.Invites {
+			if inv.Slate == slateName {
+				revoked = append(revoked, inv)
+				delete(ops.Invites, topic)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return errNoInvite
+	}
+
+	for _, inv := range revoked {
+		core.stopInvite(inv.Topic, &msg.Message{
+			Kind:    "operator:end",
+			Sent:    msg.Timestamp(),
+			Content: map[string]any{"topic": inv.Topic},
+		})
+		core.audit("revoke", slateName, inv.Operator, "revoked the operator's invite")
+	}
+
+	return nil
+}
+
+// stop passing the slate along, say goodbye, and leave once that's had time to get there
+func (core *Core) stopInvite(topic string, goodbye *msg.Message) {
+	core.lock.Lock()
+	if detach, there := core.operators[topic]; there {
+		detach()
+		delete(core.operators, topic)
+	}
+	core.lock.Unlock()
+
+	core.leaveOperatorTopic(topic, goodbye)
+}
+
+func (core *Core) leaveOperatorTopic(topic string, goodbye *msg.Message) {
+	host := core.getHost()
+	host.send(topic, goodbye)
+
+	time.AfterFunc(LEAVE_GRACE, func() { host.leave(topic) })
+}
+
+func (core *Core) handleOperatorHello(m *msg.Message, topic string) {
+	var inv invite
+	first := false
+
+	err := core.changeOperators(func(ops *operators) error {
+		var there bool
+		if inv, there = ops.Invites[topic]; !there {
+			return errNoInvite
+		}
+		if inv.Operator != "" && inv.Operator != m.Device {
+			return errNotOperator
+		}
+		if inv.Operator == "" {
+			inv.Operator = m.Device
+			ops.Invites[topic] = inv
+			first = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	if first {
+		core.audit("join", inv.Slate, m.Device, "an operator joined")
+	}
+
+	s, err := core.openSlate(inv.Slate)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	// catch them up (they skip what they've already seen)
+	count := int(s.Count())
+	from := count - HISTORY
+	if from < 0 {
+		from = 0
+	}
+	if count == 0 {
+		return
+	}
+
+	history, err := s.GetRange(from, count-1)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, h := range history {
+		core.forward(topic, h)
+	}
+}
+
+func (core *Core) handleOperatorReply(m *msg.Message, topic string) {
+	core.operatorsLock.Lock()
+	ops, err := core.loadOperators()
+	core.operatorsLock.Unlock()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	inv, there := ops.Invites[topic]
+	if !there || inv.Operator == "" || inv.Operator != m.Device {
+		log.Debug(errNotOperator)
+		return
+	}
+
+	switch m.Kind {
+	case "operator:leave":
+		core.audit("leave", inv.Slate, m.Device, "the operator left")
+		return
+	case "operator:accept":
+		id, _ := m.Content["draft"].(string)
+		core.acceptDraft(inv, m.Device, id)
+		return
+	}
+
+	body, ok := m.Content["body"].(string)
+	if !ok {
+		log.Debug("bad operator reply")
+		return
+	}
+
+	s, err := core.openSlate(inv.Slate)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	event, _ := m.Content["event"].(string)
+
+	err = s.Write(&msg.Message{
+		User:  OPERATOR_USER,
+		Kind:  "text",
+		Event: event,
+		Sent:  msg.Timestamp(),
+		Content: map[string]any{
+			"body":        body,
+			OPERATOR_USER: m.Device,
+		},
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	core.audit("reply", inv.Slate, m.Device, "the operator said %q", body)
+	core.recordReply(inv, s, body)
+}
+
+func (core *Core) joinAsOperator(code string) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil {
+		return errBadInvite
+	}
+
+	var ic inviteCode
+	if err = cbor.Unmarshal(bytes, &ic); err != nil || !strings.HasPrefix(ic.Topic, OPERATOR_TOPIC) || len(ic.Key) != 32 {
+		return errBadInvite
+	}
+	if _, err = _peer.Decode(ic.Device); err != nil {
+		return errBadInvite
+	}
+
+	id, err := nanoid.New()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	title := ic.Title
+	if title == "" {
+		title = "untitled"
+	}
+
+	err = core.changeLayout(func(l *layout) error {
+		l.Slates[id] = slateInfo{Title: "operator: " + title}
+		l.Open = append(l.Open, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	j := joined{ic.Topic, ic.Key, ic.Device, id, make(map[string]uint64)}
+
+	err = core.changeOperators(func(ops *operators) error {
+		ops.Joined[j.Topic] = j
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	core.operate(j)
+	core.audit("join", id, core.getHost().host.ID().String(), "joined %q as an operator", title)
+
+	return nil
+}
+
+// listen on the invite's topic, and say hello once the user's device is there
+func (core *Core) operate(j joined) {
+	host := core.getHost()
+	self := host.host.ID().String()
+
+	if err := host.addTopicKey(j.Topic, TOPIC_KEY_VERSION, j.Key); err != nil {
+		log.Error(err)
+		return
+	}
+
+	host.join(j.Topic, func(ctx context.Context, pid _peer.ID, pmsg *pubsub.Message) pubsub.ValidationResult {
+		p := pid.String()
+		if p == self || p == j.Device {
+			return pubsub.ValidationAccept
+		}
+		return pubsub.ValidationReject
+	})
+
+	go func() {
+		device, err := _peer.Decode(j.Device)
+		if err != nil {
+			log.Debug(err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(host.ctx, HELLO_TIMEOUT)
+		defer cancel()
+
+		if err = host.host.Connect(ctx, _peer.AddrInfo{ID: device}); err != nil {
+			log.Debug(err)
+		}
+
+		for ctx.Err() == nil {
+			for _, p := range host.psub.ListPeers(j.Topic) {
+				if p == device {
+					host.send(j.Topic, &msg.Message{
+						Kind:    "operator:hello",
+						Sent:    msg.Timestamp(),
+						Content: map[string]any{"topic": j.Topic},
+					})
+					return
+				}
+			}
+			time.Sleep(time.Second)
+		}
+
+		log.Debugf("operator: nobody on %s", j.Topic)
+	}()
+}
+
+// whether a slate is one this device operates on (and for which topic)
+func (core *Core) operating(slateName string) (joined, bool) {
+	core.operatorsLock.Lock()
+	defer core.operatorsLock.Unlock()
+
+	ops, err := core.loadOperators()
+	if err != nil {
+		log.Error(err)
+		return joined{}, false
+	}
+
+	for _, j := range ops.Joined {
+		if j.Slate == slateName {
+			return j, true
+		}
+	}
+	return joined{}, false
+}
+
+// what the operator writes on their slate goes to the user, and comes back from there
+func (core *Core) operatorReply(j joined, m *msg.Message) {
+	body, _ := m.Content["body"].(string)
+	if m.Kind != "text" || body == "" {
+		log.Debugf("discarded %s on an operator slate", m.Kind)
+		return
+	}
+
+	host := core.getHost()
+
+	host.send(j.Topic, &msg.Message{
+		Kind:    "operator:reply",
+		Sent:    msg.Timestamp(),
+		Content: map[string]any{"topic": j.Topic, "body": body, "event": m.Event},
+	})
+
+	core.audit("reply", j.Slate, host.host.ID().String(), "said %q as the operator", body)
+}
+
+func (core *Core) handleOperatorMsg(m *msg.Message, topic string) {
+	core.operatorsLock.Lock()
+	ops, err := core.loadOperators()
+	core.operatorsLock.Unlock()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	j, there := ops.Joined[topic]
+	if !there || m.Device != j.Device {
+		log.Debug("operator: not from the user")
+		return
+	}
+
+	if m.Kind == "operator:end" {
+		core.stopOperating(j)
+		core.getHost().leave(j.Topic)
+		core.audit("end", j.Slate, m.Device, "the user revoked the invite")
+		core.noteOn(j.Slate, "The user revoked this invite, so nothing more will come through here.")
+		return
+	}
+
+	if m.Kind == "operator:draft" {
+		core.showDraft(j, m)
+		return
+	}
+
+	bytes, ok := m.Content["message"].([]byte)
+	if !ok {
+		log.Debug("bad operator message")
+		return
+	}
+
+	inner, err := msg.Decode(bytes)
+	if err != nil || inner.Kind == SCRIPT_KIND {
+		log.Debug("bad operator message")
+		return
+	}
+
+	// (skips what it's already seen, like the history again on hello)
+	fresh := false
+	err = core.changeOperators(func(ops *operators) error {
+		j, there := ops.Joined[topic]
+		if !there {
+			return errNoInvite
+		}
+		if inner.Seq > j.Seen[inner.Device] {
+			j.Seen[inner.Device] = inner.Seq
+			fresh = true
+		}
+		ops.Joined[topic] = j
+		return nil
+	})
+	if err != nil || !fresh {
+		return
+	}
+
+	s, err := core.openSlate(j.Slate)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	s.Write(&msg.Message{
+		User:    inner.User,
+		Kind:    inner.Kind,
+		Event:   inner.Event,
+		Sent:    inner.Sent,
+		Content: inner.Content,
+	})
+}
+
+// a draft from the user's device, for the operator to look over (see drafts.go)
+func (core *Core) showDraft(j joined, m *msg.Message) {
+	id, _ := m.Content["draft"].(string)
+	name, _ := m.Content["name"].(string)
+	source, _ := m.Content["source"].(string)
+	replies := fmt.Sprint(m.Content["replies"])
+
+	s, err := core.openSlate(j.Slate)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	s.Write(&msg.Message{
+		User: "system",
+		Kind: "operator:draft",
+		Sent: msg.Timestamp(),
+		Content: map[string]any{
+			"body":   fmt.Sprintf("You've answered messages like these %s times, so here's %s, a script which would answer for you (`/accept %s` to attach it):\n```\n%s```", replies, name, id, source),
+			"draft":  id,
+			"name":   name,
+			"source": source,
+		},
+	})
+}
+
+func (core *Core) acceptAsOperator(slateName, id string) error {
+	j, there := core.operating(slateName)
+	if !there {
+		return errNoInvite
+	}
+	if id == "" {
+		return errNoDraft
+	}
+
+	host := core.getHost()
+
+	host.send(j.Topic, &msg.Message{
+		Kind:    "operator:accept",
+		Sent:    msg.Timestamp(),
+		Content: map[string]any{"topic": j.Topic, "draft": id},
+	})
+
+	core.audit("accept", j.Slate, host.host.ID().String(), "accepted draft %s as the operator", id)
+
+	return nil
+}
+
+func (core *Core) leaveAsOperator(slateName string) error {
+	j, there := core.operating(slateName)
+	if !there {
+		return errNoInvite
+	}
+
+	core.stopOperating(j)
+	core.leaveOperatorTopic(j.Topic, &msg.Message{
+		Kind:    "operator:leave",
+		Sent:    msg.Timestamp(),
+		Content: map[string]any{"topic": j.Topic},
+	})
+	core.audit("leave", j.Slate, core.getHost().host.ID().String(), "left as the operator")
+	core.noteOn(j.Slate, "You left, so nothing more will come through here.")
+
+	return nil
+}
+
+func (core *Core) stopOperating(j joined) {
+	err := core.changeOperators(func(ops *operators) error {
+		delete(ops.Joined, j.Topic)
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// (only ever with what came in on an operator's topic, see handleNet)
+func (core *Core) handleOperatorNet(m *msg.Message, topic string) {
+	if said, _ := m.Content["topic"].(string); said != topic {
+		log.Debug("topic mismatch")
+		return
+	}
+
+	switch m.Kind {
+	case "operator:hello":
+		core.handleOperatorHello(m, topic)
+	case "operator:reply", "operator:leave", "operator:accept":
+		core.handleOperatorReply(m, topic)
+	case "operator:msg", "operator:end", "operator:draft":
+		core.handleOperatorMsg(m, topic)
+	}
+}
+
+// back on the topics after a restart (or a rotation)
+func (core *Core) rejoinOperators() {
+	core.operatorsLock.Lock()
+	ops, err := core.loadOperators()
+	core.operatorsLock.Unlock()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, inv := range ops.Invites {
+		s, err := core.openSlate(inv.Slate)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		core.hostInvite(s, inv)
+	}
+
+	for _, j := range ops.Joined {
+		core.operate(j)
+	}
+}
+
+func (core *Core) noteOn(slateName, note string) {
+	s, err := core.openSlate(slateName)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	sayer(s)(note)
+}
+
+// write down who did what, on which slate
+func (core *Core) audit(action, slateName, device, format string, args ...any) {
+	s, err := core.openSlate(AUDIT_SLATE)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	err = s.Write(&msg.Message{
+		User: "system",
+		Kind: AUDIT_KIND,
+		Sent: msg.Timestamp(),
+		Content: map[string]any{
+			"body":   fmt.Sprintf(format, args...),
+			"action": action,
+			"target": slateName,
+			"by":     device,
+		},
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// put the audit slate in the layout, and open it
+func (core *Core) showAudit() error {
+	return core.changeLayout(func(l *layout) error {
+		l.Slates[AUDIT_SLATE] = slateInfo{Title: "audit"}
+		if !slices.Contains(l.Open, AUDIT_SLATE) {
+			l.Open = append(l.Open, AUDIT_SLATE)
+		}
+		return nil
+	})
+}
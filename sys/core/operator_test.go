@@ -0,0 +1,75 @@
+package core
+
+import (
+	"testing"
+
+	"slater/core/msg"
+)
+
+func TestOperatorHello(t *testing.T) {
+	core := testCore(t, "chat", AUDIT_SLATE)
+
+	topic := OPERATOR_TOPIC + "test"
+	err := core.changeOperators(func(ops *operators) error {
+		ops.Invites[topic] = invite{Topic: topic, Slate: "chat"}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first to say hello is the operator, and nobody else
+	for _, device := range []string{"first", "second", "first"} {
+		core.handleOperatorHello(&msg.Message{Kind: "operator:hello", Device: device}, topic)
+	}
+	core.handleOperatorHello(&msg.Message{Kind: "operator:hello", Device: "first"}, OPERATOR_TOPIC+"nope")
+
+	if operator := core.operatorOf(topic); operator != "first" {
+		t.Fatalf("the operator is %q", operator)
+	}
+
+	audited := all(t, core.slates[AUDIT_SLATE])
+	if len(audited) != 1 || audited[0].Content["action"] != "join" || audited[0].Content["by"] != "first" {
+		t.Fatalf("audited %v", audited)
+	}
+}
+
+func TestOperatorSeen(t *testing.T) {
+	core := testCore(t, "mine")
+
+	topic := OPERATOR_TOPIC + "test"
+	err := core.changeOperators(func(ops *operators) error {
+		ops.Joined[topic] = joined{Topic: topic, Device: "user", Slate: "mine", Seen: make(map[string]uint64)}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forward := func(from, device string, seq uint64, body string) {
+		bytes, err := msg.Encode(&msg.Message{Slate: "theirs", Device: device, Seq: seq, Kind: "text", Content: map[string]any{"body": body}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		core.handleOperatorMsg(&msg.Message{Kind: "operator:msg", Device: from, Content: map[string]any{"topic": topic, "message": bytes}}, topic)
+	}
+
+	forward("user", "user", 1, "one")
+	forward("user", "user", 1, "one")  // again, like the history on another hello
+	forward("user", "other", 1, "two") // another of the user's devices counts on its own
+	forward("user", "user", 2, "three")
+	forward("user", "user", 2, "three")
+	forward("someone", "user", 3, "not from the user's device")
+
+	got := all(t, core.slates["mine"])
+
+	expected := []string{"one", "two", "three"}
+	if len(got) != len(expected) {
+		t.Fatalf("got %d messages, expected %d", len(got), len(expected))
+	}
+	for i, body := range expected {
+		if got[i].Content["body"] != body {
+			t.Fatalf("got %v at %d, expected %s", got[i].Content["body"], i, body)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+//
+// Recovery, when the salt file is lost (or the hash file, without a keyring to check the credentials against).
+//
+// Without the salt, there's no way to unwrap the data key, so the local store is set aside,
+// and this device is set up again with the same credentials, as a new device.
+// It joins the discovery topic, another device accepts its signet,
+// and then it pulls every slate from that device.
+//
+// Until every slate has been pulled, the store is marked as recovering,
+// so if Slater is closed in the meantime, recovery picks up where it left off.
+//
+// There's nothing to check the credentials against, so they're typed twice before anything is set aside.
+// Even so, if no other device turns up after RECOVER_ROUNDS reminders, and none ever did,
+// recovery gives up, and leaves the (empty) store to be set aside on the next start, with credentials typed afresh.
+//
+
+const (
+	RECOVERINGKEY = "rv"
+	LOST          = ".lost"
+
+	RECOVER_POLL     = time.Second
+	RECOVER_REMINDER = 30 * time.Second
+	RECOVER_ROUNDS   = 10 // of reminders
+
+	// what the recovering mark says
+	LOOKING = 1
+	FOUND   = 2
+)
+
+func recoverSession(core *Core, feed slate.Slate, say func(...string), sessionName, passphrase, pin string, sessions []string) (store.Store, *node) {
+	say("I'll set this device up again, and copy your data back from one of your other devices.")
+
+	say("I can't check your credentials without my files, so I need them once more, to be sure.")
+
+	for !retypeCredentials(feed, passphrase, pin) {
+		say("😬 Those don't match. Let's start over.")
+		passphrase = <-promptPassphrase(feed)
+		pin = <-promptPIN(feed)
+	}
+
+	if err := setAside(core.root, sessionName); err != nil {
+		log.Error(err)
+		say("Hmm, I couldn't set what's left of your data aside, so I've left everything as it was.")
+		return resumeSession(core, feed, say, sessions)
+	}
+
+	db, node := completeSetup(core, sessionName, passphrase, pin)
+
+	if err := db.Put([]string{RECOVERINGKEY}, []byte{LOOKING}); err != nil {
+		// without the mark, the new (empty) store would pass for the real one, so it goes too
+		log.Error(err)
+		if err = node.close(); err != nil {
+			log.Debug(err)
+		}
+		db.Store.Close()
+		if err = dropCredentials(core.root, sessionName); err != nil {
+			log.Error(err)
+		}
+		say("Hmm, something went wrong, and I couldn't start recovering. Let's try that again.")
+		return resumeSession(core, feed, say, sessions)
+	}
+
+	return db, node
+}
+
+func retypeCredentials(feed slate.Slate, passphrase, pin string) bool {
+	again := <-promptSecret(feed, "setup:passphraseAgain", "Enter your passphrase again")
+	pinAgain := <-promptSecret(feed, "setup:pinAgain", "Enter your PIN again")
+	return again == passphrase && pinAgain == pin
+}
+
+// keep what's left of a session, in case it can be decrypted some other way
+func setAside(rootPath, sessionID string) error {
+	dpath := filepath.Join(rootPath, sessionID)
+
+	for _, name := range []string{store.DB, KEYRING} {
+		path := filepath.Join(dpath, name)
+
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		lost := fmt.Sprintf("%s%s-%d", path, LOST, time.Now().Unix())
+		if err := os.Rename(path, lost); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (core *Core) recovering() bool {
+	_, err := core.store.Get(RECOVERINGKEY)
+	return err == nil
+}
+
+// pull everything from another device, then mark the store as usable
+// (looking for one every poll, and saying so every reminder, see RECOVER_POLL and RECOVER_REMINDER)
+func (core *Core) recoverData(say func(...string), poll, reminder time.Duration) {
+	say("Looking for your other devices.",
+		"Please make sure one of them is online, and running session `"+core.name+"`.")
+
+	reminded := time.Now()
+	rounds := 0
+
+	for {
+		pid, found := core.findDevice()
+		if !found {
+			if time.Since(reminded) > reminder {
+				rounds++
+				if rounds >= RECOVER_ROUNDS && !core.foundDevice() {
+					core.abandonRecovery(say)
+					return
+				}
+				say("Still looking...")
+				reminded = time.Now()
+			}
+			time.Sleep(poll)
+			continue
+		}
+
+		if err := core.store.Put([]string{RECOVERINGKEY}, []byte{FOUND}); err != nil {
+			log.Error(err)
+		}
+
+		horizons, err := core.fetchHorizons(pid)
+		if err != nil {
+			log.Debug(err)
+			time.Sleep(poll)
+			continue
+		}
+
+		names := make([]string, 0, len(horizons))
+		for name := range horizons {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		say(fmt.Sprintf("Found device `%s`. Copying %d slates from it...", pid, len(names)))
+
+		complete := true
+
+		for i, name := range names {
+			s, err := core.openSlate(name)
+			if err != nil {
+				log.Error(err)
+				complete = false
+				continue
+			}
+
+			theirs := horizons[name]
+
+			core.pull(pid, s, theirs)
+
+			ours, err := s.Horizon()
+			if err != nil || ours.Behind(theirs) {
+				say(fmt.Sprintf("Couldn't copy all of `%s` (%d of %d) yet.", name, i+1, len(names)))
+				complete = false
+				continue
+			}
+
+			say(fmt.Sprintf("Copied `%s` (%d of %d): %d messages.", name, i+1, len(names), s.Count()))
+		}
+
+		if complete {
+			break
+		}
+
+		say("I'll try the rest again in a moment.")
+		time.Sleep(poll)
+	}
+
+	if err := core.store.Delete(RECOVERINGKEY); err != nil {
+		log.Error(err)
+	}
+
+	say("All done! Your data is back.")
+}
+
+// whether recovery ever found another device (so the store may have some of the user's data in it)
+func (core *Core) foundDevice() bool {
+	mark, err := core.store.Get(RECOVERINGKEY)
+	return err != nil || len(mark) != 1 || mark[0] != LOOKING
+}
+
+// nothing was copied, so drop the salt and hash: next time, recovery starts over, with the credentials typed again
+func (core *Core) abandonRecovery(say func(...string)) {
+	if err := dropCredentials(core.root, core.name); err != nil {
+		log.Error(err)
+		say("Hmm, something went wrong. Please close Slater, and start it again.")
+		return
+	}
+
+	say("😬 I can't find any of your other devices.",
+		"Maybe none of them is online, or maybe the passphrase or PIN weren't quite right.",
+		"Please close Slater. Once another device is online, start Slater again, and I'll ask for your credentials again.")
+}
+
+func dropCredentials(rootPath, sessionID string) error {
+	for _, name := range []string{SALT, HASH} {
+		err := os.Remove(filepath.Join(rootPath, sessionID, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// one of the user's other devices, which we're connected to
+func (core *Core) findDevice() (peer.ID, bool) {
+	devices := core.connectedDevices()
+	if len(devices) == 0 {
+		return "", false
+	}
+	return devices[0], true
+}
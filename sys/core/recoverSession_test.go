@@ -0,0 +1,152 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+func TestSetAside(t *testing.T) {
+	root := t.TempDir()
+	name := "brave-little-otter"
+
+	for _, dir := range []string{store.DB, KEYRING} {
+		if err := os.MkdirAll(filepath.Join(root, name, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := setAside(root, name); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{store.DB, KEYRING} {
+		if _, err := os.Stat(filepath.Join(root, name, dir)); !os.IsNotExist(err) {
+			t.Fatal(dir, "should be gone", err)
+		}
+		lost, _ := filepath.Glob(filepath.Join(root, name, dir+LOST+"-*"))
+		if len(lost) != 1 {
+			t.Fatal(dir, "should be set aside once", lost)
+		}
+	}
+
+	// nothing left to set aside is fine too
+	if err := setAside(root, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverSessionSetAsideFails(t *testing.T) {
+	// with the root a file, nothing under it can be moved
+	root := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(root, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	core := &Core{root: root}
+	feed := slate.NewEphemeralSlate("setup")
+	said := make(chan string, 10)
+	say := func(things ...string) { said <- strings.Join(things, "\n") }
+
+	go recoverSession(core, feed, say, "brave-little-otter", "one two three four five six", "1234", []string{"brave-little-otter"})
+	answer(t, feed, map[string]any{
+		"setup:passphraseAgain": "one two three four five six",
+		"setup:pinAgain":        "1234",
+	})
+
+	for told := false; !told; {
+		select {
+		case s := <-said:
+			told = strings.Contains(s, "set what's left of your data aside")
+		case <-time.After(5 * time.Second):
+			t.Fatal("never said it couldn't set the data aside")
+		}
+	}
+
+	// and it's back to choosing a session, rather than panicking
+	deadline := time.Now().Add(5 * time.Second)
+	for evt, _ := lastPrompt(feed); evt != "setup:sessionID"; evt, _ = lastPrompt(feed) {
+		if time.Now().After(deadline) {
+			t.Fatal("no session choice, but", evt)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRecoverDataGivesUp(t *testing.T) {
+	core := testCore(t)
+
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	core.host = &node{host: h}
+
+	if err = core.store.Put([]string{RECOVERINGKEY}, []byte{LOOKING}); err != nil {
+		t.Fatal(err)
+	}
+
+	said := make([]string, 0)
+	say := func(things ...string) { said = append(said, strings.Join(things, "\n")) }
+
+	core.recoverData(say, time.Millisecond, time.Millisecond)
+
+	// a greeting, a reminder for every round but the last, then giving up
+	if len(said) != RECOVER_ROUNDS+1 || !strings.Contains(said[len(said)-1], "can't find any of your other devices") {
+		t.Fatal("said", said)
+	}
+
+	for _, name := range []string{SALT, HASH} {
+		if _, err = os.Stat(filepath.Join(core.root, core.name, name)); !os.IsNotExist(err) {
+			t.Fatal(name, "should be gone", err)
+		}
+	}
+}
+
+func TestRebuildHashBeforeKeyring(t *testing.T) {
+	root := t.TempDir()
+	name, phrase, pin := "brave-little-otter", "one two three four five six", "1234"
+
+	// a store from before the keyring, encrypted with the master key itself
+	db, err := store.OpenStore(root, name, createMasterKey(root, name, phrase, pin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Store.Close()
+
+	if err = os.Remove(filepath.Join(root, name, HASH)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = rebuildHash(root, name, phrase, "4321"); !errors.Is(err, errAuthFail) {
+		t.Fatal("wrong credentials should fail", err)
+	}
+
+	key, err := rebuildHash(root, name, phrase, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := getMasterKey(root, name, phrase, pin); err != nil || got != key {
+		t.Fatal("hash not written again", err)
+	}
+
+	// with no store either, there's nothing to check against
+	if err = os.RemoveAll(filepath.Join(root, name, store.DB)); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(root, name, HASH)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rebuildHash(root, name, phrase, pin); !errors.Is(err, errLostHash) {
+		t.Fatal("expected a lost hash", err)
+	}
+}
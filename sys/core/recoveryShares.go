@@ -0,0 +1,343 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/frand"
+
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+//
+// Social recovery, with Shamir shares (see shamir.go).
+//
+// A random recovery key wraps the data key in the keyring's recovery slot (see keyring.go),
+// and the recovery key is split into shares, for the user to give to people they trust.
+// Any threshold of the shares give the recovery key back, which unlocks the store without the passphrase, PIN or salt.
+// Then the user makes new credentials, just like a rotation,
+// and this device hands them to the other devices on the old topic (see rotate.go).
+//
+// A share is written in base32, in groups of four:
+//
+//	[version][set: 4 bytes][threshold][x][share: 32 bytes][checksum: 4 bytes]
+//
+// The set tells shares from different splits apart, and the checksum catches typos.
+//
+
+const (
+	RECOVERY_SLOT = "recovery"
+	SHARE_VERSION = 1
+	SHARE_SET     = 4
+	SHARE_CHECK   = 4
+	SHARE_GROUP   = 4
+)
+
+var (
+	shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	errBadShare = errors.New("bad recovery share")
+
+	shareSplits = []string{"2 of 3", "3 of 5", "4 of 7"}
+)
+
+type share struct {
+	set       []byte
+	threshold byte
+	x         byte
+	data      []byte
+}
+
+func encodeShare(s share) string {
+	b := []byte{SHARE_VERSION}
+	b = append(b, s.set...)
+	b = append(b, s.threshold, s.x)
+	b = append(b, s.data...)
+
+	check := blake2b.Sum256(b)
+	b = append(b, check[:SHARE_CHECK]...)
+
+	text := shareEncoding.EncodeToString(b)
+
+	groups := make([]string, 0, len(text)/SHARE_GROUP+1)
+	for len(text) > SHARE_GROUP {
+		groups = append(groups, text[:SHARE_GROUP])
+		text = text[SHARE_GROUP:]
+	}
+	groups = append(groups, text)
+
+	return strings.Join(groups, "-")
+}
+
+func decodeShare(text string) (share, error) {
+	text = strings.ToUpper(text)
+	text = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\n' || r == '\t' {
+			return -1
+		}
+		return r
+	}, text)
+
+	b, err := shareEncoding.DecodeString(text)
+	if err != nil {
+		return share{}, errBadShare
+	}
+
+	if len(b) < 1+SHARE_SET+2+1+SHARE_CHECK || b[0] != SHARE_VERSION {
+		return share{}, errBadShare
+	}
+
+	body, check := b[:len(b)-SHARE_CHECK], b[len(b)-SHARE_CHECK:]
+	sum := blake2b.Sum256(body)
+	if !bytes.Equal(sum[:SHARE_CHECK], check) {
+		return share{}, errBadShare
+	}
+
+	s := share{
+		set:       body[1 : 1+SHARE_SET],
+		threshold: body[1+SHARE_SET],
+		x:         body[2+SHARE_SET],
+		data:      body[3+SHARE_SET:],
+	}
+
+	if s.threshold < 2 || s.x == 0 {
+		return share{}, errBadShare
+	}
+
+	return s, nil
+}
+
+// check the credentials against the ones this session was unlocked with
+func confirmCredentials(core *Core, feed slate.Slate) bool {
+	passphrase := <-promptPassphrase(feed)
+	pin := <-promptPIN(feed)
+
+	key, err := getMasterKey(core.root, core.name, passphrase, pin)
+	if err == nil {
+		key, err = getDataKey(core.root, core.name, PASSWORD_SLOT, key)
+	}
+
+	return err == nil && key == core.key
+}
+
+func setupRecovery(core *Core, feed slate.Slate, say func(...string)) {
+	if !core.setUp() {
+		say("Let's finish setting up this device first.")
+		return
+	}
+
+	say("Recovery shares can get you back in, if you ever lose your passphrase and PIN.",
+		"I'll split a recovery key into shares, for you to give to people you trust.",
+		"A few of them together can get you back in, but fewer can't do anything at all.")
+
+	say("First, I need to confirm your credentials.")
+
+	if !confirmCredentials(core, feed) {
+		say("😬 I could not confirm those credentials, so I didn't make any shares.")
+		return
+	}
+
+	var threshold, count int
+	choice := <-chooseSplit(feed)
+	if _, err := fmt.Sscanf(choice, "%d of %d", &threshold, &count); err != nil {
+		log.Panic(err)
+	}
+
+	key := frand.Bytes(DATA_KEY_SIZE)
+
+	shares, err := split(key, threshold, count)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	set := frand.Bytes(SHARE_SET)
+
+	say("Give each share to a different person, and ask them to keep it safe.",
+		"Make sure nobody is looking!")
+
+	for i, data := range shares {
+		text := encodeShare(share{set, byte(threshold), byte(i + 1), data})
+
+		secret(feed, fmt.Sprintf("Recovery share %d of %d, for `%s`", i+1, count, core.name), text)
+
+		written := <-promptShareWritten(feed)
+		for !written {
+			wait()
+			written = <-promptShareWrittenAgain(feed)
+		}
+	}
+
+	// only now that every share is out there, so that a half-made set never replaces a good one
+	if err := addWrappingKey(core.root, core.name, core.key, RECOVERY_SLOT, string(key)); err != nil {
+		log.Error(err)
+		say("Hmm, something went wrong, and I couldn't save the recovery key. Those shares won't work.")
+		return
+	}
+
+	say(fmt.Sprintf("Done! Any %d of those %d shares can get you back in.", threshold, count),
+		"If you made shares before, they don't work anymore.")
+}
+
+// unlock a session with recovery shares, and make new credentials for it
+func recoverWithShares(core *Core, feed slate.Slate, say func(...string), sessionName string, sessions []string) (store.Store, *node) {
+	say("Okay, let's put your recovery shares together.",
+		"Punch them in one at a time. It doesn't matter which ones, or in what order.")
+
+	shares := make(map[byte][]byte)
+	var set []byte
+	threshold := 0
+
+	for threshold == 0 || len(shares) < threshold {
+		s, err := decodeShare(<-promptShare(feed))
+		if err != nil {
+			say("Hmm, that doesn't look right. Check it for typos, and try again.")
+			continue
+		}
+
+		if set != nil && !bytes.Equal(s.set, set) {
+			say("That share is from a different set than the first one.")
+			continue
+		}
+
+		set, threshold = s.set, int(s.threshold)
+		shares[s.x] = s.data
+
+		if len(shares) < threshold {
+			say(fmt.Sprintf("Got it. %d more to go.", threshold-len(shares)))
+		}
+	}
+
+	recoveryKey, err := combine(shares)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	dataKey, err := getDataKey(core.root, sessionName, RECOVERY_SLOT, string(recoveryKey))
+	if err != nil {
+		say("😬 Those shares didn't unlock session `" + sessionName + "`.")
+		return resumeSession(core, feed, say, sessions)
+	}
+
+	db, err := store.OpenStore(core.root, sessionName, dataKey)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	core.lock.Lock()
+	core.name = sessionName
+	core.key = dataKey
+	core.store = db
+	core.lock.Unlock()
+
+	say("That worked! Now you need a new passphrase and PIN.")
+
+	phrase, pin := proposeCredentials(feed, say)
+
+	writeDown(feed, say, sessionName, phrase, pin)
+
+	if err = core.takeOver(phrase, pin); err != nil {
+		log.Panic(err)
+	}
+
+	say("Your other devices will get the new passphrase and PIN as soon as they're online.")
+
+	return startSession(core, db, sessionName, phrase, pin)
+}
+
+// switch to new credentials without the old ones,
+// relaying the last topic this device was on until the other devices have them
+func (core *Core) takeOver(phrase, pin string) error {
+	signKey, err := deriveSignatureKey(core.name, phrase, pin)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := core.store.Get(DEVICESKEY)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	if err == nil {
+		entries, err := decodeRoster(bytes)
+		if err != nil {
+			return err
+		}
+		core.roster.adopt(entries, signKey)
+	}
+
+	if err = saveRoster(core.store, core.roster); err != nil {
+		return err
+	}
+
+	h, err := newHandover(core.name, phrase, pin)
+	if err != nil {
+		return err
+	}
+
+	commitMaster, err := prepareStretchedKey(core.root, core.name, h.Salt, h.Master)
+	if err != nil {
+		return err
+	}
+
+	commitKeyring, err := prepareWrappingKey(core.root, core.name, core.key, PASSWORD_SLOT, string(h.Master))
+	if err != nil {
+		return err
+	}
+
+	if err = commitKeyring(); err != nil {
+		return err
+	}
+	if err = commitMaster(); err != nil {
+		return err
+	}
+
+	rec, err := core.loadRotation()
+	if err != nil {
+		return err
+	}
+
+	rec.Handover = h
+	rec.Handed = nil
+
+	current, err := core.store.Get(TOPICKEY)
+	if err == nil {
+		var t oldTopic
+		if err = cbor.Unmarshal(current, &t); err != nil {
+			return err
+		}
+		rec.Topics = append(rec.Topics, t)
+	}
+
+	return core.saveRotation(rec)
+}
+
+func chooseSplit(feed slate.Slate) chan string {
+	return choose(feed, "setup:split", "How many shares should I make, and how many should it take to get back in?", shareSplits)
+}
+
+func promptShareWritten(feed slate.Slate) chan bool {
+	return affirm(feed, "setup:shareWritten?", "Written down?", "Yes, next", "Not yet...")
+}
+
+func promptShareWrittenAgain(feed slate.Slate) chan bool {
+	return affirm(feed, "setup:shareWritten?", "Okay, tell me when it's written down.", "Yes, next", "Not yet...")
+}
+
+func promptShare(feed slate.Slate) chan string {
+	return promptSecret(feed, "setup:share", "Enter a recovery share")
+}
+
+func askIfForgot(feed slate.Slate) chan bool {
+	return affirm(feed, "setup:forgot?", "Did you forget your passphrase or PIN?",
+		"Use my recovery shares", "No, let me try again")
+}
+
+func askToUseShares(feed slate.Slate) chan bool {
+	return affirm(feed, "setup:useShares?", "Your recovery shares can still unlock your data. Use them?",
+		"Use my recovery shares", "No")
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"errors"
+	"os"
 
 	"github.com/libp2p/go-libp2p-core/crypto"
 
@@ -20,14 +21,24 @@ func resumeSession(core *Core, feed slate.Slate, say func(...string), sessions [
 
 	var passphrase, pin string
 	var db store.Store
-	var err error
 	for db.Store == nil {
 		passphrase = <-promptPassphrase(feed)
 		pin = <-promptPIN(feed)
 
 		key, err := getMasterKey(core.root, sessionName, passphrase, pin)
+		if errors.Is(err, errLostHash) {
+			key, err = rebuildHash(core.root, sessionName, passphrase, pin)
+			if err == nil {
+				say("Hey, my hash file was missing! Your credentials check out though, so I wrote it again.")
+			}
+		}
+
 		if err != nil {
 			if errors.Is(err, errAuthFail) {
+				if hasSlot(core.root, sessionName, RECOVERY_SLOT) && <-askIfForgot(feed) {
+					return recoverWithShares(core, feed, say, sessionName, sessions)
+				}
+
 				say("😬 I could not confirm those credentials.")
 				say("Take a deep breath...")
 				say("Inhale...")
@@ -38,19 +49,28 @@ func resumeSession(core *Core, feed slate.Slate, say func(...string), sessions [
 
 			if errors.Is(err, errLostSalt) {
 				say("Hey, my salt file is missing! Now I can't decrypt your data.")
-			} else if errors.Is(err, errLostHash) {
-				say("Hey, my hash file is missing! Now I can't decrypt your data.")
+			} else if errors.Is(err, errLostHash) || errors.Is(err, os.ErrNotExist) {
+				say("Hey, my hash file is missing! Now I can't check your credentials.")
+			} else {
+				log.Error(err)
+				say("Hmm, something went wrong while checking those credentials. Let's try again.")
+				return resumeSession(core, feed, say, sessions)
 			}
 
-			say("Please don't delete my files. I hope you have a full replica of your data on another device!")
-			say("If so, please make sure it's online and running session " + sessionName)
+			say("Please don't delete my files.")
+
+			if hasSlot(core.root, sessionName, RECOVERY_SLOT) && <-askToUseShares(feed) {
+				return recoverWithShares(core, feed, say, sessionName, sessions)
+			}
 
-			store.RemoveStore(core.root, sessionName)
+			say("I hope you have a full replica of your data on another device!")
 
-			key = createMasterKey(core.root, sessionName, passphrase, pin)
+			return recoverSession(core, feed, say, sessionName, passphrase, pin, sessions)
 		}
 
-		db, err = store.OpenStore(core.root, sessionName, key)
+		var dataKey string
+		db, dataKey, err = openSessionStore(core.root, sessionName, key)
+		core.key = dataKey
 
 		if err != nil {
 			if len(sessions) > 1 {
@@ -74,6 +94,11 @@ func resumeSession(core *Core, feed slate.Slate, say func(...string), sessions [
 		}
 	}
 
+	return startSession(core, db, sessionName, passphrase, pin)
+}
+
+// connect with the libp2p key from an open store
+func startSession(core *Core, db store.Store, sessionName, passphrase, pin string) (store.Store, *node) {
 	keyBytes, err := db.Get(KEYKEY)
 
 	if err != nil {
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+func revokeDevice(core *Core, feed slate.Slate, say func(...string)) {
+	host := core.getHost()
+	if host == nil {
+		say("Let's finish setting up this device first.")
+		return
+	}
+
+	self := host.host.ID().String()
+
+	others := make([]string, 0)
+	about := make([]string, 0)
+	for _, e := range core.roster.list() {
+		if e.Device == self || e.Revoked != 0 {
+			continue
+		}
+		added := time.UnixMilli(e.Added).Format("2006-01-02 15:04")
+		others = append(others, e.Device)
+		about = append(about, fmt.Sprintf("`%s` was added on %s by `%s`", e.Device, added, e.AddedBy))
+	}
+
+	if len(others) == 0 {
+		say("There are no other devices to revoke.")
+		return
+	}
+
+	say(about...)
+
+	device := <-chooseDeviceToRevoke(feed, others)
+
+	sure := <-confirmRevoke(feed, device)
+	if !sure {
+		say("Okay, I'll leave it alone.")
+		return
+	}
+
+	say("First, I need to confirm your credentials.")
+
+	passphrase := <-promptPassphrase(feed)
+	pin := <-promptPIN(feed)
+
+	key, err := deriveSignatureKey(core.name, passphrase, pin)
+	if err != nil || !key.Equal(host.signKey) {
+		say("😬 I could not confirm those credentials, so I didn't revoke anything.")
+		return
+	}
+
+	if err = core.roster.revoke(device, self, key); err != nil {
+		log.Error(err)
+		say("Hmm, something went wrong, and I couldn't revoke that device.")
+		return
+	}
+
+	if err = saveRoster(core.store, core.roster); err != nil {
+		log.Error(err)
+	}
+
+	host = core.getHost() // (the credentials may have rotated meanwhile)
+	host.banish(device)
+	host.sendRoster(core.roster)
+	core.activateScripts()
+
+	say("Done. Your other devices will stop trusting it as soon as they hear about it.")
+	say("If that device was lost, whoever has it might know your passphrase and PIN too, so it's a good idea to change them now.")
+}
+
+func chooseDeviceToRevoke(feed slate.Slate, devices []string) chan string {
+	return choose(feed, "setup:revokeDevice", "Which device do you want to revoke?", devices)
+}
+
+func confirmRevoke(feed slate.Slate, device string) chan bool {
+	return affirm(feed, "setup:revokeDevice?",
+		"## Revoke `"+device+"`?\nIt will not be able to sync with your other devices again.",
+		"Yes, revoke it", "No, keep it")
+}
+
+// another device revoked this one, so it stops syncing, and forgets what it synced with
+func (core *Core) revoked() {
+	core.announce("This device was revoked from another one of your devices, so it won't sync with them anymore.",
+		"Your data is still here, but nothing new will come or go.")
+
+	core.disconnect()
+}
+
+func (core *Core) disconnect() {
+	core.lock.Lock()
+	for topic, detach := range core.operators {
+		detach()
+		delete(core.operators, topic)
+	}
+	core.lock.Unlock()
+
+	if err := core.getHost().close(); err != nil {
+		log.Debug(err)
+	}
+
+	for _, key := range []string{TOPICKEY, ROTATIONKEY, WANTSKEY, OPERATORSKEY} {
+		if err := core.store.Delete(key); err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Error(err)
+		}
+	}
+}
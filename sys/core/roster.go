@@ -0,0 +1,369 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"slater/core/msg"
+	"slater/core/store"
+)
+
+//
+// The roster of a user's devices.
+//
+// Each entry records when a device was added and by which device, and when and by which device it was revoked.
+// Entries are signed with the signature key derived from the credentials,
+// so only a device with the credentials can add or revoke a device.
+//
+// Rosters are merged entry by entry, and a revocation always wins,
+// so every device converges on the same roster, and a revoked device stays revoked.
+// A roster is only sent back to a device whose roster is missing something,
+// and a device which finds itself revoked stops syncing (see revoked, in revokeDevice.go).
+//
+
+type rosterEntry struct {
+	Device    string
+	Added     int64
+	AddedBy   string
+	Revoked   int64
+	RevokedBy string
+	Signature []byte
+}
+
+type roster struct {
+	entries map[string]rosterEntry
+	lock    *sync.RWMutex
+}
+
+var errNotADevice = errors.New("roster: not a device")
+
+func newRoster() *roster {
+	return &roster{
+		entries: make(map[string]rosterEntry),
+		lock:    &sync.RWMutex{},
+	}
+}
+
+func (e rosterEntry) body() []byte {
+	b, err := cbor.Marshal([]any{e.Device, e.Added, e.AddedBy, e.Revoked, e.RevokedBy})
+	if err != nil {
+		log.Panic(err)
+	}
+	return b
+}
+
+func (e *rosterEntry) sign(key ed25519.PrivateKey) {
+	e.Signature = ed25519.Sign(key, e.body())
+}
+
+func (e rosterEntry) verify(key ed25519.PublicKey) bool {
+	return ed25519.Verify(key, e.body(), e.Signature)
+}
+
+// whether a should replace b, for the same device
+func supersedes(a, b rosterEntry) bool {
+	aRevoked, bRevoked := a.Revoked != 0, b.Revoked != 0
+
+	switch {
+	case aRevoked != bRevoked:
+		return aRevoked
+	case aRevoked:
+		if a.Revoked != b.Revoked {
+			return a.Revoked < b.Revoked
+		}
+		return a.RevokedBy < b.RevokedBy
+	default:
+		if a.Added != b.Added {
+			return a.Added < b.Added
+		}
+		return a.AddedBy < b.AddedBy
+	}
+}
+
+func (r *roster) isDevice(device string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	e, there := r.entries[device]
+	return there && e.Revoked == 0
+}
+
+func (r *roster) isRevoked(device string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	e, there := r.entries[device]
+	return there && e.Revoked != 0
+}
+
+// the devices which haven't been revoked
+func (r *roster) devices() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	devices := make([]string, 0, len(r.entries))
+	for device, e := range r.entries {
+		if e.Revoked == 0 {
+			devices = append(devices, device)
+		}
+	}
+	sort.Strings(devices)
+
+	return devices
+}
+
+// all entries, oldest first
+func (r *roster) list() []rosterEntry {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	entries := make([]rosterEntry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Added != entries[j].Added {
+			return entries[i].Added < entries[j].Added
+		}
+		return entries[i].Device < entries[j].Device
+	})
+
+	return entries
+}
+
+func (r *roster) entry(device string) (rosterEntry, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	e, there := r.entries[device]
+	return e, there
+}
+
+// add a device, unless it's already there (or revoked)
+func (r *roster) add(device, by string, key ed25519.PrivateKey) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, there := r.entries[device]; there {
+		return false
+	}
+
+	e := rosterEntry{
+		Device:  device,
+		Added:   msg.Timestamp(),
+		AddedBy: by,
+	}
+	e.sign(key)
+
+	r.entries[device] = e
+
+	return true
+}
+
+func (r *roster) revoke(device, by string, key ed25519.PrivateKey) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e, there := r.entries[device]
+	if !there {
+		return errNotADevice
+	}
+	if e.Revoked != 0 {
+		return nil
+	}
+
+	e.Revoked = msg.Timestamp()
+	e.RevokedBy = by
+	e.sign(key)
+
+	r.entries[device] = e
+
+	return nil
+}
+
+// sign every entry again, with the key from new credentials
+func (r *roster) resign(key ed25519.PrivateKey) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for device, e := range r.entries {
+		e.sign(key)
+		r.entries[device] = e
+	}
+}
+
+// take entries as they are, signing them with a new key
+// (only for entries from our own store, after recovering without the old credentials)
+func (r *roster) adopt(entries []rosterEntry, key ed25519.PrivateKey) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, e := range entries {
+		e.sign(key)
+		r.entries[e.Device] = e
+	}
+}
+
+// merge entries from another device's roster, ignoring any without a valid signature
+// (returns whether anything changed, and which devices were newly revoked)
+func (r *roster) merge(entries []rosterEntry, key ed25519.PublicKey) (bool, []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	changed := false
+	revoked := make([]string, 0)
+
+	for _, e := range entries {
+		if !e.verify(key) {
+			log.Debugf("roster: bad signature on entry for %s", e.Device)
+			continue
+		}
+
+		ours, there := r.entries[e.Device]
+		if there && !supersedes(e, ours) {
+			continue
+		}
+
+		if e.Revoked != 0 && (!there || ours.Revoked == 0) {
+			revoked = append(revoked, e.Device)
+		}
+
+		r.entries[e.Device] = e
+		changed = true
+	}
+
+	return changed, revoked
+}
+
+// whether another device's roster is missing anything in this one
+func (r *roster) ahead(theirs []rosterEntry) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	devices := make(map[string]rosterEntry, len(theirs))
+	for _, e := range theirs {
+		devices[e.Device] = e
+	}
+
+	for device, ours := range r.entries {
+		e, there := devices[device]
+		if !there || supersedes(ours, e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *roster) encode() ([]byte, error) {
+	return cbor.Marshal(r.list())
+}
+
+func decodeRoster(b []byte) ([]rosterEntry, error) {
+	var entries []rosterEntry
+	err := cbor.Unmarshal(b, &entries)
+	return entries, err
+}
+
+// load the roster from the store, signing any devices saved before the roster was signed
+func (r *roster) load(db store.Store, key ed25519.PrivateKey, self string) error {
+	bytes, err := db.Get(DEVICESKEY)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+
+	if err == nil {
+		entries, err := decodeRoster(bytes)
+		if err == nil {
+			r.merge(entries, key.Public().(ed25519.PublicKey))
+		} else {
+			var devices []string
+			if err := cbor.Unmarshal(bytes, &devices); err != nil {
+				return err
+			}
+			for _, device := range devices {
+				r.add(device, self, key)
+			}
+		}
+	}
+
+	r.add(self, self, key)
+
+	return saveRoster(db, r)
+}
+
+func saveRoster(db store.Store, r *roster) error {
+	bytes, err := r.encode()
+	if err != nil {
+		return err
+	}
+	return db.Put([]string{DEVICESKEY}, bytes)
+}
+
+func (n *node) sendRoster(r *roster) {
+	bytes, err := r.encode()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	n.send(n.discoveryKey, &msg.Message{
+		Slate: "setup",
+		Kind:  "roster",
+		Sent:  msg.Timestamp(),
+		Content: map[string]any{
+			"roster": bytes,
+		},
+	})
+}
+
+func (core *Core) handleRoster(m *msg.Message) {
+	field, there := m.Content["roster"]
+	if !there {
+		log.Debug("missing roster field")
+		return
+	}
+	bytes, ok := field.([]byte)
+	if !ok {
+		log.Debug("bad roster field")
+		return
+	}
+
+	theirs, err := decodeRoster(bytes)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	host := core.getHost()
+
+	changed, revoked := core.roster.merge(theirs, host.signKey.Public().(ed25519.PublicKey))
+
+	if changed {
+		if err := saveRoster(core.store, core.roster); err != nil {
+			log.Error(err)
+		}
+
+		// scripts go with their authors
+		core.activateScripts()
+	}
+
+	self := host.host.ID().String()
+
+	for _, device := range revoked {
+		if device == self {
+			core.revoked()
+			return
+		}
+		host.banish(device)
+	}
+
+	// if they're missing something we have, pass it along
+	if core.roster.ahead(theirs) {
+		host.sendRoster(core.roster)
+	}
+}
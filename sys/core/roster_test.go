@@ -0,0 +1,275 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"slater/core/msg"
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+func TestRosterSigned(t *testing.T) {
+	key, err := deriveSignatureKey("brave-little-otter", "one two three four five six", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+
+	otherKey, err := deriveSignatureKey("brave-little-otter", "one two three four five six", "4321")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRoster()
+	r.add("x", "a", key)
+	if e, _ := r.entry("x"); !e.verify(pub) {
+		t.Fatal("entry not signed")
+	}
+
+	// signed with other credentials
+	theirs := newRoster()
+	theirs.add("y", "a", otherKey)
+	if changed, _ := r.merge(theirs.list(), pub); changed || r.isDevice("y") {
+		t.Fatal("took an entry signed with another key")
+	}
+
+	// changed after it was signed
+	e, _ := r.entry("x")
+	e.Revoked, e.RevokedBy = msg.Timestamp(), "a"
+	if changed, revoked := r.merge([]rosterEntry{e}, pub); changed || len(revoked) != 0 || !r.isDevice("x") {
+		t.Fatal("took a tampered entry")
+	}
+
+	// and every entry is signed again with new credentials
+	r.resign(otherKey)
+	for _, e := range r.list() {
+		if !e.verify(otherKey.Public().(ed25519.PublicKey)) {
+			t.Fatal("not signed again", e.Device)
+		}
+	}
+}
+
+func TestRosterRevocationWins(t *testing.T) {
+	key, err := deriveSignatureKey("brave-little-otter", "one two three four five six", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+
+	ours, theirs := newRoster(), newRoster()
+	ours.add("x", "a", key)
+	theirs.merge(ours.list(), pub)
+
+	if err = ours.revoke("x", "a", key); err != nil {
+		t.Fatal(err)
+	}
+	if ours.add("x", "b", key) || ours.isDevice("x") {
+		t.Fatal("added a revoked device again")
+	}
+
+	// added again later, elsewhere
+	e, _ := theirs.entry("x")
+	e.Added, e.AddedBy = e.Added+1000, "b"
+	e.sign(key)
+	if changed, _ := ours.merge([]rosterEntry{e}, pub); changed || !ours.isRevoked("x") {
+		t.Fatal("a later add undid the revocation")
+	}
+
+	// the revocation gets there, once
+	if changed, revoked := theirs.merge(ours.list(), pub); !changed || len(revoked) != 1 || revoked[0] != "x" {
+		t.Fatal("got", changed, revoked)
+	}
+	if changed, revoked := theirs.merge(ours.list(), pub); changed || len(revoked) != 0 {
+		t.Fatal("merged it twice", changed, revoked)
+	}
+
+	// and of two revocations, the first one wins everywhere
+	later, _ := ours.entry("x")
+	later.Revoked, later.RevokedBy = later.Revoked+1000, "c"
+	later.sign(key)
+	if changed, _ := ours.merge([]rosterEntry{later}, pub); changed {
+		t.Fatal("a later revocation replaced an earlier one")
+	}
+	other := newRoster()
+	other.merge([]rosterEntry{later}, pub)
+	if changed, revoked := other.merge(ours.list(), pub); !changed || len(revoked) != 0 {
+		t.Fatal("the earlier revocation should replace the later one, as no news", changed, revoked)
+	}
+	if e, _ := other.entry("x"); e.RevokedBy != "a" {
+		t.Fatal("revoked by", e.RevokedBy)
+	}
+}
+
+func TestRosterAhead(t *testing.T) {
+	key, err := deriveSignatureKey("brave-little-otter", "one two three four five six", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRoster()
+	r.add("a", "a", key)
+	r.add("x", "a", key)
+
+	same := r.list()
+	if r.ahead(same) {
+		t.Fatal("ahead of the same roster")
+	}
+
+	if !r.ahead(same[:1]) {
+		t.Fatal("not ahead of a roster missing a device")
+	}
+
+	// they know of a revocation we don't: nothing to send them
+	revoked := append([]rosterEntry{}, same...)
+	for i := range revoked {
+		if revoked[i].Device == "x" {
+			revoked[i].Revoked, revoked[i].RevokedBy = msg.Timestamp(), "a"
+		}
+	}
+	if r.ahead(revoked) {
+		t.Fatal("ahead of a roster with a revocation")
+	}
+
+	// we know of one they don't
+	if err = r.revoke("x", "a", key); err != nil {
+		t.Fatal(err)
+	}
+	if !r.ahead(same) {
+		t.Fatal("not ahead with a revocation")
+	}
+}
+
+// the roster comes in from another device, revoking this one
+func TestRevokedByRoster(t *testing.T) {
+	core := testCore(t)
+	host := testNode(t, core)
+	core.host = host
+
+	key := testSignKey(t, core)
+	self := host.host.ID().String()
+	core.roster.add(self, "a", key)
+
+	for _, k := range []string{TOPICKEY, ROTATIONKEY, WANTSKEY, OPERATORSKEY} {
+		if err := core.store.Put([]string{k}, []byte("something")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	detached := false
+	core.operators["topic"] = func() { detached = true }
+
+	theirs := newRoster()
+	theirs.merge(core.roster.list(), key.Public().(ed25519.PublicKey))
+	if err := theirs.revoke(self, "a", key); err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := theirs.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core.handleRoster(&msg.Message{Kind: "roster", Content: map[string]any{"roster": bytes}})
+
+	if !core.roster.isRevoked(self) {
+		t.Fatal("not revoked")
+	}
+
+	saved, err := core.store.Get(DEVICESKEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decodeRoster(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Device == self && e.Revoked == 0 {
+			t.Fatal("revocation not saved")
+		}
+	}
+
+	// it forgets what it synced with
+	for _, k := range []string{TOPICKEY, ROTATIONKEY, WANTSKEY, OPERATORSKEY} {
+		if _, err := core.store.Get(k); !errors.Is(err, store.ErrNotFound) {
+			t.Fatal(k, "is still there", err)
+		}
+	}
+	if !detached || len(core.operators) != 0 {
+		t.Fatal("operators still attached")
+	}
+
+	select {
+	case <-host.done:
+	default:
+		t.Fatal("still online")
+	}
+}
+
+func TestRevokeDevice(t *testing.T) {
+	core := testCore(t)
+	core.host = testNode(t, core)
+
+	// (so the device to revoke is the only other one: testCore's "a" isn't this host)
+	key := testSignKey(t, core)
+	if err := core.roster.revoke("a", "a", key); err != nil {
+		t.Fatal(err)
+	}
+	device := testHost(t).ID().String()
+	core.roster.add(device, "a", key)
+
+	revoke := func(pin string) []string {
+		feed := slate.NewEphemeralSlate("setup")
+		answer(t, feed, map[string]any{
+			"setup:revokeDevice":  float64(0),
+			"setup:revokeDevice?": float64(0),
+			"setup:passphrase":    "one two three four five six",
+			"setup:pin":           pin,
+		})
+
+		said := make([]string, 0)
+		done := make(chan struct{})
+		go func() {
+			revokeDevice(core, feed, func(things ...string) { said = append(said, strings.Join(things, "\n")) })
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("revoking never finished")
+		}
+		return said
+	}
+
+	said := revoke("4321")
+	if core.roster.isRevoked(device) || !strings.Contains(said[len(said)-1], "didn't revoke anything") {
+		t.Fatal("revoked with the wrong credentials", said)
+	}
+
+	said = revoke("1234")
+	if !core.roster.isRevoked(device) {
+		t.Fatal("not revoked", said)
+	}
+
+	saved, err := core.store.Get(DEVICESKEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decodeRoster(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Device == device && (e.Revoked == 0 || !e.verify(key.Public().(ed25519.PublicKey))) {
+			t.Fatal("revocation not saved, or not signed")
+		}
+	}
+
+	// and there's no one left to revoke
+	if said = revoke("1234"); !strings.Contains(said[len(said)-1], "no other devices") {
+		t.Fatal("said", said)
+	}
+}
@@ -0,0 +1,488 @@
+package core
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	_peer "github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/exp/slices"
+
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+//
+// Changing the passphrase and PIN.
+//
+// The data key is rewrapped under a master key from the new credentials (see keyring.go),
+// and the roster is signed again with the new signature key.
+// The new credentials also mean a new discovery topic,
+// so they're handed to each of the other devices over an authenticated stream, which rotates them too.
+// What's handed over (and kept until every device has it) is what the credentials derive to, never the credentials.
+//
+// A device makes the new credentials its own before handing them over, or acking them,
+// so nobody is ever told about credentials which didn't stick.
+//
+// Devices which are offline during a rotation are still on the old topic.
+// Until every device has been handed the new credentials, a rotated device stays on the old topic(s),
+// and hands the new credentials to any device it meets there.
+//
+
+const (
+	ROTATE_PROTOCOL = "/slater/rotate/1.0.0"
+	ROTATE_TIMEOUT  = 30 * time.Second
+
+	ROTATIONKEY = "r"
+)
+
+// what the other devices need from new credentials: the keys derived from them, never the passphrase and PIN themselves
+type handover struct {
+	Keys   netKeys
+	Salt   []byte
+	Master []byte // stretched with Salt (and the threads in it), so every device wraps its data key under the same master key
+}
+
+type oldTopic struct {
+	DiscoveryKey string
+	TopicKey     []byte
+}
+
+// a rotation which hasn't reached every device yet
+type rotation struct {
+	Handover handover
+	Topics   []oldTopic
+	Handed   []string
+}
+
+var errRejoin = errors.New("rotate: could not rejoin with the new credentials")
+
+func rotateCredentials(core *Core, feed slate.Slate, say func(...string)) {
+	if !core.setUp() {
+		say("Let's finish setting up this device first.")
+		return
+	}
+
+	say("First, I need to confirm your current credentials.")
+
+	if !confirmCredentials(core, feed) {
+		say("😬 I could not confirm those credentials, so nothing has changed.")
+		return
+	}
+
+	say("Okay. I'll make you a new passphrase and PIN, and you'll need to write them down again.")
+
+	ready := <-askIfReady(feed)
+	for !ready {
+		wait()
+		ready = <-askIfReadyNow(feed)
+	}
+
+	phrase, newPin := proposeCredentials(feed, say)
+
+	writeDown(feed, say, core.name, phrase, newPin)
+
+	say("Changing your credentials now. Please don't close Slater until I'm done.")
+
+	h, err := newHandover(core.name, phrase, newPin)
+	if err == nil {
+		err = core.rotate(h)
+	}
+
+	if errors.Is(err, errRejoin) {
+		log.Error(err)
+		say("Your credentials were changed, but I couldn't reconnect with them. Please restart Slater, and use the new passphrase and PIN.")
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		say("Hmm, something went wrong, and your credentials weren't changed. Your old passphrase and PIN still work.")
+		return
+	}
+
+	say("Done! From now on, use the new passphrase and PIN.",
+		"Your other devices will get them as soon as they're online.",
+		"Destroy the paper with the old ones once you've checked the new ones work.")
+}
+
+func newHandover(sessionName, phrase, pin string) (handover, error) {
+	keys, err := deriveNetKeys(sessionName, phrase, pin)
+	if err != nil {
+		return handover{}, err
+	}
+
+	salt := newSalt()
+
+	return handover{keys, salt, stretch(salt, sessionName, phrase, pin)}, nil
+}
+
+// whether a handover could be used at all (it's checked before it's acked)
+func (h handover) valid() bool {
+	return len(h.Keys.DiscoveryKey) == 2*blake2b.Size256 &&
+		len(h.Keys.TopicKey) == chacha20poly1305.KeySize &&
+		len(h.Keys.SignSeed) == ed25519.SeedSize &&
+		len(h.Salt) == SALT_SIZE+1 && h.Salt[SALT_SIZE] >= 1 &&
+		len(h.Master) == ARGON_KEYLEN
+}
+
+// change to new credentials (handed says which devices already have them)
+func (core *Core) rotate(h handover, handed ...string) error {
+	rec, err := core.commitRotation(h, handed)
+	if err != nil || rec == nil {
+		return err
+	}
+
+	return core.finishRotation(rec)
+}
+
+// make new credentials this device's own, before anyone else is told about them
+// (the rotation is nil if the device has them already)
+func (core *Core) commitRotation(h handover, handed []string) (*rotation, error) {
+	core.rotating.Lock()
+	defer core.rotating.Unlock()
+
+	signKey := ed25519.NewKeyFromSeed(h.Keys.SignSeed)
+	host := core.getHost()
+	if signKey.Equal(host.signKey) {
+		return nil, nil
+	}
+
+	rec, err := core.loadRotation()
+	if err != nil {
+		return nil, err
+	}
+
+	commitMaster, err := prepareStretchedKey(core.root, core.name, h.Salt, h.Master)
+	if err != nil {
+		return nil, err
+	}
+
+	commitKeyring, err := prepareWrappingKey(core.root, core.name, core.key, PASSWORD_SLOT, string(h.Master))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = commitKeyring(); err != nil {
+		return nil, err
+	}
+
+	// past here, the old credentials are gone, so there's no going back
+	// (and a salt and hash left pending are picked up on the next start, see getMasterKey)
+
+	if err = commitMaster(); err != nil {
+		log.Error(err)
+	}
+
+	rec.Handover = h
+	rec.Topics = append(rec.Topics, oldTopic{host.discoveryKey, host.topicKey})
+	rec.Handed = handed
+
+	core.roster.resign(signKey)
+
+	if err = saveRoster(core.store, core.roster); err != nil {
+		log.Error(err)
+	}
+	if err = core.saveRotation(rec); err != nil {
+		log.Error(err)
+	}
+
+	return rec, nil
+}
+
+// hand the new credentials over to whoever's around, and rejoin with them
+func (core *Core) finishRotation(rec *rotation) error {
+	core.rotating.Lock()
+	core.handOverAll(rec)
+	if err := core.saveRotation(rec); err != nil {
+		log.Error(err)
+	}
+	core.rotating.Unlock()
+
+	if err := core.reconnect(rec.Handover.Keys); err != nil {
+		return fmt.Errorf("%w: %s", errRejoin, err)
+	}
+
+	return nil
+}
+
+// rejoin under the new credentials
+func (core *Core) reconnect(keys netKeys) error {
+	if err := core.getHost().close(); err != nil {
+		log.Debug(err)
+	}
+
+	keyBytes, err := core.store.Get(KEYKEY)
+	if err != nil {
+		return err
+	}
+
+	privKey, err := crypto.UnmarshalPrivateKey(keyBytes)
+	if err != nil {
+		return err
+	}
+
+	node, err := startNet(privKey, core.store)
+	if err != nil {
+		return err
+	}
+
+	if err = connectWith(core, core.store, node, core.name, keys); err != nil {
+		return err
+	}
+
+	core.lock.Lock()
+	core.host = node
+	core.lock.Unlock()
+
+	core.online()
+
+	return nil
+}
+
+func (core *Core) loadRotation() (*rotation, error) {
+	rec := new(rotation)
+
+	bytes, err := core.store.Get(ROTATIONKEY)
+	if errors.Is(err, store.ErrNotFound) {
+		return rec, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = cbor.Unmarshal(bytes, rec)
+	return rec, err
+}
+
+func (core *Core) saveRotation(rec *rotation) error {
+	bytes, err := cbor.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return core.store.Put([]string{ROTATIONKEY}, bytes)
+}
+
+// whether every device has the new credentials
+func (core *Core) rotationDone(rec *rotation) bool {
+	self := core.getHost().host.ID().String()
+
+	for _, device := range core.roster.devices() {
+		if device != self && !slices.Contains(rec.Handed, device) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hand the new credentials to the devices we're connected to right now
+func (core *Core) handOverAll(rec *rotation) {
+	host := core.getHost()
+	self := host.host.ID().String()
+
+	for _, device := range core.roster.devices() {
+		if device == self || slices.Contains(rec.Handed, device) {
+			continue
+		}
+
+		pid, err := _peer.Decode(device)
+		if err != nil {
+			log.Debug(err)
+			continue
+		}
+
+		if host.host.Network().Connectedness(pid) != network.Connected {
+			continue
+		}
+
+		if err = core.handOver(pid, rec); err != nil {
+			log.Debugf("could not hand credentials to %s: %s", device, err)
+			continue
+		}
+
+		rec.Handed = append(rec.Handed, device)
+	}
+}
+
+func (core *Core) handOver(pid _peer.ID, rec *rotation) error {
+	host := core.getHost()
+
+	ctx, cancel := context.WithTimeout(host.ctx, ROTATE_TIMEOUT)
+	defer cancel()
+
+	stream, err := host.host.NewStream(ctx, pid, ROTATE_PROTOCOL)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(ROTATE_TIMEOUT))
+
+	if err = cbor.NewEncoder(stream).Encode(rec.Handover); err != nil {
+		stream.Reset()
+		return err
+	}
+	if err = stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return err
+	}
+
+	var ack bool
+	if err = cbor.NewDecoder(stream).Decode(&ack); err != nil {
+		return err
+	}
+	if !ack {
+		return errors.New("credentials refused")
+	}
+
+	return nil
+}
+
+func (core *Core) handleRotateStream(stream network.Stream) {
+	defer stream.Close()
+
+	remote := stream.Conn().RemotePeer().String()
+	if !core.roster.isDevice(remote) {
+		log.Debugf("rotate stream from unknown peer %s", remote)
+		stream.Reset()
+		return
+	}
+
+	stream.SetDeadline(time.Now().Add(ROTATE_TIMEOUT))
+
+	var h handover
+	if err := cbor.NewDecoder(stream).Decode(&h); err != nil {
+		log.Debug(err)
+		stream.Reset()
+		return
+	}
+
+	if !h.valid() {
+		log.Debugf("invalid credentials from %s", remote)
+		stream.Reset()
+		return
+	}
+
+	// only ack what's committed here, so the other device doesn't count this one as done when it isn't
+	rec, err := core.commitRotation(h, []string{remote})
+	if err != nil {
+		log.Error(err)
+		cbor.NewEncoder(stream).Encode(false)
+		return
+	}
+
+	if err := cbor.NewEncoder(stream).Encode(true); err != nil {
+		log.Debug(err)
+		stream.Reset()
+		// (committed anyway: it'll be handed over again, and seen as already done)
+	}
+
+	if rec != nil {
+		go core.rotated(remote, rec)
+	}
+}
+
+// another device changed the credentials (and they're changed here already)
+func (core *Core) rotated(from string, rec *rotation) {
+	core.announce("Your passphrase and PIN were changed on device `"+from+"`.",
+		"They're changed here too. Use the new ones from now on.")
+
+	if err := core.finishRotation(rec); err != nil {
+		log.Error(err)
+		core.announce("Hmm, I couldn't reconnect with them. Please restart Slater.")
+	}
+}
+
+// stay on the topics from before a rotation, until every device has the new credentials
+func (core *Core) relayOldTopics() {
+	rec, err := core.loadRotation()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if len(rec.Topics) == 0 {
+		return
+	}
+
+	if core.rotationDone(rec) {
+		if err = core.store.Delete(ROTATIONKEY); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	host := core.getHost()
+	self := host.host.ID().String()
+
+	for _, t := range rec.Topics {
+		if err := host.addTopicKey(t.DiscoveryKey, TOPIC_KEY_VERSION, t.TopicKey); err != nil {
+			log.Error(err)
+			continue
+		}
+
+		host.join(t.DiscoveryKey, func(ctx context.Context, pid _peer.ID, pmsg *pubsub.Message) pubsub.ValidationResult {
+			p := pid.String()
+
+			if p == self {
+				return pubsub.ValidationAccept
+			}
+
+			// nothing said on an old topic is worth hearing, except who's still there
+			if core.roster.isDevice(p) {
+				go core.handOverPending(pid)
+				return pubsub.ValidationIgnore
+			}
+
+			return pubsub.ValidationReject
+		})
+	}
+}
+
+// hand the new credentials to a device found on an old topic
+func (core *Core) handOverPending(pid _peer.ID) {
+	core.rotating.Lock()
+	defer core.rotating.Unlock()
+
+	rec, err := core.loadRotation()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	device := pid.String()
+	if len(rec.Topics) == 0 || !rec.Handover.valid() || slices.Contains(rec.Handed, device) {
+		return
+	}
+
+	if err = core.handOver(pid, rec); err != nil {
+		log.Debugf("could not hand credentials to %s: %s", device, err)
+		return
+	}
+
+	rec.Handed = append(rec.Handed, device)
+
+	if !core.rotationDone(rec) {
+		if err = core.saveRotation(rec); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	if err = core.store.Delete(ROTATIONKEY); err != nil {
+		log.Error(err)
+	}
+
+	host := core.getHost()
+	for _, t := range rec.Topics {
+		host.leave(t.DiscoveryKey)
+	}
+}
@@ -0,0 +1,92 @@
+package script
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Drafts, scripts written from what an operator said (see core/drafts.go).
+//
+// Given the messages an operator answered (all of one kind and event) and what they answered,
+// a draft says the same thing again on messages like them: always the same reply, if that's all they ever said,
+// or else the reply they gave most often to each body (lowercased, with its spaces squashed):
+//
+//	text := import("text")
+//
+//	answers := {
+//		"hi": "hello!",
+//		"what time is it?": "time to get a watch"
+//	}
+//
+//	if msg.kind == "text" && msg.event == "" {
+//		body := is_string(msg.body) ? text.join(text.fields(text.to_lower(msg.body)), " ") : ""
+//		answer := answers[body]
+//		if answer != undefined {
+//			reply(answer)
+//		}
+//	}
+//
+
+type Pair struct {
+	In  string
+	Out string
+}
+
+// the body a draft goes by
+func Normal(body string) string {
+	return strings.Join(strings.Fields(strings.ToLower(body)), " ")
+}
+
+func Draft(kind, event string, pairs []Pair) string {
+	outs := make(map[string]bool)
+	counts := make(map[string]map[string]int) // in -> out -> times
+
+	for _, p := range pairs {
+		outs[p.Out] = true
+
+		in := Normal(p.In)
+		if counts[in] == nil {
+			counts[in] = make(map[string]int)
+		}
+		counts[in][p.Out]++
+	}
+
+	guard := fmt.Sprintf("msg.kind == %s && msg.event == %s", strconv.Quote(kind), strconv.Quote(event))
+
+	if len(outs) == 1 {
+		for out := range outs {
+			return fmt.Sprintf("if %s {\n\treply(%s)\n}\n", guard, strconv.Quote(out))
+		}
+	}
+
+	ins := make([]string, 0, len(counts))
+	for in := range counts {
+		ins = append(ins, in)
+	}
+	sort.Strings(ins)
+
+	entries := make([]string, 0, len(ins))
+	for _, in := range ins {
+		// the most common answer (the first of those, alphabetically, so drafts don't change for nothing)
+		best, most := "", 0
+		for out, n := range counts[in] {
+			if n > most || (n == most && out < best) {
+				best, most = out, n
+			}
+		}
+		entries = append(entries, fmt.Sprintf("\t%s: %s", strconv.Quote(in), strconv.Quote(best)))
+	}
+
+	// (tengo won't have a comma after the last one)
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "text := import(\"text\")\n\nanswers := {\n%s\n}\n\n", strings.Join(entries, ",\n"))
+	fmt.Fprintf(b, "if %s {\n", guard)
+	b.WriteString("\tbody := is_string(msg.body) ? text.join(text.fields(text.to_lower(msg.body)), \" \") : \"\"\n")
+	b.WriteString("\tanswer := answers[body]\n")
+	b.WriteString("\tif answer != undefined {\n\t\treply(answer)\n\t}\n}\n")
+
+	return b.String()
+}
@@ -0,0 +1,57 @@
+package script
+
+import (
+	"testing"
+
+	"slater/core/msg"
+)
+
+func TestDraft(t *testing.T) {
+	for name, c := range map[string]struct {
+		pairs    []Pair
+		in       string
+		expected string
+	}{
+		"same": {
+			[]Pair{{"hi", "hello \"you\""}, {"hey", "hello \"you\""}},
+			"anything",
+			"hello \"you\"",
+		},
+		"table": {
+			[]Pair{{"Hi  there", "hello"}, {"time?", "late"}, {"hi there", "hello"}, {"hi there", "yo"}},
+			"HI THERE",
+			"hello",
+		},
+		"unknown": {
+			[]Pair{{"hi", "hello"}, {"bye", "ciao"}},
+			"what?",
+			"",
+		},
+	} {
+		s, err := Compile("draft", []byte(Draft("text", "", c.pairs)))
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", name, err, Draft("text", "", c.pairs))
+		}
+
+		replies, err := s.Run(&msg.Message{Kind: "text", Content: map[string]any{"body": c.in}})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		got := ""
+		if len(replies) == 1 {
+			got, _ = replies[0].Content["body"].(string)
+		}
+		if len(replies) > 1 || got != c.expected {
+			t.Fatalf("%s: got %v, expected %q", name, replies, c.expected)
+		}
+
+		// not on other events, or messages without a body
+		if replies, err = s.Run(&msg.Message{Kind: "text", Event: "setup:pin", Content: map[string]any{"body": c.in}}); err != nil || len(replies) != 0 {
+			t.Fatalf("%s: %v, %v on another event", name, replies, err)
+		}
+		if _, err = s.Run(&msg.Message{Kind: "text", Content: map[string]any{}}); err != nil {
+			t.Fatalf("%s: %s without a body", name, err)
+		}
+	}
+}
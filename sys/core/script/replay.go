@@ -0,0 +1,209 @@
+package script
+
+import (
+	"fmt"
+	"strings"
+
+	"slater/core/msg"
+	"slater/core/slate"
+)
+
+//
+// Replays, to see how a script would have done on a slate, had it been there all along.
+//
+// The last REPLAY messages of the slate go through the script, one after another, like they would have live
+// (on the messages it listens to, but not on scripts, or their replies), and what it says goes on a scratch slate,
+// never on the real one. Errors go on the scratch slate too, like they would have.
+//
+// Then what the script would have said is compared to what a script by that name did say on the slate,
+// one line per message, as a diff:
+//
+//	  text: hi ada      (said both times)
+//	- text: hi bob      (said, but wouldn't have been)
+//	+ text: hello bob   (would have been said)
+//
+// Replays run on every message of the slate, whichever device it's from,
+// since live, every device runs the script on its own messages.
+//
+
+const (
+	REPLAY     = 1000 // messages replayed, at most
+	BATCH      = 256  // messages read at once
+	DIFF_LINES = 1000 // lines compared on each side, at most (the latest ones)
+
+	KIND  = "script"       // on the messages keeping scripts (see core/scripts.go)
+	ERROR = "script:error" // on errors, naming the script they're from
+)
+
+type Replay struct {
+	Runs    int
+	Errors  int
+	Scratch *slate.EphemeralSlate
+	Diff    []string
+}
+
+// replay the end of a slate through the script (listening to on)
+func (s *Script) Replay(on string, from slate.Slate) (*Replay, error) {
+	if on == "" {
+		on = slate.ALL
+	}
+
+	r := &Replay{Scratch: slate.NewEphemeralSlate(from.Name())}
+
+	count := int(from.Count())
+	start := 0
+	if count > REPLAY {
+		start = count - REPLAY
+	}
+
+	said := make([]string, 0)
+
+	for i := start; i < count; i += BATCH {
+		end := i + BATCH
+		if end > count {
+			end = count
+		}
+
+		msgs, err := from.GetRange(i, end-1)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range msgs {
+			if FromScript(m) {
+				if m.Content[FIELD] == s.Name {
+					said = append(said, line(m))
+				}
+				continue
+			}
+			if m.Kind == KIND || !listens(on, m) {
+				continue
+			}
+
+			r.Runs++
+
+			replies, err := s.Run(m)
+			if err != nil {
+				r.Errors++
+				replies = []*msg.Message{Error(s.Name, m.Slate, err)}
+			}
+
+			for _, reply := range replies {
+				r.Scratch.Write(reply)
+			}
+		}
+	}
+
+	r.Scratch.Lock.RLock()
+	would := make([]string, 0, len(r.Scratch.Log))
+	for _, m := range r.Scratch.Log {
+		would = append(would, line(m))
+	}
+	r.Scratch.Lock.RUnlock()
+
+	r.Diff = diff(said, would)
+
+	return r, nil
+}
+
+// the error message for a failed run
+func Error(name, slateName string, err error) *msg.Message {
+	return &msg.Message{
+		Slate: slateName,
+		User:  "system",
+		Kind:  ERROR,
+		Sent:  msg.Timestamp(),
+		Content: map[string]any{
+			"body": fmt.Sprintf("%s: %s", name, err),
+			FIELD:  name,
+		},
+	}
+}
+
+// like the emitter: on the kind, the event, or everything
+func listens(on string, m *msg.Message) bool {
+	return on == slate.ALL || on == m.Kind || (m.Event != "" && on == m.Event)
+}
+
+func line(m *msg.Message) string {
+	if body, there := m.Content["body"]; there {
+		return fmt.Sprintf("%s: %v", m.Kind, body)
+	}
+	return m.Kind
+}
+
+// a line diff, from a to b (longest common subsequence, once the common ends are out of the way)
+func diff(a, b []string) []string {
+	out := make([]string, 0)
+
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		out = append(out, "  "+a[head])
+		head++
+	}
+
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+
+	middleA, middleB := a[head:len(a)-tail], b[head:len(b)-tail]
+	if len(middleA) > DIFF_LINES || len(middleB) > DIFF_LINES {
+		out = append(out, "  …")
+	}
+	if len(middleA) > DIFF_LINES {
+		middleA = middleA[len(middleA)-DIFF_LINES:]
+	}
+	if len(middleB) > DIFF_LINES {
+		middleB = middleB[len(middleB)-DIFF_LINES:]
+	}
+
+	// lcs[i][j]: longest common subsequence of middleA[i:] and middleB[j:]
+	lcs := make([][]int32, len(middleA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(middleB)+1)
+	}
+	for i := len(middleA) - 1; i >= 0; i-- {
+		for j := len(middleB) - 1; j >= 0; j-- {
+			if middleA[i] == middleB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(middleA) || j < len(middleB) {
+		switch {
+		case i < len(middleA) && j < len(middleB) && middleA[i] == middleB[j]:
+			out = append(out, "  "+middleA[i])
+			i++
+			j++
+		case j == len(middleB) || (i < len(middleA) && lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "- "+middleA[i])
+			i++
+		default:
+			out = append(out, "+ "+middleB[j])
+			j++
+		}
+	}
+
+	for _, l := range a[len(a)-tail:] {
+		out = append(out, "  "+l)
+	}
+
+	return out
+}
+
+// whether a diff has any changes in it
+func Changed(diff []string) bool {
+	for _, l := range diff {
+		if strings.HasPrefix(l, "- ") || strings.HasPrefix(l, "+ ") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package script
+
+import (
+	"testing"
+
+	"slater/core/msg"
+	"slater/core/slate"
+)
+
+func TestReplay(t *testing.T) {
+	history := slate.NewEphemeralSlate("chat")
+
+	for _, m := range []*msg.Message{
+		{Kind: "text", Content: map[string]any{"body": "ada"}},
+		{User: "hi", Kind: "text", Content: map[string]any{"body": "hi ada", FIELD: "hi"}},
+		{Kind: "text", Content: map[string]any{"body": "bob"}},
+		{User: "hi", Kind: "text", Content: map[string]any{"body": "hi bob", FIELD: "hi"}},
+		{Kind: "image", Content: map[string]any{"body": "cat.png"}},
+		{Kind: "text", Content: map[string]any{"body": "cy"}},
+	} {
+		history.Write(m)
+	}
+
+	s, err := Compile("hi", []byte(`
+if msg.body == "bob" { reply("hello bob") } else { reply("hi " + msg.body) }
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Replay("text", history)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Runs != 3 || r.Errors != 0 {
+		t.Fatalf("%d runs, %d errors", r.Runs, r.Errors)
+	}
+	if history.Count() != 6 || len(r.Scratch.Log) != 3 {
+		t.Fatalf("%d on the slate, %d on the scratch slate", history.Count(), len(r.Scratch.Log))
+	}
+
+	expected := []string{"  text: hi ada", "- text: hi bob", "+ text: hello bob", "+ text: hi cy"}
+	if len(r.Diff) != len(expected) {
+		t.Fatalf("got %q", r.Diff)
+	}
+	for i := range expected {
+		if r.Diff[i] != expected[i] {
+			t.Fatalf("got %q", r.Diff)
+		}
+	}
+	if !Changed(r.Diff) || Changed(r.Diff[:1]) {
+		t.Fatal("changed, or not")
+	}
+}
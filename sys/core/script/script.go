@@ -0,0 +1,238 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/d5/tengo/v2"
+	"github.com/d5/tengo/v2/stdlib"
+
+	"slater/core/msg"
+)
+
+//
+// Scripts are bits of Tengo code sprinkled onto slates (https://github.com/d5/tengo).
+//
+// A script runs once for every message it listens to, with the message in `msg`,
+// flat like on the bridge (its content right alongside slate, kind, event, author, sent and device),
+// and says things back with `reply`, either some text or a message of its own:
+//
+//	text := import("text")
+//	rand := import("rand")
+//
+//	if msg.kind == "text" && text.has_prefix(msg.body, "!roll") {
+//		reply("🎲 " + (rand.intn(6) + 1))
+//	}
+//
+//	reply({kind: "web", body: "https://example.com", title: "example"})
+//
+// Every run is cut short after TIMEOUT, or ALLOCS objects, and strings and bytes go up to MAX_LEN,
+// so a run never makes more than BUDGET bytes of them (and messages with longer strings aren't run at all).
+// A script runs RUNS at a time,
+// and a run which has to wait longer than WAIT for its turn isn't run at all.
+// Scripts import what they need from the standard library, except os (there's no way out of the slate),
+// and their replies are only written once the run has finished.
+//
+
+const (
+	TIMEOUT     = 250 * time.Millisecond
+	WAIT        = 2 * TIMEOUT
+	RUNS        = 1
+	BUDGET      = 64 << 20 // bytes
+	ALLOCS      = 8_192
+	MAX_LEN     = BUDGET / ALLOCS
+	CONSTS      = 10_000
+	MAX_REPLIES = 16
+
+	FIELD = "script" // on replies, naming the script they're from
+)
+
+// what a script may import
+var modules = []string{"math", "text", "times", "rand", "fmt", "json", "base64", "hex", "enum"}
+
+var (
+	errTooManyReplies = fmt.Errorf("script: more than %d replies", MAX_REPLIES)
+	errBusy           = fmt.Errorf("script: still busy after %s", WAIT)
+)
+
+func init() {
+	tengo.MaxStringLen = MAX_LEN
+	tengo.MaxBytesLen = MAX_LEN
+}
+
+type Script struct {
+	Name     string
+	compiled *tengo.Compiled
+	runs     chan struct{}
+}
+
+func Compile(name string, source []byte) (*Script, error) {
+	s := tengo.NewScript(source)
+	s.SetImports(stdlib.GetModuleMap(modules...))
+	s.SetMaxAllocs(ALLOCS)
+	s.SetMaxConstObjects(CONSTS)
+
+	if err := s.Add("msg", map[string]any{}); err != nil {
+		return nil, err
+	}
+	if err := s.Add("reply", &tengo.UserFunction{Name: "reply"}); err != nil {
+		return nil, err
+	}
+
+	compiled, err := s.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Script{name, compiled, make(chan struct{}, RUNS)}, nil
+}
+
+// run the script on a message, and hand back its replies (unwritten)
+func (s *Script) Run(m *msg.Message) ([]*msg.Message, error) {
+	wait := time.NewTimer(WAIT)
+	defer wait.Stop()
+
+	select {
+	case s.runs <- struct{}{}:
+		defer func() { <-s.runs }()
+	case <-wait.C:
+		return nil, errBusy
+	}
+
+	run := s.compiled.Clone()
+
+	replies := make([]*msg.Message, 0)
+
+	reply := &tengo.UserFunction{Name: "reply", Value: func(args ...tengo.Object) (tengo.Object, error) {
+		if len(args) != 1 {
+			return nil, tengo.ErrWrongNumArguments
+		}
+		if len(replies) == MAX_REPLIES {
+			return nil, errTooManyReplies
+		}
+
+		r, err := s.reply(m, args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		replies = append(replies, r)
+		return tengo.UndefinedValue, nil
+	}}
+
+	if err := run.Set("msg", flatten(m)); err != nil {
+		if errors.Is(err, tengo.ErrStringLimit) || errors.Is(err, tengo.ErrBytesLimit) {
+			return nil, nil // too big to hand to a script
+		}
+		return nil, err
+	}
+	if err := run.Set("reply", reply); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+
+	if err := run.RunContext(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("script: ran for more than %s", TIMEOUT)
+		}
+		return nil, err
+	}
+
+	return replies, nil
+}
+
+func (s *Script) reply(m *msg.Message, arg tengo.Object) (*msg.Message, error) {
+	r := &msg.Message{
+		Slate: m.Slate,
+		User:  s.Name,
+		Kind:  "text",
+		Sent:  msg.Timestamp(),
+	}
+
+	switch arg := arg.(type) {
+	case *tengo.String:
+		r.Content = map[string]any{"body": arg.Value}
+
+	case *tengo.Map, *tengo.ImmutableMap:
+		content, ok := tengo.ToInterface(arg).(map[string]any)
+		if !ok {
+			return nil, tengo.ErrInvalidArgumentType{Name: "first", Expected: "string or map", Found: arg.TypeName()}
+		}
+		if kind, ok := content["kind"].(string); ok && kind != "" {
+			r.Kind = kind
+		}
+		if event, ok := content["event"].(string); ok {
+			r.Event = event
+		}
+		for _, field := range []string{"slate", "kind", "event", "author", "sent", "device"} {
+			delete(content, field)
+		}
+		r.Content = content
+
+	default:
+		return nil, tengo.ErrInvalidArgumentType{Name: "first", Expected: "string or map", Found: arg.TypeName()}
+	}
+
+	r.Content[FIELD] = s.Name
+
+	return r, nil
+}
+
+// whether a message is a script's reply (scripts don't hear each other, or they could talk forever)
+func FromScript(m *msg.Message) bool {
+	_, there := m.Content[FIELD]
+	return there
+}
+
+func flatten(m *msg.Message) map[string]any {
+	flat := make(map[string]any, len(m.Content)+6)
+	for k, v := range m.Content {
+		flat[k] = plain(v)
+	}
+
+	flat["slate"] = m.Slate
+	flat["kind"] = m.Kind
+	flat["event"] = m.Event
+	flat["author"] = m.User
+	flat["sent"] = m.Sent
+	flat["device"] = m.Device
+
+	return flat
+}
+
+// content comes out of CBOR with types tengo doesn't take
+func plain(v any) any {
+	switch v := v.(type) {
+	case uint64:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, vv := range v {
+			m[fmt.Sprint(k)] = plain(vv)
+		}
+		return m
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, vv := range v {
+			m[k] = plain(vv)
+		}
+		return m
+	case []any:
+		l := make([]any, len(v))
+		for i, vv := range v {
+			l[i] = plain(vv)
+		}
+		return l
+	}
+	return v
+}
@@ -0,0 +1,79 @@
+package script
+
+import (
+	"strings"
+	"testing"
+
+	"slater/core/msg"
+)
+
+func TestScript(t *testing.T) {
+	s, err := Compile("echo", []byte(`
+text := import("text")
+
+if msg.kind == "text" && text.has_prefix(msg.body, "!echo ") {
+	reply(text.trim_prefix(msg.body, "!echo "))
+	reply({kind: "web", body: "https://example.com", count: msg.count + 1})
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &msg.Message{Slate: "chat", User: "ada", Kind: "text", Content: map[string]any{"body": "!echo hi", "count": uint64(1)}}
+
+	replies, err := s.Run(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 {
+		t.Fatalf("got %d replies", len(replies))
+	}
+	if r := replies[0]; r.Slate != "chat" || r.User != "echo" || r.Kind != "text" || r.Content["body"] != "hi" || !FromScript(r) {
+		t.Fatalf("bad reply: %+v", r)
+	}
+	if r := replies[1]; r.Kind != "web" || r.Content["count"] != int64(2) {
+		t.Fatalf("bad reply: %+v", r)
+	}
+	if _, there := replies[1].Content["kind"]; there {
+		t.Fatal("kind left in content")
+	}
+
+	// runs don't see each other
+	m.Content["body"] = "nothing to say"
+	if replies, err = s.Run(m); err != nil || len(replies) != 0 {
+		t.Fatalf("got %v, %v", replies, err)
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	m := &msg.Message{Slate: "chat", Kind: "text", Content: map[string]any{"body": "hi"}}
+
+	for name, source := range map[string]string{
+		"timeout": `for {}`,
+		"allocs":  `a := []; for { a = append(a, {}) }`,
+		"length":  `s := "x"; for { s += s }`,
+		"replies": `for { reply("again") }`,
+	} {
+		s, err := Compile(name, []byte(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.Run(m); err == nil {
+			t.Fatalf("%s: ran without a limit", name)
+		}
+	}
+
+	s, err := Compile("long", []byte(`reply("too long for me")`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := &msg.Message{Slate: "chat", Kind: "text", Content: map[string]any{"body": strings.Repeat("x", MAX_LEN+1)}}
+	if replies, err := s.Run(long); err != nil || len(replies) != 0 {
+		t.Fatalf("ran on a message over the limit: %v, %v", replies, err)
+	}
+
+	if _, err := Compile("os", []byte(`os := import("os")`)); err == nil || !strings.Contains(err.Error(), "os") {
+		t.Fatalf("imported os: %v", err)
+	}
+}
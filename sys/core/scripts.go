@@ -0,0 +1,535 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	ds "github.com/ipfs/go-datastore"
+
+	"slater/core/msg"
+	"slater/core/script"
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+//
+// Scripts on slates (see script/script.go).
+//
+// A script is kept on the slate it's attached to, as script messages, one for every version,
+// so it replicates to the other devices like any other message, and its history is right there on the slate.
+// The latest version on the slate is the one that runs (or doesn't, if it's been detached).
+// The interface edits scripts with messages on the slate:
+//
+//	script:attach    name, on (a kind, an event, or * for every message), source    a new version
+//	script:detach    name                                                           a new version, which doesn't run
+//	script:rollback  name, version                                                  that version again, as a new one
+//	script:replay    name, and on and source for a draft                            a dry run (see script/replay.go)
+//
+// A replay doesn't change anything: it just tells the interface how the script (or a draft of it) would have done,
+// as a script:replay message on the slate, which isn't written on it.
+//
+// A device only runs a script whose latest version was written by a device on the roster,
+// so a script saved from a device that's since been revoked (or rotated away) stops until it's saved again.
+//
+// Each device runs its scripts on the messages written on it, so one script doesn't answer several times,
+// and scripts don't hear scripts (their own replies included).
+// When one fails, the error goes on the slate, as a script:error message.
+//
+// Every device keeps an index of the versions it's seen, so it can start the scripts without reading every slate,
+// one record per script, under /x/<slate>/<name>. It only says which message each version is:
+// the source stays on the slate, and is read from there when it's needed.
+//
+
+const (
+	SCRIPT_KIND   = script.KIND
+	SCRIPT_ERROR  = script.ERROR
+	SCRIPT_REPLAY = "script:replay"
+	SCRIPTSKEY    = "x" // also the single record every script used to share (see migrateScripts)
+)
+
+var (
+	errBadScript  = errors.New("scripts: bad script")
+	errNoVersion  = errors.New("scripts: no such version")
+	errNoScript   = errors.New("scripts: no such script")
+	errNotAllowed = errors.New("scripts: author isn't on the roster")
+)
+
+// one version of a script, as written on its slate
+type scriptVersion struct {
+	Slate   string
+	Name    string
+	Version int
+	On      string
+	Source  string `cbor:"-"` // on the slate, not in the index (see scriptSource)
+	Active  bool
+	Device  string
+	Stamp   msg.Stamp
+	Seq     uint64
+}
+
+func (core *Core) handleScriptCommand(m *msg.Message) {
+	name, _ := m.Content["name"].(string)
+	name = strings.TrimSpace(name)
+
+	if core.store.Store == nil || name == "" || strings.Contains(name, "/") || len(core.viewSlates(m.Slate)) == 0 {
+		log.Debugf("discarded %s", m.Kind)
+		return
+	}
+
+	core.editScript(name, m)
+}
+
+// a new version of a script (or a replay of it), as the message says
+func (core *Core) editScript(name string, m *msg.Message) {
+	s, err := core.openSlate(m.Slate)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	versions, err := core.scriptVersions(s.Name(), name)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	next := scriptVersion{Name: name, Version: 1, On: slate.ALL, Active: true}
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		if next.Source, err = scriptSource(s, latest); err != nil {
+			core.scriptError(s, name, err)
+			return
+		}
+		next.On = latest.On
+		for _, v := range versions {
+			if v.Version >= next.Version {
+				next.Version = v.Version + 1
+			}
+		}
+	}
+
+	switch m.Kind {
+	case SCRIPT_REPLAY:
+		core.replayScript(s, name, m, next.On, next.Source, len(versions) > 0)
+		return
+
+	case "script:attach":
+		source, ok := m.Content["source"].(string)
+		if !ok {
+			core.scriptError(s, name, errBadScript)
+			return
+		}
+		if on, ok := m.Content["on"].(string); ok && on != "" {
+			next.On = on
+		}
+		next.Source = source
+
+		// don't save what won't run
+		if _, err = script.Compile(name, []byte(source)); err != nil {
+			core.scriptError(s, name, err)
+			return
+		}
+
+	case "script:detach":
+		if len(versions) == 0 {
+			core.scriptError(s, name, errNoScript)
+			return
+		}
+		next.Active = false
+
+	case "script:rollback":
+		wanted, _ := m.Content["version"].(float64)
+
+		found := false
+		for _, v := range versions {
+			if v.Version == int(wanted) {
+				next.On, found = v.On, true
+				if next.Source, err = scriptSource(s, v); err != nil {
+					core.scriptError(s, name, err)
+					return
+				}
+			}
+		}
+		if !found {
+			core.scriptError(s, name, errNoVersion)
+			return
+		}
+	}
+
+	body := fmt.Sprintf("script %s, version %d", name, next.Version)
+	if !next.Active {
+		body += " (detached)"
+	}
+
+	err = s.Write(&msg.Message{
+		User: "system",
+		Kind: SCRIPT_KIND,
+		Sent: msg.Timestamp(),
+		Content: map[string]any{
+			"body":    body,
+			"name":    name,
+			"version": next.Version,
+			"on":      next.On,
+			"source":  next.Source,
+			"active":  next.Active,
+		},
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// a script message, from this device or another one (see openSlate)
+func (core *Core) handleScriptMessage(s *slate.PersistentSlate, m *msg.Message) {
+	v, ok := parseScriptVersion(m)
+	if !ok {
+		log.Debug("bad script message on ", s.Name())
+		return
+	}
+
+	latest, err := core.indexScript(v)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if latest {
+		core.activateScript(s, v)
+	}
+}
+
+func parseScriptVersion(m *msg.Message) (scriptVersion, bool) {
+	v := scriptVersion{Slate: m.Slate, Device: m.Device, Stamp: m.Stamp, Seq: m.Seq}
+
+	var ok bool
+	if v.Name, ok = m.Content["name"].(string); !ok || v.Name == "" {
+		return v, false
+	}
+	if v.On, ok = m.Content["on"].(string); !ok {
+		return v, false
+	}
+	if v.Source, ok = m.Content["source"].(string); !ok {
+		return v, false
+	}
+	if v.Active, ok = m.Content["active"].(bool); !ok {
+		return v, false
+	}
+
+	switch version := m.Content["version"].(type) {
+	case uint64:
+		v.Version = int(version)
+	case int64:
+		v.Version = int(version)
+	case int:
+		v.Version = version
+	default:
+		return v, false
+	}
+
+	return v, true
+}
+
+func (v scriptVersion) before(w scriptVersion) bool {
+	if v.Stamp != w.Stamp {
+		return v.Stamp.Before(w.Stamp)
+	}
+	if v.Device != w.Device {
+		return v.Device < w.Device
+	}
+	return v.Seq < w.Seq
+}
+
+// every version seen of a script, in slate order
+func (core *Core) loadScript(slateName, name string) ([]scriptVersion, error) {
+	versions := make([]scriptVersion, 0)
+
+	bytes, err := core.store.Get(scriptKey(slateName, name).String())
+	if errors.Is(err, store.ErrNotFound) {
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = cbor.Unmarshal(bytes, &versions)
+	return versions, err
+}
+
+func (core *Core) saveScript(slateName, name string, versions []scriptVersion) error {
+	bytes, err := cbor.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	return core.store.Put(scriptKey(slateName, name).Namespaces(), bytes)
+}
+
+func scriptKey(slateName, name string) ds.Key {
+	return ds.KeyWithNamespaces([]string{SCRIPTSKEY, slateName, name})
+}
+
+// the versions of every script
+func (core *Core) loadScripts() ([][]scriptVersion, error) {
+	if err := core.migrateScripts(); err != nil {
+		return nil, err
+	}
+
+	records, err := core.store.Values([]string{SCRIPTSKEY})
+	if err != nil {
+		return nil, err
+	}
+
+	index := make([][]scriptVersion, 0, len(records))
+	for _, bytes := range records {
+		var versions []scriptVersion
+		if err = cbor.Unmarshal(bytes, &versions); err != nil {
+			return nil, err
+		}
+		index = append(index, versions)
+	}
+
+	return index, nil
+}
+
+// split the single record, slate/name -> versions, which every script used to share
+func (core *Core) migrateScripts() error {
+	bytes, err := core.store.Get(SCRIPTSKEY)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	old := make(map[string][]scriptVersion)
+	if err = cbor.Unmarshal(bytes, &old); err != nil {
+		return err
+	}
+
+	for _, versions := range old {
+		if len(versions) == 0 {
+			continue
+		}
+		if err = core.saveScript(versions[0].Slate, versions[0].Name, versions); err != nil {
+			return err
+		}
+	}
+
+	return core.store.Delete(SCRIPTSKEY)
+}
+
+func (core *Core) scriptVersions(slateName, name string) ([]scriptVersion, error) {
+	core.scriptsLock.Lock()
+	defer core.scriptsLock.Unlock()
+
+	return core.loadScript(slateName, name)
+}
+
+// add a version to the index, and say whether it's the latest
+func (core *Core) indexScript(v scriptVersion) (bool, error) {
+	core.scriptsLock.Lock()
+	defer core.scriptsLock.Unlock()
+
+	versions, err := core.loadScript(v.Slate, v.Name)
+	if err != nil {
+		return false, err
+	}
+
+	for _, w := range versions {
+		if w.Device == v.Device && w.Seq == v.Seq {
+			return false, nil // seen it
+		}
+	}
+
+	versions = append(versions, v)
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].before(versions[j])
+	})
+
+	if err = core.saveScript(v.Slate, v.Name, versions); err != nil {
+		return false, err
+	}
+
+	return versions[len(versions)-1] == v, nil
+}
+
+// a version's source, from its message on the slate
+func scriptSource(s *slate.PersistentSlate, v scriptVersion) (string, error) {
+	msgs, err := s.Sublog(v.Device, v.Seq, 1)
+	if err != nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "", errNoVersion
+	}
+
+	w, ok := parseScriptVersion(msgs[0])
+	if !ok || w.Name != v.Name {
+		return "", errBadScript
+	}
+	return w.Source, nil
+}
+
+// start the latest version of every script, or stop it if it's not allowed to run (anymore)
+func (core *Core) activateScripts() {
+	core.scriptsLock.Lock()
+	index, err := core.loadScripts()
+	core.scriptsLock.Unlock()
+
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, versions := range index {
+		if len(versions) == 0 {
+			continue
+		}
+		latest := versions[len(versions)-1]
+
+		s, err := core.openSlate(latest.Slate)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		if latest.Source, err = scriptSource(s, latest); err != nil {
+			log.Debugf("script %s on %s: %s", latest.Name, latest.Slate, err)
+			core.detachScript(latest.Slate, latest.Name)
+			continue
+		}
+
+		core.activateScript(s, latest)
+	}
+}
+
+func (core *Core) activateScript(s *slate.PersistentSlate, v scriptVersion) {
+	core.detachScript(v.Slate, v.Name)
+
+	if !v.Active {
+		return
+	}
+
+	if !core.roster.isDevice(v.Device) {
+		log.Debugf("script %s on %s: %s", v.Name, v.Slate, errNotAllowed)
+		return
+	}
+
+	if err := core.attachScript(s, v.Name, v.On, []byte(v.Source)); err != nil {
+		// only the device which saved it says so, or every device would
+		if v.Device == s.Device {
+			core.scriptError(s, v.Name, err)
+		} else {
+			log.Debugf("script %s on %s: %s", v.Name, v.Slate, err)
+		}
+	}
+}
+
+func (core *Core) attachScript(s *slate.PersistentSlate, name, on string, source []byte) error {
+	if on == "" {
+		on = slate.ALL
+	}
+
+	sc, err := script.Compile(name, source)
+	if err != nil {
+		return err
+	}
+
+	detach := s.On(on, func(m *msg.Message) {
+		if m.Device != s.Device || m.Kind == SCRIPT_KIND || script.FromScript(m) {
+			return
+		}
+		core.runScript(s, sc, m)
+	})
+
+	key := s.Name() + "/" + name
+
+	core.lock.Lock()
+	if old, there := core.scripts[key]; there {
+		old()
+	}
+	core.scripts[key] = detach
+	core.lock.Unlock()
+
+	return nil
+}
+
+func (core *Core) detachScript(slateName, name string) {
+	key := slateName + "/" + name
+
+	core.lock.Lock()
+	defer core.lock.Unlock()
+
+	if detach, there := core.scripts[key]; there {
+		detach()
+		delete(core.scripts, key)
+	}
+}
+
+func (core *Core) runScript(s slate.Slate, sc *script.Script, m *msg.Message) {
+	replies, err := sc.Run(m)
+	if err != nil {
+		core.scriptError(s, sc.Name, err)
+		return
+	}
+
+	for _, r := range replies {
+		if err = s.Write(r); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+func (core *Core) scriptError(s slate.Slate, name string, err error) {
+	log.Debugf("script %s on %s: %s", name, s.Name(), err)
+
+	s.Write(script.Error(name, s.Name(), err))
+}
+
+// a dry run, on the draft in the message, or the latest version (its on and source)
+func (core *Core) replayScript(s *slate.PersistentSlate, name string, m *msg.Message, latestOn, latestSource string, there bool) {
+	on, _ := m.Content["on"].(string)
+	source, draft := m.Content["source"].(string)
+
+	if !draft && there {
+		on, source = latestOn, latestSource
+	}
+
+	replayed := &msg.Message{
+		Slate:   s.Name(),
+		User:    "system",
+		Kind:    SCRIPT_REPLAY,
+		Sent:    msg.Timestamp(),
+		Content: map[string]any{"name": name},
+	}
+
+	r, err := replay(s, name, on, source, draft || there)
+	if err != nil {
+		replayed.Content["body"] = fmt.Sprintf("replay of %s: %s", name, err)
+		replayed.Content["error"] = err.Error()
+	} else {
+		replayed.Content["body"] = fmt.Sprintf("replay of %s, on %d messages, with %d errors:\n```\n%s\n```", name, r.Runs, r.Errors, strings.Join(r.Diff, "\n"))
+		replayed.Content["runs"] = r.Runs
+		replayed.Content["errors"] = r.Errors
+		replayed.Content["changed"] = script.Changed(r.Diff)
+		replayed.Content["diff"] = r.Diff
+	}
+
+	// just to the interface
+	core.toViews(replayed)
+}
+
+func replay(s *slate.PersistentSlate, name, on, source string, there bool) (*script.Replay, error) {
+	if !there {
+		return nil, errNoScript
+	}
+
+	sc, err := script.Compile(name, []byte(source))
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.Replay(on, s)
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"slater/core/msg"
+)
+
+func TestScriptIndex(t *testing.T) {
+	core := testCore(t)
+
+	v := func(version int, wall int64, device string) scriptVersion {
+		return scriptVersion{Slate: "chat", Name: "hi", Version: version, Device: device, Stamp: msg.Stamp{Wall: wall}, Seq: uint64(version)}
+	}
+
+	// as they might come in from several devices
+	for i, c := range []struct {
+		v      scriptVersion
+		latest bool
+	}{
+		{v(1, 20, "b"), true},
+		{v(2, 10, "a"), false},
+		{v(3, 20, "a"), false}, // same stamp, so the device decides
+		{v(4, 30, "a"), true},
+		{v(1, 20, "b"), false}, // seen it
+	} {
+		latest, err := core.indexScript(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest != c.latest {
+			t.Fatalf("%d: got latest %v, expected %v", i, latest, c.latest)
+		}
+	}
+
+	versions, err := core.scriptVersions("chat", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{2, 3, 1, 4}
+	if len(versions) != len(expected) {
+		t.Fatalf("got %d versions, expected %d", len(versions), len(expected))
+	}
+	for i, version := range expected {
+		if versions[i].Version != version {
+			t.Fatalf("version %d at %d, expected %d", versions[i].Version, i, version)
+		}
+	}
+}
+
+func TestScriptEdits(t *testing.T) {
+	core := testCore(t, "chat")
+	s := core.slates["chat"]
+
+	// what an edit wrote on the slate (which is handled like it would be, coming off the slate)
+	edit := func(script, kind string, content map[string]any) *msg.Message {
+		content["name"] = script
+		core.editScript(script, &msg.Message{Slate: "chat", Kind: kind, Content: content})
+
+		last, err := s.GetRange(int(s.Count())-1, int(s.Count())-1)
+		if err != nil || len(last) != 1 {
+			t.Fatalf("%s: %v, %v", kind, last, err)
+		}
+		if last[0].Kind == SCRIPT_KIND {
+			core.handleScriptMessage(s, last[0])
+		}
+		return last[0]
+	}
+
+	attached := func() bool {
+		core.lock.RLock()
+		defer core.lock.RUnlock()
+		_, there := core.scripts["chat/hi"]
+		return there
+	}
+
+	expect := func(m *msg.Message, version int, source string, active bool) {
+		v, ok := parseScriptVersion(m)
+		if !ok || v.Version != version || v.Source != source || v.Active != active {
+			t.Fatalf("got %+v, expected version %d of %q (active: %v)", v, version, source, active)
+		}
+		if attached() != active {
+			t.Fatalf("version %d: attached is %v", version, attached())
+		}
+	}
+
+	expect(edit("hi", "script:attach", map[string]any{"on": "text", "source": "a := 1"}), 1, "a := 1", true)
+	expect(edit("hi", "script:attach", map[string]any{"source": "b := 2"}), 2, "b := 2", true)
+	expect(edit("hi", "script:detach", map[string]any{}), 3, "b := 2", false)
+	expect(edit("hi", "script:rollback", map[string]any{"version": float64(1)}), 4, "a := 1", true)
+
+	for _, c := range []struct {
+		script  string
+		kind    string
+		content map[string]any
+	}{
+		{"hi", "script:rollback", map[string]any{"version": float64(9)}},
+		{"hi", "script:attach", map[string]any{"source": "if {"}},
+		{"nope", "script:detach", map[string]any{}},
+	} {
+		if m := edit(c.script, c.kind, c.content); m.Kind != SCRIPT_ERROR {
+			t.Fatalf("%s %s: got %s, expected an error", c.kind, c.script, m.Kind)
+		}
+	}
+
+	versions, err := core.scriptVersions("chat", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 4 || versions[3].On != "text" || !attached() {
+		t.Fatalf("errors changed the script: %+v", versions)
+	}
+
+	core.detachScript("chat", "hi")
+}
+
+func TestScriptRecords(t *testing.T) {
+	core := testCore(t, "chat")
+	s := core.slates["chat"]
+
+	for _, name := range []string{"hi", "bye"} {
+		core.editScript(name, &msg.Message{Slate: "chat", Kind: "script:attach", Content: map[string]any{"name": name, "source": "secret := 1"}})
+		last, err := s.GetRange(int(s.Count())-1, int(s.Count())-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		core.handleScriptMessage(s, last[0])
+	}
+
+	// a record per script, without the source, which is on the slate
+	for _, name := range []string{"hi", "bye"} {
+		record, err := core.store.Get(scriptKey("chat", name).String())
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if bytes.Contains(record, []byte("secret")) {
+			t.Fatal(name, "has its source in the index")
+		}
+	}
+
+	index, err := core.loadScripts()
+	if err != nil || len(index) != 2 {
+		t.Fatal("expected 2 scripts", index, err)
+	}
+
+	// started again from the index, with the source from the slate
+	core.detachScript("chat", "hi")
+	core.detachScript("chat", "bye")
+	core.activateScripts()
+	core.lock.RLock()
+	attached := len(core.scripts)
+	core.lock.RUnlock()
+	if attached != 2 {
+		t.Fatal("attached", attached)
+	}
+
+	core.detachScript("chat", "hi")
+	core.detachScript("chat", "bye")
+}
+
+func TestScriptRecordsMigrate(t *testing.T) {
+	core := testCore(t)
+
+	old, err := cbor.Marshal(map[string][]scriptVersion{
+		"chat/hi":  {{Slate: "chat", Name: "hi", Version: 1, Device: "a", Seq: 1}},
+		"other/yo": {{Slate: "other", Name: "yo", Version: 1, Device: "a", Seq: 2}, {Slate: "other", Name: "yo", Version: 2, Device: "a", Seq: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = core.store.Put([]string{SCRIPTSKEY}, old); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := core.loadScripts()
+	if err != nil || len(index) != 2 {
+		t.Fatal("expected 2 scripts", index, err)
+	}
+
+	versions, err := core.scriptVersions("other", "yo")
+	if err != nil || len(versions) != 2 || versions[1].Seq != 3 {
+		t.Fatal("got", versions, err)
+	}
+
+	if _, err = core.store.Get(SCRIPTSKEY); err == nil {
+		t.Fatal("the old record is still there")
+	}
+}
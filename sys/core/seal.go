@@ -0,0 +1,93 @@
+package core
+
+import (
+	"crypto/cipher"
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/frand"
+)
+
+//
+// Payloads on the discovery topic are sealed with XChaCha20-Poly1305,
+// so peers which only relay the topic see nothing but ciphertext.
+//
+// A sealed payload is:
+//
+//	[key version: 1 byte][nonce: 24 random bytes][ciphertext]
+//
+// The nonces are random, which is safe with XChaCha's 192 bit nonces.
+// The topic is authenticated along with the payload, so it can't be replayed onto another topic.
+// Keys are versioned, so that a new key can be introduced while older payloads can still be opened.
+//
+
+const TOPIC_KEY_VERSION = 1
+
+var errUnsealed = errors.New("could not open sealed payload")
+
+type sealer struct {
+	version byte
+	keys    map[byte]cipher.AEAD
+	lock    *sync.RWMutex
+}
+
+func newSealer() *sealer {
+	return &sealer{
+		keys: make(map[byte]cipher.AEAD),
+		lock: &sync.RWMutex{},
+	}
+}
+
+// add a key, and seal with it from now on
+func (s *sealer) use(version byte, key []byte) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.keys[version] = aead
+	s.version = version
+	s.lock.Unlock()
+
+	return nil
+}
+
+func (s *sealer) seal(topic string, plain []byte) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	aead, there := s.keys[s.version]
+	if !there {
+		return nil, errors.New("no key to seal with")
+	}
+
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plain)+aead.Overhead())
+	out[0] = s.version
+	copy(out[1:], frand.Bytes(aead.NonceSize()))
+
+	return aead.Seal(out, out[1:1+aead.NonceSize()], plain, []byte(topic)), nil
+}
+
+func (s *sealer) open(topic string, sealed []byte) ([]byte, error) {
+	if len(sealed) < 1 {
+		return nil, errUnsealed
+	}
+
+	s.lock.RLock()
+	aead, there := s.keys[sealed[0]]
+	s.lock.RUnlock()
+
+	if !there || len(sealed) < 1+aead.NonceSize() {
+		return nil, errUnsealed
+	}
+
+	nonce := sealed[1 : 1+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, sealed[1+aead.NonceSize():], []byte(topic))
+	if err != nil {
+		return nil, errUnsealed
+	}
+
+	return plain, nil
+}
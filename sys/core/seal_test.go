@@ -0,0 +1,121 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func testSealer(t *testing.T, version byte, key []byte) *sealer {
+	s := newSealer()
+	if err := s.use(version, key); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSeal(t *testing.T) {
+	key := frand.Bytes(32)
+	s := testSealer(t, TOPIC_KEY_VERSION, key)
+	plain := []byte("hello, other devices")
+
+	sealed, err := s.seal("topic", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Fatal("the plaintext shows")
+	}
+
+	// round trip, and on another device with the same key
+	for _, opener := range []*sealer{s, testSealer(t, TOPIC_KEY_VERSION, key)} {
+		got, err := opener.open("topic", sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatal("got", string(got))
+		}
+	}
+
+	// same plaintext, new nonce
+	again, err := s.seal("topic", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again, sealed) {
+		t.Fatal("sealed the same twice")
+	}
+
+	// every byte is covered: the version, the nonce and the ciphertext
+	for i := range sealed {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 1
+		if _, err = s.open("topic", tampered); !errors.Is(err, errUnsealed) {
+			t.Fatal("opened with byte", i, "tampered")
+		}
+	}
+
+	if _, err = s.open("topic", sealed[:len(sealed)-1]); !errors.Is(err, errUnsealed) {
+		t.Fatal("opened a truncated payload")
+	}
+	if _, err = s.open("topic", nil); !errors.Is(err, errUnsealed) {
+		t.Fatal("opened nothing")
+	}
+
+	// and it can't be replayed onto another topic
+	if _, err = s.open("other", sealed); !errors.Is(err, errUnsealed) {
+		t.Fatal("opened on another topic")
+	}
+}
+
+func TestSealWrongKey(t *testing.T) {
+	s := testSealer(t, TOPIC_KEY_VERSION, frand.Bytes(32))
+
+	sealed, err := s.seal("topic", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = testSealer(t, TOPIC_KEY_VERSION, frand.Bytes(32)).open("topic", sealed); !errors.Is(err, errUnsealed) {
+		t.Fatal("opened with the wrong key")
+	}
+
+	// a newer key seals from then on, but the older one still opens
+	if err = s.use(TOPIC_KEY_VERSION+1, frand.Bytes(32)); err != nil {
+		t.Fatal(err)
+	}
+	newer, err := s.seal("topic", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newer[0] != TOPIC_KEY_VERSION+1 {
+		t.Fatal("sealed with version", newer[0])
+	}
+	if _, err = s.open("topic", sealed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTopicKeyFields(t *testing.T) {
+	a, err := deriveTopicKey("brave-little-otter", "one two", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same characters, split differently between the fields
+	for _, creds := range [][3]string{
+		{"brave-little-otterone", " two", "1234"},
+		{"brave-little-otter", "one two1", "234"},
+	} {
+		b, err := deriveTopicKey(creds[0], creds[1], creds[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(a, b) {
+			t.Fatal("same topic key for", creds)
+		}
+	}
+}
@@ -1,13 +1,119 @@
 package core
 
+import (
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"slater/core/msg"
+	"slater/core/slate"
+)
+
+//
+// A session is a user's view, through the bridge.
+// Several interfaces (clients) may share it, each on its own socket, and each gets everything sent to the session
+// (except pages of history, which go to the client which asked, see view.go).
+//
+// When the last client goes away, the session stops listening to its slates, but keeps its view,
+// so an interface can resume it where it left off (say, after a restart).
+// Sessions which aren't resumed within SESSION_GRACE are dropped.
+// Resuming one after that starts it over, with the layout of the core as it's running (see connect).
+//
+
+const (
+	SESSION_GRACE  = 10 * time.Minute
+	SESSION_EXPIRY = time.Minute // how often to look for expired sessions
+)
+
 type session struct {
-	id   string
-	view view
+	id      string
+	view    view
+	clients []string
+	detach  func()    // stop listening to the setup slate
+	away    time.Time // since the last client went, or zero while there's one connected
 }
 
 func newSession(id string) session {
 	return session{
-		id:   id,
-		view: newView(),
+		id:      id,
+		view:    newView(),
+		clients: make([]string, 0),
+	}
+}
+
+// send the session everything on the setup slate, from now on until its last client goes
+func (core *Core) attach(sid, client string, feed slate.Slate) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+
+	session, there := core.sessions[sid]
+	if !there {
+		return
+	}
+
+	if !slices.Contains(session.clients, client) {
+		session.clients = append(session.clients, client)
+	}
+
+	if session.detach == nil {
+		session.detach = feed.On(slate.ALL, func(m *msg.Message) {
+			core.sendMessage(sid, m)
+		})
+	}
+
+	session.away = time.Time{}
+	core.sessions[sid] = session
+}
+
+func (core *Core) quitSession(sid, client string) {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+
+	session, there := core.sessions[sid]
+	if !there {
+		return
+	}
+
+	if i := slices.Index(session.clients, client); i != -1 {
+		session.clients = slices.Delete(session.clients, i, i+1)
+	}
+
+	if len(session.clients) == 0 {
+		if session.detach != nil {
+			session.detach()
+			session.detach = nil
+		}
+		session.away = time.Now()
+
+		log.Debugf("session %s went away", sid)
+	}
+
+	core.sessions[sid] = session
+}
+
+// every so often
+func (core *Core) expireSessions() {
+	core.lock.Lock()
+	defer core.lock.Unlock()
+
+	for sid, session := range core.sessions {
+		if !session.away.IsZero() && time.Since(session.away) > SESSION_GRACE {
+			delete(core.sessions, sid)
+			log.Debugf("session %s expired", sid)
+		}
+	}
+}
+
+// the slate of this name in every view that has one
+func (core *Core) viewSlates(name string) []slate.Slate {
+	core.lock.RLock()
+	defer core.lock.RUnlock()
+
+	slates := make([]slate.Slate, 0)
+	for _, session := range core.sessions {
+		if s, there := session.view.slates[name]; there {
+			slates = append(slates, s)
+		}
 	}
+	return slates
 }
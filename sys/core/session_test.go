@@ -0,0 +1,162 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"slater/core/msg"
+)
+
+// a core which is set up already, with room for what it sends the interface
+func testSessionCore(t *testing.T) *Core {
+	core := testCore(t, LAYOUT_SLATE)
+	core.host = &node{host: testHost(t)}
+	core.sessions = make(map[string]session)
+	core.Output = make(chan any, 1000)
+	return core
+}
+
+// everything sent to the interface so far
+func sent(core *Core) []any {
+	out := make([]any, 0)
+	for {
+		select {
+		case o := <-core.Output:
+			out = append(out, o)
+		default:
+			return out
+		}
+	}
+}
+
+// in time, or the test fails (setup would wait for prompts forever)
+func within(t *testing.T, what string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal(what, "didn't finish")
+	}
+}
+
+func TestSessionQuit(t *testing.T) {
+	core := testSessionCore(t)
+
+	within(t, "connect", func() { core.connect("s", "one") })
+	within(t, "resume", func() { core.resumeSession("s", "two") })
+
+	core.lock.RLock()
+	feed := core.sessions["s"].view.slates["setup"]
+	clients := len(core.sessions["s"].clients)
+	core.lock.RUnlock()
+	if clients != 2 {
+		t.Fatal("clients", clients)
+	}
+	sent(core)
+
+	// one goes, and the other still hears the setup slate
+	core.quitSession("s", "one")
+	feed.Write(&msg.Message{Kind: "text", Sent: msg.Timestamp()})
+	time.Sleep(100 * time.Millisecond)
+	if out := sent(core); len(out) != 1 {
+		t.Fatal("sent", out)
+	}
+
+	// the last goes, and then nothing is sent, but the session stays for a while
+	core.quitSession("s", "two")
+	feed.Write(&msg.Message{Kind: "text", Sent: msg.Timestamp()})
+	time.Sleep(100 * time.Millisecond)
+	if out := sent(core); len(out) != 0 {
+		t.Fatal("sent to a session with no clients", out)
+	}
+
+	core.expireSessions()
+
+	core.lock.RLock()
+	s, there := core.sessions["s"]
+	core.lock.RUnlock()
+	if !there || s.away.IsZero() || s.detach != nil {
+		t.Fatalf("session gone too soon, or still attached: %+v", s)
+	}
+
+	// coming back within the grace keeps the view, and catches up on the setup slate
+	within(t, "resume", func() { core.resumeSession("s", "three") })
+
+	core.lock.RLock()
+	s = core.sessions["s"]
+	core.lock.RUnlock()
+	if s.view.slates["setup"] != feed || !s.away.IsZero() || s.detach == nil {
+		t.Fatal("didn't pick up where it left off")
+	}
+
+	pages := 0
+	for _, o := range sent(core) {
+		if page, ok := o.(OutputPage); ok && page.Slate == "setup" && page.Client == "three" {
+			pages++
+			if len(page.Page) != 2 {
+				t.Fatal("caught up on", len(page.Page), "messages")
+			}
+		}
+	}
+	if pages != 1 {
+		t.Fatal("pages", pages)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	core := testSessionCore(t)
+
+	within(t, "connect", func() { core.connect("s", "one") })
+	core.quitSession("s", "one")
+
+	core.lock.Lock()
+	s := core.sessions["s"]
+	old := s.view.slates["setup"]
+	s.away = time.Now().Add(-SESSION_GRACE - time.Second)
+	core.sessions["s"] = s
+	core.lock.Unlock()
+
+	// a session which has a client is never dropped
+	within(t, "connect", func() { core.connect("t", "other") })
+
+	core.expireSessions()
+
+	core.lock.RLock()
+	_, there := core.sessions["s"]
+	_, still := core.sessions["t"]
+	core.lock.RUnlock()
+	if there || !still {
+		t.Fatal("expired", !there, "kept the other", still)
+	}
+	sent(core)
+
+	// resuming starts it over, on the core as it's running: no setup, just the layout
+	within(t, "resume", func() { core.resumeSession("s", "one") })
+
+	core.lock.RLock()
+	s, there = core.sessions["s"]
+	core.lock.RUnlock()
+	if !there || s.view.slates["setup"] == old || len(s.clients) != 1 || s.clients[0] != "one" {
+		t.Fatalf("not started over: %+v", s)
+	}
+
+	laidOut := false
+	for _, o := range sent(core) {
+		switch o := o.(type) {
+		case OutputLayout:
+			laidOut = laidOut || o.Session == "s"
+		case OutputUIMessage:
+			if _, prompt := o.Message.Content["prompt"]; prompt {
+				t.Fatal("prompted", o.Message.Content)
+			}
+		}
+	}
+	if !laidOut {
+		t.Fatal("no layout")
+	}
+}
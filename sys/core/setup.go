@@ -3,8 +3,6 @@ package core
 import (
 	"context"
 	"crypto/ed25519"
-	"errors"
-	"golang.org/x/exp/slices"
 	"strings"
 	"time"
 
@@ -25,6 +23,7 @@ const (
 
 	KEYKEY     = "k"
 	DEVICESKEY = "d"
+	TOPICKEY   = "t"
 )
 
 func wait() {
@@ -34,20 +33,24 @@ func wait() {
 	<-time.After(time.Duration(d) * time.Second)
 }
 
-func runSetup(core *Core, feed slate.Slate) (store.Store, *node) {
-	text := func(body string) {
-		feed.Write(&msg.Message{
-			Slate: "setup",
-			User:  "system",
-			Kind:  "text",
-			Sent:  msg.Timestamp(),
-			Content: map[string]any{
-				"body": body,
-			},
-		})
-	}
+func text(feed slate.Slate, body string) {
+	feed.Write(&msg.Message{
+		Slate: "setup",
+		User:  "system",
+		Kind:  "text",
+		Sent:  msg.Timestamp(),
+		Content: map[string]any{
+			"body": body,
+		},
+	})
+}
 
-	say := func(things ...string) { wait(); text(strings.Join(things, "\n")) }
+func sayer(feed slate.Slate) func(...string) {
+	return func(things ...string) { wait(); text(feed, strings.Join(things, "\n")) }
+}
+
+func runSetup(core *Core, feed slate.Slate) (store.Store, *node) {
+	say := sayer(feed)
 
 	// TODO instead of saying "hello" in English,
 	// we will say it in many languages, as a language chooser.
@@ -59,7 +62,7 @@ func runSetup(core *Core, feed slate.Slate) (store.Store, *node) {
 	// if there is only one, sending the message should select it.
 	// else if there are more than one, it should be obvious that the user should tap one to select it.
 
-	text("# Hello!")
+	text(feed, "# Hello!")
 
 	stores, err := store.FindStores(core.root)
 	if err != nil {
@@ -271,7 +274,13 @@ func affirmSecret(feed slate.Slate, evt string, body string, secret string, choi
 func completeSetup(core *Core, name, passphrase, pin string) (store.Store, *node) {
 	key := createMasterKey(core.root, name, passphrase, pin)
 
-	db, err := store.OpenStore(core.root, name, key)
+	dataKey, err := createDataKey(core.root, name, key)
+	if err != nil {
+		log.Panic(err)
+	}
+	core.key = dataKey
+
+	db, err := store.OpenStore(core.root, name, dataKey)
 
 	if err != nil {
 		log.Panic(err)
@@ -307,41 +316,72 @@ func completeSetup(core *Core, name, passphrase, pin string) (store.Store, *node
 }
 
 func connect(core *Core, db store.Store, peer *node, sessionName, passphrase, pin string) {
-	devicesBytes, err := db.Get(DEVICESKEY)
+	keys, err := deriveNetKeys(sessionName, passphrase, pin)
 	if err != nil {
-		if !errors.Is(err, store.ErrNotFound) {
-			log.Panic(err)
-		}
-	} else {
-		err = cbor.Unmarshal(devicesBytes, &core.devices)
-		if err != nil {
-			log.Panic(err)
-		}
+		log.Panic(err)
 	}
+	if err = connectWith(core, db, peer, sessionName, keys); err != nil {
+		log.Panic(err)
+	}
+}
+
+// (a rotation reconnects with the keys it was handed, without the credentials they came from, see rotate.go)
+func connectWith(core *Core, db store.Store, peer *node, sessionName string, keys netKeys) error {
+	core.name = sessionName
 
-	discoKey := discoveryKey(sessionName, passphrase, pin)
+	discoKey := keys.DiscoveryKey
 	peer.discoveryKey = discoKey
 
-	signKey, err := deriveSignatureKey(sessionName, passphrase, pin)
-	if err != nil {
-		log.Panic(err)
+	signKey := ed25519.NewKeyFromSeed(keys.SignSeed)
+	peer.signKey = signKey
+
+	self := peer.host.ID().String()
+
+	if err := core.roster.load(db, signKey, self); err != nil {
+		return err
 	}
 
 	signet := ed25519.Sign(signKey, []byte(peer.host.ID().String()))
 	peer.signet = signet
 
+	topicKey := keys.TopicKey
+	peer.topicKey = topicKey
+
+	// so that after recovering with shares, this topic can be relayed without these credentials (see rotate.go)
+	current, err := cbor.Marshal(oldTopic{discoKey, topicKey})
+	if err != nil {
+		return err
+	}
+	if err = db.Put([]string{TOPICKEY}, current); err != nil {
+		return err
+	}
+
+	if err = peer.addTopicKey(discoKey, TOPIC_KEY_VERSION, topicKey); err != nil {
+		return err
+	}
+
 	validator := func(ctx context.Context, pid _peer.ID, pmsg *pubsub.Message) pubsub.ValidationResult {
 		p := pid.String()
 
-		if p == peer.host.ID().String() {
+		if p == self {
 			return pubsub.ValidationAccept
 		}
 
-		if slices.Contains(core.devices, p) {
+		if core.roster.isRevoked(p) {
+			return pubsub.ValidationReject
+		}
+
+		if core.roster.isDevice(p) {
 			return pubsub.ValidationAccept
 		}
 
-		m, err := msg.Decode(pmsg.Data)
+		// without the topic key, there's no way to write a valid payload
+		bytes, err := peer.open(peer.discoveryKey, pmsg.Data)
+		if err != nil {
+			return pubsub.ValidationReject
+		}
+
+		m, err := msg.Decode(bytes)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -361,12 +401,12 @@ func connect(core *Core, db store.Store, peer *node, sessionName, passphrase, pi
 		valid := ed25519.Verify(pubKey, []byte(p), signetBytes)
 
 		if valid {
-			core.devices = append(core.devices, p)
-			bytes, err := cbor.Marshal(core.devices)
-			if err != nil {
-				log.Panic(err)
+			if core.roster.add(p, self, signKey) {
+				if err := saveRoster(db, core.roster); err != nil {
+					log.Error(err)
+				}
+				go peer.sendRoster(core.roster)
 			}
-			db.Put([]string{DEVICESKEY}, bytes)
 			return pubsub.ValidationAccept
 		}
 
@@ -387,6 +427,7 @@ func connect(core *Core, db store.Store, peer *node, sessionName, passphrase, pi
 						"signet": peer.signet,
 					},
 				})
+				peer.sendRoster(core.roster)
 				return
 				// ...or should we continue sending periodically? 🤔...
 				// Should we continue polling, and watch for more peers?
@@ -396,4 +437,6 @@ func connect(core *Core, db store.Store, peer *node, sessionName, passphrase, pi
 			time.Sleep(1 * time.Second)
 		}
 	}()
+
+	return nil
 }
@@ -25,6 +25,24 @@ func setupUser(core *Core, feed slate.Slate, say func(...string)) (store.Store,
 		nameAccepted = <-proposeAnotherName(feed, newName)
 	}
 
+	newPhrase, newPin := proposeCredentials(feed, say)
+
+	writeDown(feed, say, newName, newPhrase, newPin)
+
+	say("Put it with your money.",
+		"Make a copy, and put it in a safe or something.\n",
+		"Make another copy, and put it in your lawyer's safe or something.",
+	)
+
+	say("_Don't lose it._",
+		"If you lose it, everything is lost and nobody can help you.\n",
+		"(Unless you make recovery shares, for people you trust. You can do that any time.)",
+	)
+
+	return completeSetup(core, newName, newPhrase, newPin)
+}
+
+func proposeCredentials(feed slate.Slate, say func(...string)) (string, string) {
 	newPhrase := generatePassphrase()
 	phraseAccepted := <-proposePhrase(feed, newPhrase)
 	for !phraseAccepted {
@@ -41,6 +59,10 @@ func setupUser(core *Core, feed slate.Slate, say func(...string)) (store.Store,
 		pinAccepted = <-proposePin(feed, newPin)
 	}
 
+	return newPhrase, newPin
+}
+
+func writeDown(feed slate.Slate, say func(...string), name, phrase, pin string) {
 	say("Awesome. Now write it down.",
 		"Write on one sheet of paper so it doesn't imprint on another.",
 		"Make sure nobody is looking!",
@@ -50,24 +72,13 @@ func setupUser(core *Core, feed slate.Slate, say func(...string)) (store.Store,
 
 	now := time.Now()
 
-	secret(feed, now.Format("2006-01-02"), newName, newPhrase, newPin)
+	secret(feed, now.Format("2006-01-02"), name, phrase, pin)
 
 	writtenDown := <-promptWrittenDown(feed)
 	for !writtenDown {
 		wait()
 		writtenDown = <-promptWrittenDownAgain(feed)
 	}
-
-	say("Put it with your money.",
-		"Make a copy, and put it in a safe or something.\n",
-		"Make another copy, and put it in your lawyer's safe or something.",
-	)
-
-	say("_Don't lose it._",
-		"If you lose it, everything is lost and nobody can help you.\n",
-	)
-
-	return completeSetup(core, newName, newPhrase, newPin)
 }
 
 func askIfReady(feed slate.Slate) chan bool {
@@ -44,19 +44,11 @@ func TestSetupAndDiscovery(t *testing.T) {
 
 		switch coreMsg.(type) {
 		case OutputUIMessage:
-			output := coreMsg.(OutputUIMessage)
-			inner := output.Message
+			m := coreMsg.(OutputUIMessage).Message
 
-			mi, there := inner["msg"]
-			if !there {
-				continue
-			}
-
-			m := mi.(msg.Message)
-
-			switch m["kind"] {
+			switch m.Kind {
 			case "text", "secretText":
-				bodyField, there := m["body"]
+				bodyField, there := m.Content["body"]
 				if !there {
 					continue
 				}
@@ -64,53 +56,53 @@ func TestSetupAndDiscovery(t *testing.T) {
 				body := bodyField.(string)
 
 				if strings.Contains(body, "new user") {
-					prompt := m["prompt"].(msg.Message)
-					event := prompt["event"]
-					kind := prompt["kind"]
-					send(core1.Input, InputUIMessage{Session: "test1", Message: msg.Message{"kind": "msg", "msg": map[string]any{"choice": float64(0), "event": event, "kind": kind, "slate": "setup"}}})
+					prompt := m.Content["prompt"].(map[string]any)
+					event := prompt["event"].(string)
+					kind := prompt["kind"].(string)
+					send(core1.Input, InputUIMessage{Session: "test1", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"choice": float64(0)}}})
 					continue
 				}
 
 				if strings.Contains(body, "you ready") {
-					prompt := m["prompt"].(msg.Message)
-					event := prompt["event"]
-					kind := prompt["kind"]
-					send(core1.Input, InputUIMessage{Session: "test1", Message: msg.Message{"kind": "msg", "msg": map[string]any{"choice": float64(0), "event": event, "kind": kind, "slate": "setup"}}})
+					prompt := m.Content["prompt"].(map[string]any)
+					event := prompt["event"].(string)
+					kind := prompt["kind"].(string)
+					send(core1.Input, InputUIMessage{Session: "test1", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"choice": float64(0)}}})
 					continue
 				}
 
 				if strings.Contains(body, "`session name`") {
-					sessionName = m["secretText"].(string)
-					prompt := m["prompt"].(msg.Message)
-					event := prompt["event"]
-					kind := prompt["kind"]
-					send(core1.Input, InputUIMessage{Session: "test1", Message: msg.Message{"kind": "msg", "msg": map[string]any{"choice": float64(0), "event": event, "kind": kind, "slate": "setup"}}})
+					sessionName = m.Content["secretText"].(string)
+					prompt := m.Content["prompt"].(map[string]any)
+					event := prompt["event"].(string)
+					kind := prompt["kind"].(string)
+					send(core1.Input, InputUIMessage{Session: "test1", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"choice": float64(0)}}})
 					continue
 				}
 
 				if strings.Contains(body, "`passphrase`") {
-					passphrase = m["secretText"].(string)
-					prompt := m["prompt"].(msg.Message)
-					event := prompt["event"]
-					kind := prompt["kind"]
-					send(core1.Input, InputUIMessage{Session: "test1", Message: msg.Message{"kind": "msg", "msg": map[string]any{"choice": float64(0), "event": event, "kind": kind, "slate": "setup"}}})
+					passphrase = m.Content["secretText"].(string)
+					prompt := m.Content["prompt"].(map[string]any)
+					event := prompt["event"].(string)
+					kind := prompt["kind"].(string)
+					send(core1.Input, InputUIMessage{Session: "test1", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"choice": float64(0)}}})
 					continue
 				}
 
 				if strings.Contains(body, "`PIN`") {
-					pin = m["secretText"].(string)
-					prompt := m["prompt"].(msg.Message)
-					event := prompt["event"]
-					kind := prompt["kind"]
-					send(core1.Input, InputUIMessage{Session: "test1", Message: msg.Message{"kind": "msg", "msg": map[string]any{"choice": float64(0), "event": event, "kind": kind, "slate": "setup"}}})
+					pin = m.Content["secretText"].(string)
+					prompt := m.Content["prompt"].(map[string]any)
+					event := prompt["event"].(string)
+					kind := prompt["kind"].(string)
+					send(core1.Input, InputUIMessage{Session: "test1", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"choice": float64(0)}}})
 					continue
 				}
 
 				if strings.Contains(body, "finished") {
-					prompt := m["prompt"].(msg.Message)
-					event := prompt["event"]
-					kind := prompt["kind"]
-					send(core1.Input, InputUIMessage{Session: "test1", Message: msg.Message{"kind": "msg", "msg": map[string]any{"choice": float64(0), "event": event, "kind": kind, "slate": "setup"}}})
+					prompt := m.Content["prompt"].(map[string]any)
+					event := prompt["event"].(string)
+					kind := prompt["kind"].(string)
+					send(core1.Input, InputUIMessage{Session: "test1", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"choice": float64(0)}}})
 					continue
 				}
 
@@ -145,19 +137,11 @@ func TestSetupAndDiscovery(t *testing.T) {
 				return
 
 			case OutputUIMessage:
-				output := coreMsg.(OutputUIMessage)
-				inner := output.Message
-
-				mi, there := inner["msg"]
-				if !there {
-					continue
-				}
-
-				m := mi.(msg.Message)
+				m := coreMsg.(OutputUIMessage).Message
 
-				switch m["kind"] {
+				switch m.Kind {
 				case "text":
-					bodyField, there := m["body"]
+					bodyField, there := m.Content["body"]
 					if !there {
 						continue
 					}
@@ -165,34 +149,34 @@ func TestSetupAndDiscovery(t *testing.T) {
 					body := bodyField.(string)
 
 					if strings.Contains(body, "new user") {
-						prompt := m["prompt"].(msg.Message)
-						event := prompt["event"]
-						kind := prompt["kind"]
-						send(core2.Input, InputUIMessage{Session: "test2", Message: msg.Message{"kind": "msg", "msg": map[string]any{"choice": float64(1), "event": event, "kind": kind, "slate": "setup"}}})
+						prompt := m.Content["prompt"].(map[string]any)
+						event := prompt["event"].(string)
+						kind := prompt["kind"].(string)
+						send(core2.Input, InputUIMessage{Session: "test2", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"choice": float64(1)}}})
 						continue
 					}
 
 					if strings.Contains(body, "session") {
-						prompt := m["prompt"].(msg.Message)
-						event := prompt["event"]
-						kind := prompt["kind"]
-						send(core2.Input, InputUIMessage{Session: "test2", Message: msg.Message{"kind": "msg", "msg": map[string]any{"body": sessionName, "event": event, "kind": kind, "slate": "setup"}}})
+						prompt := m.Content["prompt"].(map[string]any)
+						event := prompt["event"].(string)
+						kind := prompt["kind"].(string)
+						send(core2.Input, InputUIMessage{Session: "test2", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"body": sessionName}}})
 						continue
 					}
 
 					if strings.Contains(body, "passphrase") {
-						prompt := m["prompt"].(msg.Message)
-						event := prompt["event"]
-						kind := prompt["kind"]
-						send(core2.Input, InputUIMessage{Session: "test2", Message: msg.Message{"kind": "msg", "msg": map[string]any{"secretText": passphrase, "event": event, "kind": kind, "slate": "setup"}}})
+						prompt := m.Content["prompt"].(map[string]any)
+						event := prompt["event"].(string)
+						kind := prompt["kind"].(string)
+						send(core2.Input, InputUIMessage{Session: "test2", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"secretText": passphrase}}})
 						continue
 					}
 
 					if strings.Contains(body, "PIN") {
-						prompt := m["prompt"].(msg.Message)
-						event := prompt["event"]
-						kind := prompt["kind"]
-						send(core2.Input, InputUIMessage{Session: "test2", Message: msg.Message{"kind": "msg", "msg": map[string]any{"secretText": pin, "event": event, "kind": kind, "slate": "setup"}}})
+						prompt := m.Content["prompt"].(map[string]any)
+						event := prompt["event"].(string)
+						kind := prompt["kind"].(string)
+						send(core2.Input, InputUIMessage{Session: "test2", Message: &msg.Message{Slate: "setup", Kind: kind, Event: event, Content: map[string]any{"secretText": pin}}})
 						continue
 					}
 
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"errors"
+
+	"lukechampine.com/frand"
+)
+
+//
+// Shamir's secret sharing, over GF(2^8).
+// https://en.wikipedia.org/wiki/Shamir%27s_secret_sharing
+//
+// Each byte of the secret is the constant term of its own random polynomial of degree threshold-1,
+// and share x holds every polynomial evaluated at x (for x from 1 to 255).
+// Any threshold shares give the polynomials back by Lagrange interpolation, and so the secret;
+// fewer give nothing at all.
+//
+// The field is the one AES uses (x^8 + x^4 + x^3 + x + 1), with 3 as the generator for the log tables.
+//
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+
+	errShares    = errors.New("shamir: bad shares")
+	errThreshold = errors.New("shamir: bad threshold")
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfExp[i+255] = x
+		gfLog[x] = byte(i)
+		x = gfMulSlow(x, 3)
+	}
+}
+
+func gfMulSlow(a, b byte) (p byte) {
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// split a secret into count shares, any threshold of which give it back
+// (the x coordinate of each share is its index + 1)
+func split(secret []byte, threshold, count int) ([][]byte, error) {
+	if threshold < 2 || threshold > count || count > 255 {
+		return nil, errThreshold
+	}
+
+	shares := make([][]byte, count)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+
+	coefficients := make([]byte, threshold)
+
+	for b, s := range secret {
+		coefficients[0] = s
+		copy(coefficients[1:], frand.Bytes(threshold-1))
+
+		for i := range shares {
+			x := byte(i + 1)
+
+			// Horner's method
+			y := byte(0)
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+
+			shares[i][b] = y
+		}
+	}
+
+	return shares, nil
+}
+
+// the secret from shares, by x coordinate
+func combine(shares map[byte][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errShares
+	}
+
+	size := -1
+	for x, share := range shares {
+		if x == 0 || (size != -1 && len(share) != size) {
+			return nil, errShares
+		}
+		size = len(share)
+	}
+
+	secret := make([]byte, size)
+
+	for xi, share := range shares {
+		// the Lagrange basis polynomial for xi, at 0
+		basis := byte(1)
+		for xj := range shares {
+			if xj != xi {
+				basis = gfMul(basis, gfDiv(xj, xj^xi))
+			}
+		}
+
+		for b := range secret {
+			secret[b] ^= gfMul(share[b], basis)
+		}
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"lukechampine.com/frand"
+)
+
+func TestShamir(t *testing.T) {
+	secret := frand.Bytes(32)
+
+	shares, err := split(secret, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subsets := [][]int{
+		{0, 1, 2},
+		{4, 2, 0},
+		{1, 3, 4},
+		{0, 1, 2, 3, 4},
+	}
+
+	for _, subset := range subsets {
+		picked := make(map[byte][]byte)
+		for _, i := range subset {
+			picked[byte(i+1)] = shares[i]
+		}
+
+		got, err := combine(picked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Fatalf("shares %v did not give the secret back", subset)
+		}
+	}
+
+	got, err := combine(map[byte][]byte{1: shares[0], 2: shares[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Fatal("fewer shares than the threshold gave the secret back")
+	}
+
+	if _, err := split(secret, 1, 5); err == nil {
+		t.Fatal("expected a threshold error")
+	}
+}
+
+func TestShareEncoding(t *testing.T) {
+	s := share{frand.Bytes(SHARE_SET), 3, 2, frand.Bytes(32)}
+
+	text := encodeShare(s)
+
+	got, err := decodeShare(strings.ToLower(strings.ReplaceAll(text, "-", " ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.set, s.set) || got.threshold != s.threshold || got.x != s.x || !bytes.Equal(got.data, s.data) {
+		t.Fatalf("expected %v, got %v", s, got)
+	}
+
+	typo := []byte(text)
+	if typo[5] == 'A' {
+		typo[5] = 'B'
+	} else {
+		typo[5] = 'A'
+	}
+	if _, err := decodeShare(string(typo)); err == nil {
+		t.Fatal("expected a typo to be caught")
+	}
+}
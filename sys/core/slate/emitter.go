@@ -1,7 +1,6 @@
 package slate
 
 import (
-	"golang.org/x/exp/slices"
 	"sync"
 
 	"slater/core/msg"
@@ -9,10 +8,12 @@ import (
 
 type Emitter struct {
 	listeners map[string][]listener
+	next      uint64
 	lock      *sync.Mutex
 }
 
 type listener struct {
+	id      uint64
 	fn      func(*msg.Message)
 	persist bool
 }
@@ -26,19 +27,35 @@ func NewEmitter() *Emitter {
 	}
 }
 
-func (emitter *Emitter) On(kind string, fn func(*msg.Message)) {
-	emitter.listen(kind, fn, true)
+// listen until the returned func is called
+func (emitter *Emitter) On(kind string, fn func(*msg.Message)) func() {
+	return emitter.listen(kind, fn, true)
 }
 
 func (emitter *Emitter) Once(kind string, fn func(*msg.Message)) {
 	emitter.listen(kind, fn, false)
 }
 
-func (emitter *Emitter) listen(kind string, fn func(*msg.Message), persist bool) {
+func (emitter *Emitter) listen(kind string, fn func(*msg.Message), persist bool) func() {
 	emitter.lock.Lock()
-	listeners, there := emitter.listeners[kind]
-	if there {
-		listeners = append(listeners, listener{fn, persist})
+	emitter.next++
+	id := emitter.next
+	emitter.listeners[kind] = append(emitter.listeners[kind], listener{id, fn, persist})
+	emitter.lock.Unlock()
+
+	return func() { emitter.off(kind, id) }
+}
+
+func (emitter *Emitter) off(kind string, id uint64) {
+	emitter.lock.Lock()
+	defer emitter.lock.Unlock()
+
+	listeners := emitter.listeners[kind]
+	for i, l := range listeners {
+		if l.id == id {
+			emitter.listeners[kind] = append(listeners[:i:i], listeners[i+1:]...)
+			return
+		}
 	}
 }
 
@@ -48,35 +65,33 @@ func (emitter *Emitter) Emit(m *msg.Message) {
 
 	emitter.lock.Lock()
 
-	wildcardListeners := emitter.listeners[ALL]
+	emitter.fire(ALL, m)
 
-	kindListeners, haveKindListeners := emitter.listeners[kind]
-	eventListeners, haveEventListeners := emitter.listeners[event]
+	if kind != ALL {
+		emitter.fire(kind, m)
+	}
 
-	for i, h := range wildcardListeners {
-		go h.fn(m)
-		if !h.persist {
-			emitter.listeners[ALL] = slices.Delete(emitter.listeners[ALL], i, i)
-		}
+	if event != "" && event != kind {
+		emitter.fire(event, m)
 	}
 
-	if haveKindListeners {
-		for i, h := range kindListeners {
-			go h.fn(m)
-			if !h.persist {
-				emitter.listeners[kind] = slices.Delete(emitter.listeners[kind], i, i)
-			}
-		}
+	emitter.lock.Unlock()
+}
+
+// call the listeners for one key, dropping the ones which only listen once
+func (emitter *Emitter) fire(key string, m *msg.Message) {
+	listeners, there := emitter.listeners[key]
+	if !there {
+		return
 	}
 
-	if haveEventListeners {
-		for i, h := range eventListeners {
-			go h.fn(m)
-			if !h.persist {
-				emitter.listeners[event] = slices.Delete(emitter.listeners[event], i, i)
-			}
+	kept := make([]listener, 0, len(listeners))
+	for _, h := range listeners {
+		go h.fn(m)
+		if h.persist {
+			kept = append(kept, h)
 		}
 	}
 
-	emitter.lock.Unlock()
+	emitter.listeners[key] = kept
 }
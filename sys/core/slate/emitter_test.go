@@ -0,0 +1,35 @@
+package slate
+
+import (
+	"testing"
+	"time"
+
+	"slater/core/msg"
+)
+
+func TestEmitterOff(t *testing.T) {
+	e := NewEmitter()
+
+	heard := make(chan string, 4)
+
+	off := e.On(ALL, func(m *msg.Message) { heard <- "first" })
+	e.On(ALL, func(m *msg.Message) { heard <- "second" })
+
+	off()
+	e.Emit(&msg.Message{Kind: "text"})
+
+	select {
+	case who := <-heard:
+		if who != "second" {
+			t.Fatalf("%s listener still listening", who)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nobody heard")
+	}
+
+	select {
+	case who := <-heard:
+		t.Fatalf("%s listener heard twice", who)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
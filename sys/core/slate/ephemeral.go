@@ -38,8 +38,8 @@ func (slate *EphemeralSlate) Write(m *msg.Message) error {
 	return nil
 }
 
-func (slate *EphemeralSlate) On(kind string, fn func(*msg.Message)) {
-	slate.Emitter.On(kind, fn)
+func (slate *EphemeralSlate) On(kind string, fn func(*msg.Message)) func() {
+	return slate.Emitter.On(kind, fn)
 }
 
 func (slate *EphemeralSlate) Once(kind string, fn func(*msg.Message)) {
@@ -64,11 +64,14 @@ func (slate *EphemeralSlate) GetRange(from, including int) ([]*msg.Message, erro
 	defer slate.Lock.RUnlock()
 
 	high := including + 1
-	if uint64(high) >= uint64(len(slate.Log)) {
+	if from < 0 || high < from || high > len(slate.Log) {
 		return nil, errors.New("slate.range: range exceeded bounds!")
 	}
 
-	return slate.Log[from:high], nil
+	msgs := make([]*msg.Message, high-from)
+	copy(msgs, slate.Log[from:high])
+
+	return msgs, nil
 }
 
 func (slate *EphemeralSlate) Count() uint64 {
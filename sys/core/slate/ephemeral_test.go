@@ -0,0 +1,34 @@
+package slate
+
+import (
+	"testing"
+
+	"slater/core/msg"
+)
+
+func TestEphemeralSlateRange(t *testing.T) {
+	s := NewEphemeralSlate("setup")
+
+	if msgs, err := s.GetRange(0, -1); err != nil || len(msgs) != 0 {
+		t.Fatalf("empty range of an empty slate: %v, %v", msgs, err)
+	}
+
+	for _, body := range []string{"a", "b", "c"} {
+		s.Write(&msg.Message{Kind: "text", Content: map[string]any{"body": body}})
+	}
+
+	msgs, err := s.GetRange(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Content["body"] != "b" || msgs[1].Content["body"] != "c" {
+		t.Fatalf("got %v", msgs)
+	}
+
+	if _, err = s.GetRange(1, 3); err == nil {
+		t.Fatal("range past the end")
+	}
+	if _, err = s.GetRange(2, 0); err == nil {
+		t.Fatal("backwards range")
+	}
+}
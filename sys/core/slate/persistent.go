@@ -3,12 +3,16 @@ package slate
 import (
 	"context"
 	"errors"
+	"fmt"
 	"golang.org/x/exp/slices"
 	"strconv"
+	"sync"
 
 	cbor "github.com/fxamacker/cbor/v2"
 	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
 	logging "github.com/ipfs/go-log/v2"
+	dsextensions "github.com/textileio/go-datastore-extensions"
 
 	"slater/core/msg"
 	"slater/core/store"
@@ -17,231 +21,696 @@ import (
 const (
 	ROOT    = "s"
 	SEQ     = "sq"
-	SUBLOGS = "sl"
+	HORIZON = "hz"
+	INDEX   = "ix" // by position, from before the index was ordered (see migrate)
+	ORDER   = "or"
+	COUNT   = "ct"
+
+	MIGRATE_BATCH = 1_000
 )
 
 var (
 	ctx = context.TODO()
 	log = logging.Logger("slater:core")
+
+	ErrAhead = errors.New("slate: message is stamped too far ahead of our clock")
 )
 
+// Keys, per slate:
+//
+//	/s/<slate>                 key of the last message in the merged log
+//	/s/<slate>/hz              horizon: the last contiguous seq of each device's sublog
+//	/s/<slate>/ct              number of messages in the merged log
+//	/s/<slate>/or/<order>      key of the message at that place in the order (see orderKey)
+//	/s/<slate>/<device>/sq     highest seq written by that device
+//	/s/<slate>/<device>/<seq>  the message itself
+//
+// The index mirrors the Prev/Next links, so that reads don't need to walk the list.
+// It's keyed by where each message goes in the order, not by position,
+// so a message which arrives late is just one more key, wherever it goes.
+
 type PersistentSlate struct {
 	name    string
 	Device  string
 	Store   store.Store
+	Lock    *sync.RWMutex
 	Emitter *Emitter
 }
 
 func NewPersistentSlate(name, device string, db store.Store) *PersistentSlate {
-	return &PersistentSlate{
+	slate := &PersistentSlate{
 		name:    name,
 		Device:  device,
 		Store:   db,
+		Lock:    &sync.RWMutex{},
 		Emitter: NewEmitter(),
 	}
+	if err := slate.migrate(); err != nil {
+		log.Error(err)
+	}
+	return slate
 }
 
 func (slate *PersistentSlate) Name() string {
 	return slate.name
 }
 
+// record a message written here with Send, or one replicated from another device with Recv
+func (slate *PersistentSlate) Write(m *msg.Message) error {
+	if m.Device == "" || m.Device == slate.Device {
+		return slate.Send(m)
+	}
+	return slate.Recv(m)
+}
+
 // record a message to this device's log, to then be replicated
-// (derives Seq and Prev from current state)
+// (derives Seq, Stamp and Prev from current state)
 func (slate *PersistentSlate) Send(m *msg.Message) error {
 	m.Slate = slate.name
 	m.Device = slate.Device
 
-	sublog := slate.Device
+	slate.Lock.Lock()
+	defer slate.Lock.Unlock()
 
 	txn, err := slate.Store.Store.NewTransaction(ctx, false)
 	if err != nil {
 		return err
 	}
+	defer txn.Discard(ctx)
 
-	// NEXT: actually, save the horizon instead...
-	sublogsNs := []string{ROOT, slate.name, SUBLOGS}
-	sublogsKey := ds.KeyWithNamespaces(sublogsNs)
-	sublogsBytes, err := txn.Get(ctx, sublogsKey)
+	seqKey := slate.key(slate.Device, SEQ)
+	seq, err := getUint(txn, seqKey)
 	if err != nil {
 		return err
 	}
-	var sublogs []string
-	err = cbor.Unmarshal(sublogsBytes, sublogs)
-	if err != nil {
+
+	seq++
+	m.Seq = seq
+
+	if err = putUint(txn, seqKey, seq); err != nil {
 		return err
 	}
 
-	if !slices.Contains(sublogs, sublog) {
-		// lazy add, assuming more ceremony at a higher level to govern what sublogs are valid
-		sublogs = append(sublogs, sublog)
-		sublogsBytes, err = cbor.Marshal(sublogs)
+	// the last message has the latest stamp we've seen, whichever device it came from
+	latest := msg.Stamp{}
+	lastKey, err := getString(txn, slate.key())
+	if err != nil {
+		return err
+	}
+	if lastKey != "" {
+		last, err := getMessage(txn, ds.NewKey(lastKey))
 		if err != nil {
 			return err
 		}
-		txn.Put(ctx, sublogsKey, sublogsBytes)
+		latest = last.Order()
 	}
 
-	logNs := []string{ROOT, slate.name, slate.Device}
+	m.Stamp = msg.NextStamp(latest)
 
-	seqNs := append(logNs, SEQ)
-	seqKey := ds.KeyWithNamespaces(seqNs)
+	if err = slate.insert(txn, m); err != nil {
+		return err
+	}
 
-	seqBytes, err := txn.Get(ctx, seqKey)
-	if err != nil && !errors.Is(err, ds.ErrNotFound) {
+	if err = slate.advance(txn, slate.Device); err != nil {
 		return err
 	}
-	var seq uint64
-	err = cbor.Unmarshal(seqBytes, seq)
-	if err != nil {
+
+	if err = txn.Commit(ctx); err != nil {
 		return err
 	}
 
-	seq++
-	m.Seq = seq
+	slate.Emitter.Emit(m)
+
+	return nil
+}
 
-	seqBytes, err = cbor.Marshal(seq)
+// record a message which was written on another device
+// (expects Seq and Stamp fields to be written already)
+//
+// Messages are ordered by stamp alone, so every device ends up with the same order
+// no matter which order the messages arrive in, or whether some are still missing.
+// One stamped too far ahead is refused, and taken when it's sent again later on.
+func (slate *PersistentSlate) Recv(m *msg.Message) error {
+	m.Slate = slate.name
+
+	if m.Stamp.Ahead() {
+		return ErrAhead
+	}
+
+	slate.Lock.Lock()
+	defer slate.Lock.Unlock()
+
+	txn, err := slate.Store.Store.NewTransaction(ctx, false)
 	if err != nil {
 		return err
 	}
+	defer txn.Discard(ctx)
 
-	txn.Put(ctx, seqKey, seqBytes)
+	msgKey := slate.messageKey(m.Device, m.Seq)
 
-	lastMessageNs := []string{ROOT, slate.name}
-	lastMessageKey := ds.KeyWithNamespaces(lastMessageNs)
-	lastMessageBytes, err := txn.Get(ctx, lastMessageKey)
-	if err != nil && !errors.Is(err, ds.ErrNotFound) {
+	have, err := txn.Has(ctx, msgKey)
+	if err != nil {
 		return err
 	}
-	var lastMessage string
-	err = cbor.Unmarshal(lastMessageBytes, lastMessage)
+	if have {
+		return nil // already replicated
+	}
+
+	seqKey := slate.key(m.Device, SEQ)
+	seq, err := getUint(txn, seqKey)
 	if err != nil {
 		return err
 	}
+	if m.Seq > seq {
+		if err = putUint(txn, seqKey, m.Seq); err != nil {
+			return err
+		}
+	}
 
-	m.Prev = lastMessage
+	if err = slate.insert(txn, m); err != nil {
+		return err
+	}
 
-	msgNs := append(logNs, strconv.FormatUint(seq, 10))
-	msgKey := ds.KeyWithNamespaces(msgNs)
+	if err = slate.advance(txn, m.Device); err != nil {
+		return err
+	}
 
-	msgBytes, err := msg.Encode(m)
-	if err != nil {
+	if err = txn.Commit(ctx); err != nil {
 		return err
 	}
 
-	txn.Put(ctx, msgKey, msgBytes)
+	slate.Emitter.Emit(m)
+
+	return nil
+}
 
-	lastMessageBytes, err = cbor.Marshal(msgKey.String())
-	txn.Put(ctx, lastMessageKey, lastMessageBytes)
+// link m into the merged log, between whichever messages are either side of it in the order
+func (slate *PersistentSlate) insert(txn ds.Txn, m *msg.Message) error {
+	msgKey := slate.messageKey(m.Device, m.Seq)
+	msgKeyStr := msgKey.String()
+	orderKey := slate.orderKey(m)
 
-	horizon := new(msg.Horizon)
-	for log := range sublogs {
+	m.Prev = ""
+	m.Next = ""
 
+	before, err := slate.scan(txn, orderKey.String(), true, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(before) > 0 {
+		prevKey := ds.NewKey(before[0])
+		prevMsg, err := getMessage(txn, prevKey)
+		if err != nil {
+			return err
+		}
+		prevMsg.Next = msgKeyStr
+		if err = putMessage(txn, prevKey, prevMsg); err != nil {
+			return err
+		}
+		m.Prev = before[0]
 	}
 
-	txn.Commit(ctx)
+	after, err := slate.scan(txn, orderKey.String(), false, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(after) > 0 {
+		nextKey := ds.NewKey(after[0])
+		nextMsg, err := getMessage(txn, nextKey)
+		if err != nil {
+			return err
+		}
+		nextMsg.Prev = msgKeyStr
+		if err = putMessage(txn, nextKey, nextMsg); err != nil {
+			return err
+		}
+		m.Next = after[0]
+	} else {
+		if err := putString(txn, slate.key(), msgKeyStr); err != nil {
+			return err
+		}
+	}
 
-	slate.Emitter.Emit(m)
+	if err := putString(txn, orderKey, msgKeyStr); err != nil {
+		return err
+	}
 
-	return nil
-}
+	if err := putMessage(txn, msgKey, m); err != nil {
+		return err
+	}
 
-// record a message which was written on another device
-// (expects Seq and Prev fields to be written already)
-func (slate *PersistentSlate) Recv(m *msg.Message) error {
-	txn, err := slate.Store.Store.NewTransaction(ctx, false)
+	count, err := getUint(txn, slate.key(COUNT))
 	if err != nil {
 		return err
 	}
+	return putUint(txn, slate.key(COUNT), count+1)
+}
 
-	msgNs := []string{ROOT, slate.Name(), m.Device, strconv.FormatUint(m.Seq, 10)}
-	msgKey := ds.KeyWithNamespaces(msgNs)
-	msgKeyStr := msgKey.String()
+// Slates from before the index was ordered are indexed by position, with /s/<slate>/ix/0 first.
+// Their messages are moved over to the ordered index in batches (the ones from before there were stamps go by Sent),
+// and relinked to match. The old index goes last, from the end, so an interrupted migration starts over.
+func (slate *PersistentSlate) migrate() error {
+	slate.Lock.Lock()
+	defer slate.Lock.Unlock()
 
-	prevKey := ds.NewKey(m.Prev)
-	prevMsgBytes, err := txn.Get(ctx, prevKey)
+	txn, err := slate.Store.Store.NewTransaction(ctx, true)
 	if err != nil {
-		if errors.Is(err, ds.ErrNotFound) {
-			// we don't have that message yet!
-			// XXX this leaves a gap, and I'm not sure what to do about it yet!
-			// ...should this even happen? hopefully we can avoid this completely.
-			// we want to always append, never insert...
-			log.Debug("missing link")
-		} else {
-			return err
-		}
+		return err
+	}
+	defer txn.Discard(ctx)
+
+	legacy, err := txn.Has(ctx, slate.indexKey(0))
+	if err != nil || !legacy {
+		return err
 	}
 
-	prevMsg, err := msg.Decode(prevMsgBytes)
+	count, err := getUint(txn, slate.key(COUNT))
 	if err != nil {
 		return err
 	}
 
-	other := prevMsg.Next
-	if other != "" {
-		otherKey := ds.NewKey(other)
-		otherMsgBytes, err := txn.Get(ctx, otherKey)
+	type entry struct {
+		order ds.Key
+		key   string
+	}
+
+	entries := make([]entry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := getString(txn, slate.indexKey(i))
 		if err != nil {
 			return err
 		}
-		otherMsg, err := msg.Decode(otherMsgBytes)
+		m, err := getMessage(txn, ds.NewKey(key))
 		if err != nil {
 			return err
 		}
+		entries = append(entries, entry{slate.orderKey(m), key})
+	}
 
-		if comesBefore(m, otherMsg) {
-			m.Next = other
-			otherMsg.Prev = msgKeyStr
+	slices.SortFunc(entries, func(a, b entry) bool {
+		return a.order.String() < b.order.String()
+	})
 
-			prevMsg.Next = msgKeyStr
-			prevRec, err := msg.Encode(prevMsg)
-			if err != nil {
+	batch := func(do func(txn ds.Txn, i int) error, from, to int) error {
+		txn, err := slate.Store.Store.NewTransaction(ctx, false)
+		if err != nil {
+			return err
+		}
+		defer txn.Discard(ctx)
+		for i := to - 1; i >= from; i-- {
+			if err := do(txn, i); err != nil {
 				return err
 			}
-			txn.Put(ctx, prevKey, prevRec)
-		} else {
-			m.Prev = other
-			otherMsg.Next = msgKeyStr
 		}
+		return txn.Commit(ctx)
+	}
 
-		otherRec, err := msg.Encode(otherMsg)
+	relink := func(txn ds.Txn, i int) error {
+		key := ds.NewKey(entries[i].key)
+		m, err := getMessage(txn, key)
 		if err != nil {
 			return err
 		}
-		txn.Put(ctx, otherKey, otherRec)
-	} else {
-		prevMsg.Next = msgKeyStr
-		prevRec, err := msg.Encode(prevMsg)
+		m.Prev = ""
+		m.Next = ""
+		if i > 0 {
+			m.Prev = entries[i-1].key
+		}
+		if i+1 < len(entries) {
+			m.Next = entries[i+1].key
+		} else if err = putString(txn, slate.key(), entries[i].key); err != nil {
+			return err
+		}
+		if err = putMessage(txn, key, m); err != nil {
+			return err
+		}
+		return putString(txn, entries[i].order, entries[i].key)
+	}
+
+	unindex := func(txn ds.Txn, i int) error {
+		return txn.Delete(ctx, slate.indexKey(uint64(i)))
+	}
+
+	for _, do := range []func(ds.Txn, int) error{relink, unindex} {
+		for to := len(entries); to > 0; to -= MIGRATE_BATCH {
+			from := to - MIGRATE_BATCH
+			if from < 0 {
+				from = 0
+			}
+			if err = batch(do, from, to); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Info("ordered the index of slate ", slate.name)
+
+	return nil
+}
+
+// move a device's horizon past any messages which have arrived contiguously
+func (slate *PersistentSlate) advance(txn ds.Txn, device string) error {
+	horizonKey := slate.key(HORIZON)
+
+	horizon, err := getHorizon(txn, horizonKey)
+	if err != nil {
+		return err
+	}
+
+	// lazy add, assuming more ceremony at a higher level to govern what sublogs are valid
+	seq := (*horizon)[device]
+	for {
+		have, err := txn.Has(ctx, slate.messageKey(device, seq+1))
 		if err != nil {
 			return err
 		}
-		txn.Put(ctx, prevKey, prevRec)
+		if !have {
+			break
+		}
+		seq++
 	}
 
-	rec, err := msg.Encode(m)
+	horizon.Update(device, seq)
+
+	horizonBytes, err := msg.EncodeHorizon(horizon)
 	if err != nil {
 		return err
 	}
+	return txn.Put(ctx, horizonKey, horizonBytes)
+}
 
-	txn.Put(ctx, msgKey, rec)
+// the last contiguous seq of every sublog on this slate
+func (slate *PersistentSlate) Horizon() (*msg.Horizon, error) {
+	slate.Lock.RLock()
+	defer slate.Lock.RUnlock()
 
-	txn.Commit(ctx)
+	txn, err := slate.Store.Store.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Discard(ctx)
 
-	slate.Emitter.Emit(m)
+	return getHorizon(txn, slate.key(HORIZON))
+}
 
-	return nil
+// the messages we have which are beyond another device's horizon, up to limit
+func (slate *PersistentSlate) Missing(other *msg.Horizon, limit int) ([]*msg.Message, error) {
+	slate.Lock.RLock()
+	defer slate.Lock.RUnlock()
+
+	txn, err := slate.Store.Store.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Discard(ctx)
+
+	horizon, err := getHorizon(txn, slate.key(HORIZON))
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]string, 0, len(*horizon))
+	for device := range *horizon {
+		devices = append(devices, device)
+	}
+	slices.Sort(devices)
+
+	missing := make([]*msg.Message, 0)
+	for _, device := range devices {
+		for seq := (*other)[device] + 1; seq <= (*horizon)[device]; seq++ {
+			if len(missing) >= limit {
+				return missing, nil
+			}
+			m, err := getMessage(txn, slate.messageKey(device, seq))
+			if err != nil {
+				return nil, err
+			}
+			missing = append(missing, m)
+		}
+	}
+
+	return missing, nil
 }
 
-func comesBefore(a, b *msg.Message) bool {
-	if a.Sent == b.Sent {
-		return a.Device < b.Device
+// the contiguous run of a device's messages starting at seq from, up to limit
+func (slate *PersistentSlate) Sublog(device string, from uint64, limit int) ([]*msg.Message, error) {
+	slate.Lock.RLock()
+	defer slate.Lock.RUnlock()
+
+	txn, err := slate.Store.Store.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
 	}
-	return a.Sent < b.Sent
+	defer txn.Discard(ctx)
+
+	msgs := make([]*msg.Message, 0)
+	for seq := from; len(msgs) < limit; seq++ {
+		m, err := getMessage(txn, slate.messageKey(device, seq))
+		if err != nil {
+			if errors.Is(err, ds.ErrNotFound) {
+				break
+			}
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
 }
 
-func (slate *PersistentSlate) On(kind string, fn func(*msg.Message)) {
-	slate.Emitter.On(kind, fn)
+func (slate *PersistentSlate) On(kind string, fn func(*msg.Message)) func() {
+	return slate.Emitter.On(kind, fn)
 }
 
 func (slate *PersistentSlate) Once(kind string, fn func(*msg.Message)) {
 	slate.Emitter.Once(kind, fn)
 }
+
+func (slate *PersistentSlate) Get(idx uint64) (*msg.Message, error) {
+	slate.Lock.RLock()
+	defer slate.Lock.RUnlock()
+
+	txn, err := slate.Store.Store.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Discard(ctx)
+
+	count, err := getUint(txn, slate.key(COUNT))
+	if err != nil {
+		return nil, err
+	}
+
+	if idx >= count {
+		return nil, errors.New("slate.get: index out of bounds!")
+	}
+
+	msgs, err := slate.messagesAt(txn, idx, idx+1, count)
+	if err != nil {
+		return nil, err
+	}
+	return msgs[0], nil
+}
+
+func (slate *PersistentSlate) GetRange(from, including int) ([]*msg.Message, error) {
+	slate.Lock.RLock()
+	defer slate.Lock.RUnlock()
+
+	txn, err := slate.Store.Store.NewTransaction(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Discard(ctx)
+
+	count, err := getUint(txn, slate.key(COUNT))
+	if err != nil {
+		return nil, err
+	}
+
+	high := including + 1
+	if from < 0 || high < from || uint64(high) > count {
+		return nil, errors.New("slate.range: range exceeded bounds!")
+	}
+
+	return slate.messagesAt(txn, uint64(from), uint64(high), count)
+}
+
+func (slate *PersistentSlate) Count() uint64 {
+	slate.Lock.RLock()
+	defer slate.Lock.RUnlock()
+
+	txn, err := slate.Store.Store.NewTransaction(ctx, true)
+	if err != nil {
+		log.Error(err)
+		return 0
+	}
+	defer txn.Discard(ctx)
+
+	count, err := getUint(txn, slate.key(COUNT))
+	if err != nil {
+		log.Error(err)
+		return 0
+	}
+
+	return count
+}
+
+// the messages from position from up to to, counting along the index from whichever end is nearer
+func (slate *PersistentSlate) messagesAt(txn ds.Txn, from, to, count uint64) ([]*msg.Message, error) {
+	msgs := make([]*msg.Message, 0, to-from)
+	if from >= to {
+		return msgs, nil
+	}
+
+	var keys []string
+	var err error
+	if count-to < from {
+		keys, err = slate.scan(txn, slate.key(ORDER).String()+"/\xff", true, int(count-to), int(to-from))
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	} else {
+		keys, err = slate.scan(txn, "", false, int(from), int(to-from))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) != int(to-from) {
+		return nil, errors.New("slate: index doesn't match the count!")
+	}
+
+	for _, key := range keys {
+		m, err := getMessage(txn, ds.NewKey(key))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+// the message keys along the index from seek (or from the start, or the end if reversed)
+func (slate *PersistentSlate) scan(txn ds.Txn, seek string, reverse bool, offset, limit int) ([]string, error) {
+	ext, ok := txn.(dsextensions.TxnExt)
+	if !ok {
+		return nil, errors.New("slate: the store can't seek")
+	}
+
+	q := dsextensions.QueryExt{
+		Query:      dsq.Query{Prefix: slate.key(ORDER).String(), Offset: offset, Limit: limit},
+		SeekPrefix: seek,
+	}
+	if reverse {
+		q.Orders = []dsq.Order{dsq.OrderByKeyDescending{}}
+	}
+
+	results, err := ext.QueryExtended(q)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	keys := make([]string, 0, limit)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		var key string
+		if err = cbor.Unmarshal(result.Value, &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (slate *PersistentSlate) key(parts ...string) ds.Key {
+	return ds.KeyWithNamespaces(append([]string{ROOT, slate.name}, parts...))
+}
+
+func (slate *PersistentSlate) indexKey(pos uint64) ds.Key {
+	return slate.key(INDEX, strconv.FormatUint(pos, 10))
+}
+
+// The total order of a merged log: by stamp, then by device, then by seq.
+// The numbers are fixed width, so the keys sort in that order
+// (device IDs are base58, so they sort after the "-").
+func (slate *PersistentSlate) orderKey(m *msg.Message) ds.Key {
+	s := m.Order()
+	return slate.key(ORDER, fmt.Sprintf("%016x-%08x-%s-%016x", uint64(s.Wall), s.Logical, m.Device, m.Seq))
+}
+
+func (slate *PersistentSlate) messageKey(device string, seq uint64) ds.Key {
+	return slate.key(device, strconv.FormatUint(seq, 10))
+}
+
+func getUint(txn ds.Txn, key ds.Key) (uint64, error) {
+	var n uint64
+	b, err := txn.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, ds.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	err = cbor.Unmarshal(b, &n)
+	return n, err
+}
+
+func putUint(txn ds.Txn, key ds.Key, n uint64) error {
+	b, err := cbor.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return txn.Put(ctx, key, b)
+}
+
+func getString(txn ds.Txn, key ds.Key) (string, error) {
+	var s string
+	b, err := txn.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, ds.ErrNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	err = cbor.Unmarshal(b, &s)
+	return s, err
+}
+
+func putString(txn ds.Txn, key ds.Key, s string) error {
+	b, err := cbor.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return txn.Put(ctx, key, b)
+}
+
+func getHorizon(txn ds.Txn, key ds.Key) (*msg.Horizon, error) {
+	b, err := txn.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, ds.ErrNotFound) {
+			return &msg.Horizon{}, nil
+		}
+		return nil, err
+	}
+	return msg.DecodeHorizon(b)
+}
+
+func getMessage(txn ds.Txn, key ds.Key) (*msg.Message, error) {
+	b, err := txn.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Decode(b)
+}
+
+func putMessage(txn ds.Txn, key ds.Key, m *msg.Message) error {
+	b, err := msg.Encode(m)
+	if err != nil {
+		return err
+	}
+	return txn.Put(ctx, key, b)
+}
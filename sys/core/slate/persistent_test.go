@@ -0,0 +1,290 @@
+package slate
+
+import (
+	"errors"
+	"testing"
+
+	"slater/core/msg"
+	"slater/core/store"
+)
+
+func openTestStore(t *testing.T, root string) store.Store {
+	db, err := store.OpenStore(root, "test", "0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPersistentSlateMergedOrder(t *testing.T) {
+	root := t.TempDir()
+	db := openTestStore(t, root)
+
+	s := NewPersistentSlate("chat", "a", db)
+
+	write := func(m *msg.Message) {
+		if err := s.Write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(&msg.Message{Kind: "text", Content: map[string]any{"body": "a1"}})
+
+	a1, err := s.Get(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write(&msg.Message{Kind: "text", Content: map[string]any{"body": "a2"}})
+
+	// concurrent with a1, and ordered after it by device
+	write(&msg.Message{Device: "b", Seq: 1, Kind: "text", Stamp: a1.Stamp, Content: map[string]any{"body": "b1"}})
+
+	// already replicated
+	write(&msg.Message{Device: "b", Seq: 1, Kind: "text", Stamp: a1.Stamp, Content: map[string]any{"body": "b1"}})
+
+	write(&msg.Message{Kind: "text", Content: map[string]any{"body": "a3"}})
+
+	expected := []string{"a1", "b1", "a2", "a3"}
+
+	if count := s.Count(); count != uint64(len(expected)) {
+		t.Fatalf("expected %d messages, got %d", len(expected), count)
+	}
+
+	check := func(s *PersistentSlate) {
+		msgs, err := s.GetRange(0, len(expected)-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range msgs {
+			if body := m.Content["body"]; body != expected[i] {
+				t.Fatalf("expected %s at %d, got %v", expected[i], i, body)
+			}
+		}
+
+		m, err := s.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Device != "b" || m.Next != "/s/chat/a/2" || m.Prev != "/s/chat/a/1" {
+			t.Fatalf("bad links on %v", m)
+		}
+
+		// read from the end of the index
+		if m, err = s.Get(3); err != nil || m.Content["body"] != "a3" {
+			t.Fatalf("expected a3 last, got %v, %v", m, err)
+		}
+		if msgs, err = s.GetRange(2, 3); err != nil || msgs[0].Content["body"] != "a2" {
+			t.Fatalf("expected a2, a3, got %v, %v", msgs, err)
+		}
+
+		if _, err := s.Get(uint64(len(expected))); err == nil {
+			t.Fatal("expected an out of bounds error")
+		}
+	}
+
+	check(s)
+
+	db.Store.Close()
+
+	db = openTestStore(t, root)
+	defer db.Store.Close()
+
+	check(NewPersistentSlate("chat", "a", db))
+}
+
+func TestPersistentSlateHorizonSync(t *testing.T) {
+	dbA := openTestStore(t, t.TempDir())
+	defer dbA.Store.Close()
+	dbB := openTestStore(t, t.TempDir())
+	defer dbB.Store.Close()
+
+	a := NewPersistentSlate("chat", "a", dbA)
+	b := NewPersistentSlate("chat", "b", dbB)
+
+	for i := 0; i < 5; i++ {
+		if err := a.Write(&msg.Message{Kind: "text"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Write(&msg.Message{Kind: "text"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// b catches up in batches of two, as if each batch were a reply to its horizon
+	for rounds := 0; ; rounds++ {
+		if rounds > 5 {
+			t.Fatal("sync did not converge")
+		}
+
+		hb, err := b.Horizon()
+		if err != nil {
+			t.Fatal(err)
+		}
+		missing, err := a.Missing(hb, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(missing) == 0 {
+			break
+		}
+		for _, m := range missing {
+			if err := b.Recv(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ha, _ := a.Horizon()
+	hb, _ := b.Horizon()
+
+	if hb.Behind(ha) || (*hb)["a"] != 5 || (*hb)["b"] != 1 {
+		t.Fatalf("b did not catch up: %v", *hb)
+	}
+
+	if !ha.Behind(hb) {
+		t.Fatal("a should be behind b")
+	}
+
+	if count := b.Count(); count != 6 {
+		t.Fatalf("expected 6 messages, got %d", count)
+	}
+}
+
+func TestPersistentSlateConvergence(t *testing.T) {
+	stamp := func(wall int64, logical uint32) msg.Stamp {
+		return msg.Stamp{Wall: wall, Logical: logical}
+	}
+
+	// b's clock runs behind, but b2 was written after b saw a1
+	msgs := []*msg.Message{
+		{Device: "a", Seq: 1, Stamp: stamp(100, 0), Content: map[string]any{"body": "a1"}},
+		{Device: "b", Seq: 1, Stamp: stamp(50, 0), Content: map[string]any{"body": "b1"}},
+		{Device: "b", Seq: 2, Stamp: stamp(100, 1), Content: map[string]any{"body": "b2"}},
+		{Device: "c", Seq: 1, Stamp: stamp(100, 0), Content: map[string]any{"body": "c1"}},
+		{Device: "a", Seq: 2, Stamp: stamp(200, 0), Content: map[string]any{"body": "a2"}},
+	}
+
+	expected := []string{"b1", "a1", "c1", "b2", "a2"}
+
+	arrivals := [][]int{
+		{0, 1, 2, 3, 4},
+		{4, 3, 2, 1, 0},
+		{2, 4, 0, 3, 1},
+	}
+
+	for _, arrival := range arrivals {
+		db := openTestStore(t, t.TempDir())
+		s := NewPersistentSlate("chat", "z", db)
+
+		for _, i := range arrival {
+			m := *msgs[i]
+			if err := s.Recv(&m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := s.GetRange(0, len(expected)-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range got {
+			if body := m.Content["body"]; body != expected[i] {
+				t.Fatalf("arrival %v: expected %s at %d, got %v", arrival, expected[i], i, body)
+			}
+		}
+
+		db.Store.Close()
+	}
+}
+
+func TestPersistentSlateAhead(t *testing.T) {
+	db := openTestStore(t, t.TempDir())
+	defer db.Store.Close()
+
+	s := NewPersistentSlate("chat", "a", db)
+
+	ahead := &msg.Message{Device: "b", Seq: 1, Stamp: msg.Stamp{Wall: msg.Timestamp() + 2*msg.MAX_DRIFT}}
+	if err := s.Recv(ahead); !errors.Is(err, ErrAhead) {
+		t.Fatalf("expected %v, got %v", ErrAhead, err)
+	}
+	if count := s.Count(); count != 0 {
+		t.Fatalf("took a message from the future: %d", count)
+	}
+
+	if err := s.Write(&msg.Message{Kind: "text"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := s.Get(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Stamp.Wall > msg.Timestamp() {
+		t.Fatalf("stamped ahead of the clock: %v", m.Stamp)
+	}
+}
+
+func TestPersistentSlateMigrate(t *testing.T) {
+	root := t.TempDir()
+	db := openTestStore(t, root)
+
+	// indexed by position, the way slates were before the ordered index,
+	// and the first message from before there were stamps
+	legacy := []*msg.Message{
+		{Slate: "chat", Device: "a", Seq: 1, Sent: 300, Content: map[string]any{"body": "a1"}},
+		{Slate: "chat", Device: "b", Seq: 1, Sent: 100, Content: map[string]any{"body": "b1"}},
+		{Slate: "chat", Device: "a", Seq: 2, Sent: 50, Stamp: msg.Stamp{Wall: 200}, Content: map[string]any{"body": "a2"}},
+	}
+
+	s := &PersistentSlate{name: "chat", Device: "a", Store: db}
+	txn, err := db.Store.NewTransaction(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range legacy {
+		key := s.messageKey(m.Device, m.Seq)
+		if err = putMessage(txn, key, m); err != nil {
+			t.Fatal(err)
+		}
+		if err = putString(txn, s.indexKey(uint64(i)), key.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = putUint(txn, s.key(COUNT), uint64(len(legacy))); err != nil {
+		t.Fatal(err)
+	}
+	if err = putUint(txn, s.key("a", SEQ), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(s *PersistentSlate, expected ...string) {
+		msgs, err := s.GetRange(0, len(expected)-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range msgs {
+			if body := m.Content["body"]; body != expected[i] {
+				t.Fatalf("expected %s at %d, got %v", expected[i], i, body)
+			}
+		}
+		if msgs[0].Prev != "" || msgs[0].Next != "/s/chat/a/2" || msgs[1].Prev != "/s/chat/b/1" || msgs[1].Next != "/s/chat/a/1" {
+			t.Fatalf("not relinked: %v, %v", msgs[0], msgs[1])
+		}
+	}
+
+	migrated := NewPersistentSlate("chat", "a", db)
+	check(migrated, "b1", "a2", "a1")
+
+	if err = migrated.Write(&msg.Message{Kind: "text", Content: map[string]any{"body": "a3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Store.Close()
+	db = openTestStore(t, root)
+	defer db.Store.Close()
+
+	check(NewPersistentSlate("chat", "a", db), "b1", "a2", "a1", "a3")
+}
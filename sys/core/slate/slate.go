@@ -5,7 +5,7 @@ import "slater/core/msg"
 type Slate interface {
 	Name() string
 	Write(*msg.Message) error
-	On(string, func(*msg.Message))
+	On(string, func(*msg.Message)) func()
 	Once(string, func(*msg.Message))
 	Get(uint64) (*msg.Message, error)
 	GetRange(int, int) ([]*msg.Message, error)
@@ -0,0 +1,553 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	mh "github.com/multiformats/go-multihash"
+)
+
+//
+// Blobs (images, files, voice notes...) are kept apart from the slates, in chunks,
+// so big values never bloat the LSM tree, and the same bytes are only kept once.
+//
+// The chunks are cut by content (see chunker.go), and a manifest lists them in order.
+// A blob is named by the CID of its manifest, which is what messages refer to;
+// chunks are raw, manifests are CBOR, and both are hashed with BLAKE2b-256.
+//
+//	/b/c/<cid>  chunk
+//	/b/m/<cid>  manifest
+//	/b/r/<cid>  refcount, of a manifest or a chunk
+//
+// A manifest is referenced by the messages which refer to it (see Ref and Release), even before it's here,
+// and a chunk by the manifests which list it. Nothing is deleted until CollectGarbage,
+// which leaves unreferenced manifests alone for a grace period, so an upload has time to be referred to.
+// (Messages stay on their slates for good, so in practice it's uploads nothing ever referred to which get collected.)
+//
+// To replicate a blob, put its manifest first (so its chunks are referenced), then its missing chunks.
+//
+
+const (
+	BLOBS            = "b"
+	MANIFEST_VERSION = 1
+)
+
+var (
+	ErrBadCid   = errors.New("bad blob cid")
+	ErrBadChunk = errors.New("chunk doesn't match its cid")
+)
+
+type Manifest struct {
+	Version byte
+	Size    int64
+	Chunks  []Chunk
+}
+
+type Chunk struct {
+	Cid  []byte
+	Size uint32
+}
+
+type refcount struct {
+	Count uint64
+	Since int64 // unix milliseconds, when the count last went to zero
+}
+
+func chunkCid(data []byte) cid.Cid {
+	return newCid(cid.Raw, data)
+}
+
+func manifestCid(b []byte) cid.Cid {
+	return newCid(cid.DagCBOR, b)
+}
+
+func newCid(codec uint64, b []byte) cid.Cid {
+	hash, err := mh.Sum(b, mh.BLAKE2B_MIN+31, -1)
+	if err != nil {
+		log.Panic(err)
+	}
+	return cid.NewCidV1(codec, hash)
+}
+
+// a blob cid, from a message
+func ParseBlob(s string) (cid.Cid, error) {
+	c, err := cid.Decode(s)
+	if err != nil || c.Type() != cid.DagCBOR {
+		return cid.Undef, ErrBadCid
+	}
+	return c, nil
+}
+
+func chunkKey(c cid.Cid) ds.Key {
+	return ds.KeyWithNamespaces([]string{BLOBS, "c", c.String()})
+}
+
+func manifestKey(c cid.Cid) ds.Key {
+	return ds.KeyWithNamespaces([]string{BLOBS, "m", c.String()})
+}
+
+func refKey(c cid.Cid) ds.Key {
+	return ds.KeyWithNamespaces([]string{BLOBS, "r", c.String()})
+}
+
+func (s Store) PutBlob(data []byte) (cid.Cid, error) {
+	return s.WriteBlob(bytes.NewReader(data))
+}
+
+// store a blob as it's read, a chunk at a time
+func (s Store) WriteBlob(r io.Reader) (cid.Cid, error) {
+	m := Manifest{Version: MANIFEST_VERSION, Chunks: make([]Chunk, 0)}
+
+	written := make([]cid.Cid, 0)
+	defer func() {
+		s.doneWriting(written)
+	}()
+
+	chunks := newChunker(r)
+
+	for {
+		data, err := chunks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cid.Undef, err
+		}
+
+		c := chunkCid(data)
+
+		s.startWriting(c)
+		written = append(written, c)
+
+		if err = s.putChunk(c, data); err != nil {
+			return cid.Undef, err
+		}
+
+		m.Chunks = append(m.Chunks, Chunk{c.Bytes(), uint32(len(data))})
+		m.Size += int64(len(data))
+	}
+
+	b, err := cbor.Marshal(m)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	c := manifestCid(b)
+
+	return c, s.addManifest(c, b, m)
+}
+
+func (s Store) startWriting(c cid.Cid) {
+	s.blobLock.Lock()
+	s.writing[c.KeyString()]++
+	s.blobLock.Unlock()
+}
+
+func (s Store) doneWriting(chunks []cid.Cid) {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	for _, c := range chunks {
+		key := c.KeyString()
+		if s.writing[key]--; s.writing[key] <= 0 {
+			delete(s.writing, key)
+		}
+	}
+}
+
+func (s Store) putChunk(c cid.Cid, data []byte) error {
+	there, err := s.Store.Has(whatever, chunkKey(c))
+	if err != nil || there {
+		return err
+	}
+	return s.Store.Put(whatever, chunkKey(c), data)
+}
+
+// a chunk from another device
+func (s Store) PutChunk(c cid.Cid, data []byte) error {
+	if !chunkCid(data).Equals(c) {
+		return ErrBadChunk
+	}
+	return s.putChunk(c, data)
+}
+
+func (s Store) GetChunk(c cid.Cid) ([]byte, error) {
+	return s.Store.Get(whatever, chunkKey(c))
+}
+
+func (s Store) HasChunk(c cid.Cid) (bool, error) {
+	return s.Store.Has(whatever, chunkKey(c))
+}
+
+// a manifest from another device
+func (s Store) PutManifest(c cid.Cid, b []byte) error {
+	if c.Type() != cid.DagCBOR || !manifestCid(b).Equals(c) {
+		return ErrBadCid
+	}
+
+	var m Manifest
+	if err := cbor.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	return s.addManifest(c, b, m)
+}
+
+func (s Store) GetManifest(c cid.Cid) (*Manifest, error) {
+	b, err := s.ManifestBytes(c)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(Manifest)
+	if err = cbor.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s Store) ManifestBytes(c cid.Cid) ([]byte, error) {
+	return s.Store.Get(whatever, manifestKey(c))
+}
+
+// store a manifest, and count it as a reference to each of its chunks (only the first time)
+func (s Store) addManifest(c cid.Cid, b []byte, m Manifest) error {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	txn, err := s.Store.NewTransaction(whatever, false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard(whatever)
+
+	there, err := txn.Has(whatever, manifestKey(c))
+	if err != nil || there {
+		return err
+	}
+
+	if err = txn.Put(whatever, manifestKey(c), b); err != nil {
+		return err
+	}
+
+	// messages which arrived before the manifest already count
+	rc, err := getRefs(txn, c)
+	if err != nil {
+		return err
+	}
+	if rc.Count == 0 {
+		rc.Since = time.Now().UnixMilli()
+	}
+	if err = putRefs(txn, c, rc); err != nil {
+		return err
+	}
+
+	for _, chunk := range m.Chunks {
+		cc, err := cid.Cast(chunk.Cid)
+		if err != nil {
+			return err
+		}
+		if _, err = addRefs(txn, cc, 1); err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit(whatever)
+}
+
+func getRefs(txn ds.Txn, c cid.Cid) (refcount, error) {
+	var rc refcount
+
+	b, err := txn.Get(whatever, refKey(c))
+	if errors.Is(err, ErrNotFound) {
+		return rc, nil
+	}
+	if err != nil {
+		return rc, err
+	}
+
+	err = cbor.Unmarshal(b, &rc)
+	return rc, err
+}
+
+func putRefs(txn ds.Txn, c cid.Cid, rc refcount) error {
+	b, err := cbor.Marshal(rc)
+	if err != nil {
+		return err
+	}
+	return txn.Put(whatever, refKey(c), b)
+}
+
+// add to (or take from) a refcount, which never goes below zero
+func addRefs(txn ds.Txn, c cid.Cid, n int) (refcount, error) {
+	rc, err := getRefs(txn, c)
+	if err != nil {
+		return rc, err
+	}
+
+	if n < 0 && uint64(-n) >= rc.Count {
+		if rc.Count > 0 {
+			rc.Since = time.Now().UnixMilli()
+		}
+		rc.Count = 0
+	} else {
+		rc.Count = uint64(int64(rc.Count) + int64(n))
+	}
+
+	return rc, putRefs(txn, c, rc)
+}
+
+// a message refers to a blob
+func (s Store) Ref(c cid.Cid) error {
+	return s.changeRefs(c, 1)
+}
+
+// a message no longer refers to a blob (it's collected once nothing does)
+func (s Store) Release(c cid.Cid) error {
+	return s.changeRefs(c, -1)
+}
+
+func (s Store) changeRefs(c cid.Cid, n int) error {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	txn, err := s.Store.NewTransaction(whatever, false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard(whatever)
+
+	if _, err = addRefs(txn, c, n); err != nil {
+		return err
+	}
+
+	return txn.Commit(whatever)
+}
+
+// whether a blob is all here
+func (s Store) HasBlob(c cid.Cid) (bool, error) {
+	missing, err := s.MissingChunks(c)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil && len(missing) == 0, err
+}
+
+// the chunks of a blob which aren't here yet (it takes the manifest)
+func (s Store) MissingChunks(c cid.Cid) ([]cid.Cid, error) {
+	m, err := s.GetManifest(c)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]cid.Cid, 0)
+	for _, chunk := range m.Chunks {
+		cc, err := cid.Cast(chunk.Cid)
+		if err != nil {
+			return nil, err
+		}
+
+		there, err := s.HasChunk(cc)
+		if err != nil {
+			return nil, err
+		}
+		if !there {
+			missing = append(missing, cc)
+		}
+	}
+
+	return missing, nil
+}
+
+func (s Store) GetBlob(c cid.Cid) ([]byte, error) {
+	r, err := s.OpenBlob(c)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// read a blob a chunk at a time
+func (s Store) OpenBlob(c cid.Cid) (*BlobReader, error) {
+	m, err := s.GetManifest(c)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobReader{store: s, manifest: m}, nil
+}
+
+type BlobReader struct {
+	store    Store
+	manifest *Manifest
+	next     int
+	chunk    []byte
+}
+
+func (r *BlobReader) Size() int64 {
+	return r.manifest.Size
+}
+
+func (r *BlobReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.next >= len(r.manifest.Chunks) {
+			return 0, io.EOF
+		}
+
+		c, err := cid.Cast(r.manifest.Chunks[r.next].Cid)
+		if err != nil {
+			return 0, err
+		}
+
+		r.chunk, err = r.store.GetChunk(c)
+		if err != nil {
+			return 0, err
+		}
+
+		r.next++
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+
+	return n, nil
+}
+
+// delete the blobs nothing has referred to for the grace period, and the chunks only they had,
+// returning how many blobs went
+func (s Store) CollectGarbage(grace time.Duration) (int, error) {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	cutoff := time.Now().Add(-grace).UnixMilli()
+
+	manifests, err := s.blobKeys("m")
+	if err != nil {
+		return 0, err
+	}
+
+	collected := 0
+
+	for _, c := range manifests {
+		txn, err := s.Store.NewTransaction(whatever, false)
+		if err != nil {
+			return collected, err
+		}
+
+		done, err := s.collectManifest(txn, c, cutoff)
+		if err == nil && done {
+			err = txn.Commit(whatever)
+		}
+		txn.Discard(whatever)
+
+		if err != nil {
+			return collected, err
+		}
+		if done {
+			collected++
+		}
+	}
+
+	// and chunks no manifest lists, from writes or replication that never finished
+	chunks, err := s.blobKeys("c")
+	if err != nil {
+		return collected, err
+	}
+
+	for _, c := range chunks {
+		if s.writing[c.KeyString()] > 0 {
+			continue
+		}
+
+		there, err := s.Store.Has(whatever, refKey(c))
+		if err != nil {
+			return collected, err
+		}
+		if !there {
+			if err = s.Store.Delete(whatever, chunkKey(c)); err != nil {
+				return collected, err
+			}
+		}
+	}
+
+	return collected, nil
+}
+
+func (s Store) collectManifest(txn ds.Txn, c cid.Cid, cutoff int64) (bool, error) {
+	rc, err := getRefs(txn, c)
+	if err != nil || rc.Count > 0 || rc.Since > cutoff {
+		return false, err
+	}
+
+	b, err := txn.Get(whatever, manifestKey(c))
+	if err != nil {
+		return false, err
+	}
+
+	var m Manifest
+	if err = cbor.Unmarshal(b, &m); err != nil {
+		return false, err
+	}
+
+	for _, chunk := range m.Chunks {
+		cc, err := cid.Cast(chunk.Cid)
+		if err != nil {
+			return false, err
+		}
+
+		rc, err := addRefs(txn, cc, -1)
+		if err != nil {
+			return false, err
+		}
+
+		if rc.Count == 0 {
+			if err = txn.Delete(whatever, refKey(cc)); err != nil {
+				return false, err
+			}
+			if s.writing[cc.KeyString()] > 0 {
+				continue
+			}
+			if err = txn.Delete(whatever, chunkKey(cc)); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if err = txn.Delete(whatever, refKey(c)); err != nil {
+		return false, err
+	}
+	return true, txn.Delete(whatever, manifestKey(c))
+}
+
+// the cids under /b/<kind>
+func (s Store) blobKeys(kind string) ([]cid.Cid, error) {
+	results, err := s.Store.Query(whatever, query.Query{
+		Prefix:   ds.KeyWithNamespaces([]string{BLOBS, kind}).String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	cids := make([]cid.Cid, 0)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		c, err := cid.Decode(ds.RawKey(result.Key).BaseNamespace())
+		if err != nil {
+			log.Debug("bad blob key ", result.Key)
+			continue
+		}
+		cids = append(cids, c)
+	}
+
+	return cids, nil
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+//
+// Content-defined chunking, with a gear hash (as in FastCDC).
+// https://www.usenix.org/conference/atc16/technical-sessions/presentation/xia
+//
+// A chunk ends where the hash of the 64 bytes before it has its top bits all zero,
+// so an edit only changes the chunks around it, and the rest still dedup against the old version.
+//
+// Every device has to cut the same chunks from the same bytes, or they won't dedup against each other,
+// so don't ever change the gear table or the sizes.
+//
+
+const (
+	CHUNK_MIN = 64 << 10
+	CHUNK_AVG = 1 << chunkBits // past the minimum
+	CHUNK_MAX = 1 << 20
+
+	chunkBits = 18
+	chunkMask = (1<<chunkBits - 1) << (64 - chunkBits)
+)
+
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := blake2b.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		gear[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+}
+
+type chunker struct {
+	r *bufio.Reader
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{bufio.NewReaderSize(r, CHUNK_MAX)}
+}
+
+// the next chunk, or io.EOF when there are no more
+func (c *chunker) next() ([]byte, error) {
+	chunk := make([]byte, 0, CHUNK_MIN+CHUNK_AVG)
+
+	var hash uint64
+
+	for len(chunk) < CHUNK_MAX {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(chunk) == 0 {
+				return nil, io.EOF
+			}
+			return chunk, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, b)
+
+		hash = (hash << 1) + gear[b]
+		if len(chunk) >= CHUNK_MIN && hash&chunkMask == 0 {
+			break
+		}
+	}
+
+	return chunk, nil
+}
@@ -2,12 +2,16 @@ package store
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"sync"
 
 	logging "github.com/ipfs/go-log/v2"
 
+	badgerdb "github.com/dgraph-io/badger/v3"
 	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	badger "github.com/textileio/go-ds-badger3"
 )
 
@@ -18,14 +22,17 @@ const (
 )
 
 var (
-	ErrNotFound error           = ds.ErrNotFound
-	whatever    context.Context = context.TODO()
+	ErrNotFound    error           = ds.ErrNotFound
+	ErrKeyMismatch error           = badgerdb.ErrEncryptionKeyMismatch
+	whatever       context.Context = context.TODO()
 
 	log = logging.Logger("slater:store")
 )
 
 type Store struct {
-	Store *badger.Datastore
+	Store    *badger.Datastore
+	blobLock *sync.Mutex
+	writing  map[string]int // chunks of blobs being written, which the collector leaves alone (see blob.go)
 }
 
 func FindStores(rootPath string) ([]string, error) {
@@ -48,17 +55,51 @@ func OpenStore(rootPath, name string, key string) (Store, error) {
 	path := filepath.Join(rootPath, name, DB)
 
 	opts := badger.DefaultOptions
-	opts.WithIndexCacheSize(INDEXCACHESIZE)
-	opts.WithEncryptionKey([]byte(key))
+	opts.Options = opts.Options.
+		WithIndexCacheSize(INDEXCACHESIZE).
+		WithEncryptionKey([]byte(key))
 	//opts.WithEncryptionKeyRotationDuration(...)
 
 	store, err := badger.NewDatastore(path, &opts)
 
+	if errors.Is(err, badgerdb.ErrEncryptionKeyMismatch) {
+		// Stores made before the key was actually applied are plaintext, so encrypt them now.
+		// (if the store is encrypted with another key, this fails too, which is what we want)
+		if rekeyErr := Rekey(rootPath, name, "", key); rekeyErr == nil {
+			log.Info("encrypted plaintext store ", name)
+			store, err = badger.NewDatastore(path, &opts)
+		}
+	}
+
 	if err != nil {
-		return Store{nil}, err
+		return Store{}, err
 	}
 
-	return Store{store}, nil
+	return Store{store, &sync.Mutex{}, make(map[string]int)}, nil
+}
+
+// Re-encrypt a closed store under a new key.
+// Badger encrypts its data with data keys, which are themselves encrypted with this key,
+// so only the key registry needs to be rewritten.
+func Rekey(rootPath, name string, oldKey, newKey string) error {
+	path := filepath.Join(rootPath, name, DB)
+
+	opts := badgerdb.KeyRegistryOptions{
+		Dir:                           path,
+		ReadOnly:                      true,
+		EncryptionKey:                 []byte(oldKey),
+		EncryptionKeyRotationDuration: badger.DefaultOptions.EncryptionKeyRotationDuration,
+	}
+
+	registry, err := badgerdb.OpenKeyRegistry(opts)
+	if err != nil {
+		return err
+	}
+	defer registry.Close()
+
+	opts.EncryptionKey = []byte(newKey)
+
+	return badgerdb.WriteKeyRegistry(registry, opts)
 }
 
 func RemoveStore(rootPath, name string) {
@@ -80,3 +121,29 @@ func (s Store) Get(key string) (value []byte, err error) {
 	value, err = s.Store.Get(whatever, k)
 	return
 }
+
+func (s Store) Delete(key string) error {
+	k := ds.NewKey(key)
+	return s.Store.Delete(whatever, k)
+}
+
+// the values of every key under a namespace (not the namespace's own)
+func (s Store) Values(ns []string) ([][]byte, error) {
+	results, err := s.Store.Query(whatever, query.Query{
+		Prefix: ds.KeyWithNamespaces(ns).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	values := make([][]byte, 0)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		values = append(values, result.Value)
+	}
+
+	return values, nil
+}
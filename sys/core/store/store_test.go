@@ -0,0 +1,250 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"lukechampine.com/frand"
+)
+
+func TestRekey(t *testing.T) {
+	root := t.TempDir()
+
+	oldKey := "0123456789abcdef0123456789abcdef"
+	newKey := "fedcba9876543210fedcba9876543210"
+
+	db, err := OpenStore(root, "test", oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]string{"k"}, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	db.Store.Close()
+
+	if err = Rekey(root, "test", newKey, oldKey); err == nil {
+		t.Fatal("rekeyed with the wrong key")
+	}
+
+	if err = Rekey(root, "test", oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = OpenStore(root, "test", oldKey); err == nil {
+		t.Fatal("opened with the old key")
+	}
+
+	db, err = OpenStore(root, "test", newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Store.Close()
+
+	v, err := db.Get("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "v" {
+		t.Fatalf("expected v, got %s", v)
+	}
+}
+
+func TestOpenPlaintextStore(t *testing.T) {
+	root := t.TempDir()
+
+	db, err := OpenStore(root, "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Put([]string{"k"}, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	db.Store.Close()
+
+	key := "0123456789abcdef0123456789abcdef"
+
+	db, err = OpenStore(root, "test", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := db.Get("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "v" {
+		t.Fatalf("expected v, got %s", v)
+	}
+	db.Store.Close()
+
+	if _, err = OpenStore(root, "test", ""); err == nil {
+		t.Fatal("store is still plaintext")
+	}
+}
+
+func TestBlob(t *testing.T) {
+	db, err := OpenStore(t.TempDir(), "test", "0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Store.Close()
+
+	data := frand.Bytes(3 << 20)
+
+	c, err := db.WriteBlob(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := db.GetManifest(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != int64(len(data)) || len(m.Chunks) < 3 {
+		t.Fatalf("expected at least 3 chunks of %d bytes, got %d of %d", len(data), len(m.Chunks), m.Size)
+	}
+
+	got, err := db.GetBlob(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("got a different blob back")
+	}
+
+	// an edit in the middle leaves most of the chunks alone
+	edited := append([]byte{}, data...)
+	copy(edited[len(edited)/2:], "edited")
+
+	c2, err := db.PutBlob(edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := db.GetManifest(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := 0
+	for i := range m.Chunks {
+		if i < len(m2.Chunks) && bytes.Equal(m.Chunks[i].Cid, m2.Chunks[i].Cid) {
+			same++
+		}
+	}
+	if same < len(m.Chunks)-2 {
+		t.Fatalf("only %d of %d chunks dedup", same, len(m.Chunks))
+	}
+
+	if err = db.Ref(c); err != nil {
+		t.Fatal(err)
+	}
+
+	collected, err := db.CollectGarbage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collected != 1 {
+		t.Fatalf("expected the unreferenced blob to go, %d went", collected)
+	}
+
+	if there, _ := db.HasBlob(c2); there {
+		t.Fatal("the unreferenced blob is still there")
+	}
+	if got, err = db.GetBlob(c); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("lost the referenced blob: %v", err)
+	}
+
+	if err = db.Release(c); err != nil {
+		t.Fatal(err)
+	}
+	if collected, _ = db.CollectGarbage(time.Hour); collected != 0 {
+		t.Fatal("collected a blob within the grace period")
+	}
+	if collected, _ = db.CollectGarbage(0); collected != 1 {
+		t.Fatal("didn't collect the released blob")
+	}
+
+	chunks, err := db.blobKeys("c")
+	if err != nil || len(chunks) != 0 {
+		t.Fatalf("%d chunks left over (%v)", len(chunks), err)
+	}
+
+	chunk, _ := cid.Cast(m.Chunks[0].Cid)
+	if _, err = ParseBlob(chunk.String()); err != ErrBadCid {
+		t.Fatal("took a chunk for a blob")
+	}
+}
+
+func TestReplicateBlob(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+
+	from, err := OpenStore(t.TempDir(), "from", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer from.Store.Close()
+
+	to, err := OpenStore(t.TempDir(), "to", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Store.Close()
+
+	data := frand.Bytes(2 << 20)
+
+	c, err := from.PutBlob(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the message arrives before the blob
+	if err = to.Ref(c); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := from.ManifestBytes(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = to.PutManifest(c, append([]byte{0}, b...)); err != ErrBadCid {
+		t.Fatal("took a manifest that doesn't match its cid")
+	}
+	if err = to.PutManifest(c, b); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := to.MissingChunks(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) < 2 {
+		t.Fatalf("expected a few missing chunks, got %d", len(missing))
+	}
+
+	if err = to.PutChunk(missing[0], []byte("not it")); err != ErrBadChunk {
+		t.Fatal("took a chunk that doesn't match its cid")
+	}
+
+	for _, chunk := range missing {
+		data, err := from.GetChunk(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = to.PutChunk(chunk, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if collected, _ := to.CollectGarbage(0); collected != 0 {
+		t.Fatal("collected a blob which was referenced before it arrived")
+	}
+
+	got, err := to.GetBlob(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("got a different blob back")
+	}
+}
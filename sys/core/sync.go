@@ -0,0 +1,270 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/exp/slices"
+
+	"slater/core/msg"
+	"slater/core/slate"
+	"slater/core/store"
+)
+
+//
+// Anti-entropy between a user's devices:
+//
+// Every SYNC_INTERVAL, each device advertises its horizon for every persistent slate on the discovery topic.
+// A device which finds itself behind an advertised horizon pulls the missing ranges of each sublog
+// from the advertising device over the sync stream protocol (see syncStream.go),
+// and a device which finds the advertiser behind advertises its own horizon right away.
+//
+// Gossip only carries horizons, and new messages as they're written (live fan-out).
+//
+
+const (
+	SLATESKEY = "l"
+
+	SYNC_INTERVAL = 30 * time.Second
+	SYNC_BATCH    = 256
+)
+
+var errBadSlateName = errors.New("bad slate name")
+
+// open a persistent slate, registering it for replication if it's new
+func (core *Core) openSlate(name string) (*slate.PersistentSlate, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, errBadSlateName
+	}
+
+	core.lock.Lock()
+	defer core.lock.Unlock()
+
+	s, there := core.slates[name]
+	if there {
+		return s, nil
+	}
+
+	names, err := core.slateNames()
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(names, name) {
+		bytes, err := cbor.Marshal(append(names, name))
+		if err != nil {
+			return nil, err
+		}
+		if err = core.store.Put([]string{SLATESKEY}, bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	s = slate.NewPersistentSlate(name, core.host.host.ID().String(), core.store)
+	core.slates[name] = s
+
+	s.On(slate.ALL, func(m *msg.Message) {
+		if m.Device == s.Device {
+			core.publish(m)
+		} else {
+			core.wantBlob(name, m)
+		}
+
+		if m.Kind == SCRIPT_KIND {
+			core.handleScriptMessage(s, m)
+		}
+
+		if name == LAYOUT_SLATE {
+			core.showLayout()
+		} else {
+			core.toViews(m)
+		}
+	})
+
+	return s, nil
+}
+
+func (core *Core) slateNames() ([]string, error) {
+	return listSlates(core.store)
+}
+
+func listSlates(db store.Store) ([]string, error) {
+	var names []string
+
+	bytes, err := db.Get(SLATESKEY)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return names, nil
+		}
+		return nil, err
+	}
+
+	err = cbor.Unmarshal(bytes, &names)
+	return names, err
+}
+
+func (core *Core) advertiseHorizons() {
+	for {
+		// (a revoked device has nobody to tell)
+		if core.roster.isRevoked(core.getHost().host.ID().String()) {
+			return
+		}
+
+		core.lock.RLock()
+		names, err := core.slateNames()
+		core.lock.RUnlock()
+
+		if err != nil {
+			log.Error(err)
+		}
+
+		for _, name := range names {
+			s, err := core.openSlate(name)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			core.sendHorizon(s)
+		}
+
+		time.Sleep(SYNC_INTERVAL)
+	}
+}
+
+func (core *Core) sendHorizon(s *slate.PersistentSlate) {
+	horizon, err := s.Horizon()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	bytes, err := msg.EncodeHorizon(horizon)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	host := core.getHost()
+
+	host.send(host.discoveryKey, &msg.Message{
+		Slate: s.Name(),
+		Kind:  "horizon",
+		Sent:  msg.Timestamp(),
+		Content: map[string]any{
+			"horizon": bytes,
+		},
+	})
+}
+
+func (core *Core) handleHorizon(m *msg.Message) {
+	if !core.roster.isDevice(m.Device) {
+		log.Debug("horizon from unknown device")
+		return
+	}
+
+	field, there := m.Content["horizon"]
+	if !there {
+		log.Debug("missing horizon field")
+		return
+	}
+	bytes, ok := field.([]byte)
+	if !ok {
+		log.Debug("bad horizon field")
+		return
+	}
+
+	theirs, err := msg.DecodeHorizon(bytes)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	s, err := core.openSlate(m.Slate)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	ours, err := s.Horizon()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if ours.Behind(theirs) {
+		pid, err := peer.Decode(m.Device)
+		if err != nil {
+			log.Debug(err)
+			return
+		}
+		go core.pull(pid, s, theirs)
+	}
+
+	if theirs.Behind(ours) {
+		core.sendHorizon(s)
+	}
+}
+
+// live fan-out of a message written on this device
+func (core *Core) publish(m *msg.Message) {
+	bytes, err := msg.Encode(m)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	host := core.getHost()
+
+	host.send(host.discoveryKey, &msg.Message{
+		Slate: m.Slate,
+		Kind:  "sync",
+		Sent:  msg.Timestamp(),
+		Content: map[string]any{
+			"message": bytes,
+		},
+	})
+}
+
+// messages are wrapped, so they keep the fields set on the device they were written on
+func (core *Core) handleSync(m *msg.Message) {
+	field, there := m.Content["message"]
+	if !there {
+		log.Debug("missing message field")
+		return
+	}
+	bytes, ok := field.([]byte)
+	if !ok {
+		log.Debug("bad message field")
+		return
+	}
+
+	inner, err := msg.Decode(bytes)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	// only the user's own devices write on their slates
+	if !core.roster.isDevice(m.Device) {
+		log.Debugf("discarded sync from %s, which isn't on the roster", m.Device)
+		return
+	}
+
+	if inner.Slate != m.Slate || inner.Device != m.Device {
+		log.Debug("bad sync message")
+		return
+	}
+
+	s, err := core.openSlate(m.Slate)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	if err = s.Recv(inner); err != nil {
+		log.Error(err)
+	}
+}
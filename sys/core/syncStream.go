@@ -0,0 +1,346 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/exp/slices"
+
+	"slater/core/msg"
+	"slater/core/slate"
+)
+
+//
+// Bulk replication of sublogs between devices.
+//
+// The requesting device writes one syncRequest frame and closes its side of the stream.
+// The other device answers with one frame per message, in seq order, and closes the stream when the range is done.
+// Every frame is received into the slate as it arrives, so after a disconnect
+// the requester just asks again from its new horizon.
+//
+// No frame can be larger than SYNC_MAX_FRAME, so a device can't make another buffer without end.
+// (a message from the interface is at most about a megabyte, see bridge.go, and blobs go over their own protocol)
+//
+// A device can also ask for the horizons of all of another device's slates at once,
+// to find out what there is to pull when it has nothing at all (see recoverSession.go).
+//
+
+const (
+	SYNC_PROTOCOL     = "/slater/sync/1.0.0"
+	HORIZONS_PROTOCOL = "/slater/horizons/1.0.0"
+	SYNC_TIMEOUT      = 30 * time.Second
+	SYNC_RETRIES      = 5
+	SYNC_MAX_FRAME    = 4 << 20
+)
+
+var (
+	errBadFrame   = errors.New("sync: unexpected frame")
+	errLargeFrame = errors.New("sync: frame too large")
+)
+
+type syncRequest struct {
+	Slate  string
+	Device string
+	From   uint64
+	Until  uint64
+}
+
+func (core *Core) handleSyncStream(stream network.Stream) {
+	core.serveSync(stream, SYNC_TIMEOUT)
+}
+
+func (core *Core) serveSync(stream network.Stream, timeout time.Duration) {
+	defer stream.Close()
+
+	remote := stream.Conn().RemotePeer().String()
+	if !core.roster.isDevice(remote) {
+		log.Debugf("sync stream from unknown peer %s", remote)
+		stream.Reset()
+		return
+	}
+
+	stream.SetReadDeadline(time.Now().Add(timeout))
+
+	var req syncRequest
+	if err := cbor.NewDecoder(newFrameReader(stream)).Decode(&req); err != nil {
+		log.Debug(err)
+		stream.Reset()
+		return
+	}
+
+	core.lock.RLock()
+	names, err := core.slateNames()
+	core.lock.RUnlock()
+	if err != nil {
+		log.Error(err)
+		stream.Reset()
+		return
+	}
+	if !slices.Contains(names, req.Slate) {
+		return // nothing to send
+	}
+
+	s, err := core.openSlate(req.Slate)
+	if err != nil {
+		log.Error(err)
+		stream.Reset()
+		return
+	}
+
+	enc := cbor.NewEncoder(stream)
+
+	for from := req.From; from <= req.Until; {
+		msgs, err := s.Sublog(req.Device, from, SYNC_BATCH)
+		if err != nil {
+			log.Error(err)
+			stream.Reset()
+			return
+		}
+		if len(msgs) == 0 {
+			return
+		}
+
+		for _, m := range msgs {
+			if m.Seq > req.Until {
+				return
+			}
+			stream.SetWriteDeadline(time.Now().Add(timeout))
+			if err := enc.Encode(m); err != nil {
+				log.Debug(err)
+				stream.Reset()
+				return
+			}
+		}
+
+		from += uint64(len(msgs))
+	}
+}
+
+// pull everything beyond our horizon from another device, resuming after any interruption
+func (core *Core) pull(pid peer.ID, s *slate.PersistentSlate, theirs *msg.Horizon) {
+	core.lock.Lock()
+	if core.pulls[s.Name()] {
+		core.lock.Unlock()
+		return
+	}
+	core.pulls[s.Name()] = true
+	core.lock.Unlock()
+
+	defer func() {
+		core.lock.Lock()
+		delete(core.pulls, s.Name())
+		core.lock.Unlock()
+	}()
+
+	for attempt := 1; attempt <= SYNC_RETRIES; attempt++ {
+		ours, err := s.Horizon()
+		if err != nil {
+			log.Error(err)
+			return
+		}
+
+		if !ours.Behind(theirs) {
+			return
+		}
+
+		devices := make([]string, 0, len(*theirs))
+		for device := range *theirs {
+			devices = append(devices, device)
+		}
+		slices.Sort(devices)
+
+		for _, device := range devices {
+			from, until := (*ours)[device]+1, (*theirs)[device]
+			if from > until {
+				continue
+			}
+			if err = core.pullRange(pid, s, device, from, until, SYNC_TIMEOUT); err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			log.Debugf("sync of %s with %s interrupted (attempt %d): %s", s.Name(), pid, attempt, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+func (core *Core) pullRange(pid peer.ID, s *slate.PersistentSlate, device string, from, until uint64, timeout time.Duration) error {
+	host := core.getHost()
+
+	ctx, cancel := context.WithTimeout(host.ctx, timeout)
+	defer cancel()
+
+	stream, err := host.host.NewStream(ctx, pid, SYNC_PROTOCOL)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	req := syncRequest{
+		Slate:  s.Name(),
+		Device: device,
+		From:   from,
+		Until:  until,
+	}
+
+	stream.SetWriteDeadline(time.Now().Add(timeout))
+	if err = cbor.NewEncoder(stream).Encode(req); err != nil {
+		stream.Reset()
+		return err
+	}
+	if err = stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return err
+	}
+
+	frames := newFrameReader(stream)
+	dec := cbor.NewDecoder(bufio.NewReader(frames))
+
+	for {
+		stream.SetReadDeadline(time.Now().Add(timeout))
+		frames.next()
+
+		m := new(msg.Message)
+		err := dec.Decode(m)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			stream.Reset()
+			return err
+		}
+
+		if m.Slate != s.Name() || m.Device != device || m.Seq < from || m.Seq > until {
+			stream.Reset()
+			return errBadFrame
+		}
+
+		if err = s.Recv(m); err != nil {
+			stream.Reset()
+			return err
+		}
+	}
+}
+
+func (core *Core) handleHorizonsStream(stream network.Stream) {
+	defer stream.Close()
+
+	remote := stream.Conn().RemotePeer().String()
+	if !core.roster.isDevice(remote) {
+		log.Debugf("horizons stream from unknown peer %s", remote)
+		stream.Reset()
+		return
+	}
+
+	core.lock.RLock()
+	names, err := core.slateNames()
+	core.lock.RUnlock()
+	if err != nil {
+		log.Error(err)
+		stream.Reset()
+		return
+	}
+
+	horizons := make(map[string][]byte)
+
+	for _, name := range names {
+		s, err := core.openSlate(name)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		horizon, err := s.Horizon()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		bytes, err := msg.EncodeHorizon(horizon)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		horizons[name] = bytes
+	}
+
+	stream.SetWriteDeadline(time.Now().Add(SYNC_TIMEOUT))
+	if err := cbor.NewEncoder(stream).Encode(horizons); err != nil {
+		log.Debug(err)
+		stream.Reset()
+	}
+}
+
+// the horizons of all of another device's slates
+func (core *Core) fetchHorizons(pid peer.ID) (map[string]*msg.Horizon, error) {
+	host := core.getHost()
+
+	ctx, cancel := context.WithTimeout(host.ctx, SYNC_TIMEOUT)
+	defer cancel()
+
+	stream, err := host.host.NewStream(ctx, pid, HORIZONS_PROTOCOL)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	if err = stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(SYNC_TIMEOUT))
+
+	var encoded map[string][]byte
+	if err = cbor.NewDecoder(newFrameReader(stream)).Decode(&encoded); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+
+	horizons := make(map[string]*msg.Horizon)
+	for name, bytes := range encoded {
+		horizon, err := msg.DecodeHorizon(bytes)
+		if err != nil {
+			return nil, err
+		}
+		horizons[name] = horizon
+	}
+
+	return horizons, nil
+}
+
+// a reader which gives up once a frame's gone past SYNC_MAX_FRAME (call next before each frame)
+// (a decoder reads ahead, so some of one frame can count towards the one before: that's fine, at this size)
+type frameReader struct {
+	r    io.Reader
+	left int
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r, SYNC_MAX_FRAME}
+}
+
+func (f *frameReader) next() {
+	f.left = SYNC_MAX_FRAME
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	if f.left <= 0 {
+		return 0, errLargeFrame
+	}
+	if len(p) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= n
+	return n, err
+}
@@ -0,0 +1,245 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	libp2p "github.com/libp2p/go-libp2p"
+	host "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+
+	"slater/core/msg"
+)
+
+func testHost(t *testing.T) host.Host {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// a core serving sync (with a short timeout) on a host of its own, with a "chat" slate of 3 messages,
+// and another host connected to it, which isn't on the roster yet
+func testSyncPair(t *testing.T) (*Core, host.Host) {
+	core := testCore(t, "chat")
+
+	h := testHost(t)
+	core.host = &node{host: h, ctx: context.Background()}
+	h.SetStreamHandler(SYNC_PROTOCOL, func(stream network.Stream) { core.serveSync(stream, time.Second) })
+	h.SetStreamHandler(HORIZONS_PROTOCOL, core.handleHorizonsStream)
+
+	names, _ := cbor.Marshal([]string{"chat"})
+	if err := core.store.Put([]string{SLATESKEY}, names); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := core.slates["chat"].Write(&msg.Message{Kind: "text", Sent: msg.Timestamp()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := testHost(t)
+	if err := other.Connect(context.Background(), peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	return core, other
+}
+
+func enroll(t *testing.T, core *Core, h host.Host) {
+	core.roster.add(h.ID().String(), "a", testSignKey(t, core))
+}
+
+// ask for a range, and read the frames until the stream ends (nil) or breaks
+func requestSync(t *testing.T, from, to host.Host, req syncRequest) ([]*msg.Message, error) {
+	stream, err := from.NewStream(context.Background(), to.ID(), SYNC_PROTOCOL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if err = cbor.NewEncoder(stream).Encode(req); err != nil {
+		return nil, err
+	}
+	stream.CloseWrite()
+
+	msgs := make([]*msg.Message, 0)
+	dec := cbor.NewDecoder(stream)
+	for {
+		m := new(msg.Message)
+		err := dec.Decode(m)
+		if errors.Is(err, io.EOF) {
+			return msgs, nil
+		}
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func TestSyncStream(t *testing.T) {
+	core, other := testSyncPair(t)
+	serving := core.getHost().host
+
+	// not on the roster, so nothing
+	if msgs, err := requestSync(t, other, serving, syncRequest{"chat", "a", 1, 3}); err == nil || len(msgs) != 0 {
+		t.Fatal("served a stranger", msgs, err)
+	}
+
+	enroll(t, core, other)
+
+	for _, c := range []struct {
+		req  syncRequest
+		seqs []uint64
+	}{
+		{syncRequest{"chat", "a", 1, 3}, []uint64{1, 2, 3}},
+		{syncRequest{"chat", "a", 2, 2}, []uint64{2}},
+		{syncRequest{"chat", "a", 3, 9}, []uint64{3}},
+		{syncRequest{"chat", "b", 1, 3}, []uint64{}},
+		{syncRequest{"nope", "a", 1, 3}, []uint64{}},
+	} {
+		msgs, err := requestSync(t, other, serving, c.req)
+		if err != nil {
+			t.Fatal(c.req, err)
+		}
+		if len(msgs) != len(c.seqs) {
+			t.Fatalf("%v: got %d messages, expected %d", c.req, len(msgs), len(c.seqs))
+		}
+		for i, m := range msgs {
+			if m.Seq != c.seqs[i] || m.Device != "a" {
+				t.Fatalf("%v: got %s/%d at %d", c.req, m.Device, m.Seq, i)
+			}
+		}
+	}
+}
+
+func TestSyncStreamLimits(t *testing.T) {
+	core, other := testSyncPair(t)
+	serving := core.getHost().host
+	enroll(t, core, other)
+
+	// a request which never comes is given up on
+	stream, err := other.NewStream(context.Background(), serving.ID(), SYNC_PROTOCOL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	stream.SetReadDeadline(started.Add(5 * time.Second))
+	if _, err = stream.Read(make([]byte, 1)); err == nil || errors.Is(err, io.EOF) || time.Since(started) > 4*time.Second {
+		t.Fatal("expected the stream to be reset", err)
+	}
+
+	// and so is one which is too large
+	msgs, err := requestSync(t, other, serving, syncRequest{Slate: strings.Repeat("x", SYNC_MAX_FRAME), Device: "a", From: 1, Until: 3})
+	if err == nil || len(msgs) != 0 {
+		t.Fatal("took an oversized request", msgs, err)
+	}
+}
+
+func TestHorizonsStream(t *testing.T) {
+	core, other := testSyncPair(t)
+	serving := core.getHost().host
+
+	fetch := func() (map[string][]byte, error) {
+		stream, err := other.NewStream(context.Background(), serving.ID(), HORIZONS_PROTOCOL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		stream.CloseWrite()
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var encoded map[string][]byte
+		err = cbor.NewDecoder(stream).Decode(&encoded)
+		return encoded, err
+	}
+
+	if horizons, err := fetch(); err == nil {
+		t.Fatal("told a stranger", horizons)
+	}
+
+	enroll(t, core, other)
+
+	encoded, err := fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	horizon, err := msg.DecodeHorizon(encoded["chat"])
+	if err != nil || len(encoded) != 1 || (*horizon)["a"] != 3 {
+		t.Fatal("got", encoded, err)
+	}
+}
+
+// pulling from a device which answers with whatever it likes
+func TestPullRange(t *testing.T) {
+	core, other := testSyncPair(t)
+	s := core.slates["chat"]
+
+	frame := func(device string, seq uint64, body string) *msg.Message {
+		return &msg.Message{Slate: "chat", Device: device, Seq: seq, Stamp: msg.Stamp{Wall: msg.Timestamp()}, Kind: "text", Content: map[string]any{"body": body}}
+	}
+
+	serve := func(frames ...*msg.Message) {
+		other.SetStreamHandler(SYNC_PROTOCOL, func(stream network.Stream) {
+			defer stream.Close()
+			var req syncRequest
+			if err := cbor.NewDecoder(stream).Decode(&req); err != nil {
+				stream.Reset()
+				return
+			}
+			enc := cbor.NewEncoder(stream)
+			for _, m := range frames {
+				if m == nil {
+					time.Sleep(5 * time.Second) // and say nothing
+					return
+				}
+				if err := enc.Encode(m); err != nil {
+					return
+				}
+			}
+		})
+	}
+
+	for _, c := range []struct {
+		name   string
+		frames []*msg.Message
+		err    error
+		count  uint64
+	}{
+		{"another device's", []*msg.Message{frame("c", 1, "hi")}, errBadFrame, 3},
+		{"outside the range", []*msg.Message{frame("b", 5, "hi")}, errBadFrame, 3},
+		{"oversized", []*msg.Message{frame("b", 1, strings.Repeat("x", SYNC_MAX_FRAME))}, errLargeFrame, 3},
+		{"silent", []*msg.Message{nil}, nil, 3},
+		{"fine", []*msg.Message{frame("b", 1, "hi"), frame("b", 2, "there")}, nil, 5},
+	} {
+		serve(c.frames...)
+
+		started := time.Now()
+		err := core.pullRange(other.ID(), s, "b", 1, 2, 200*time.Millisecond)
+
+		switch {
+		case c.name == "silent":
+			if err == nil || time.Since(started) > 2*time.Second {
+				t.Fatal(c.name, "didn't time out", err)
+			}
+		case c.err == nil && err != nil:
+			t.Fatal(c.name, err)
+		case c.err != nil && !errors.Is(err, c.err):
+			t.Fatal(c.name, "got", err, "expected", c.err)
+		}
+
+		if s.Count() != c.count {
+			t.Fatal(c.name, "count is", s.Count())
+		}
+	}
+}
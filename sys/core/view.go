@@ -2,15 +2,17 @@ package core
 
 import "slater/core/slate"
 
+//
+// A session's view: the slates it shows, in order.
+//
+// A client starts from the latest page of a slate, and asks for more a page at a time,
+// before or after a cursor (an index on the slate), as it scrolls.
+// Which pages a client has is up to the client: the core only sends what's asked for, and what's new.
+//
+
 type view struct {
 	layout []string
 	slates map[string]slate.Slate
-	pages  map[string]page
-}
-
-type page struct {
-	start int
-	end   int
 }
 
 func newView() view {
@@ -21,8 +23,73 @@ func newView() view {
 		slates: map[string]slate.Slate{
 			"setup": setup,
 		},
-		pages: map[string]page{
-			"setup": {0, 0},
-		},
 	}
 }
+
+func (core *Core) handlePageRequest(sid, client, slateName string, cursor, count int, before bool) {
+	core.lock.RLock()
+	session, there := core.sessions[sid]
+	var s slate.Slate
+	if there {
+		s, there = session.view.slates[slateName]
+	}
+	core.lock.RUnlock()
+
+	if !there {
+		log.Debugf("page asked of slate %s, which isn't showing", slateName)
+		return
+	}
+
+	total := int(s.Count())
+
+	if cursor < 0 {
+		cursor = 0
+	}
+	if cursor > total {
+		cursor = total
+	}
+
+	from, to := cursor, cursor+count
+	if before {
+		from, to = cursor-count, cursor
+	}
+	if from < 0 {
+		from = 0
+	}
+	if to > total {
+		to = total
+	}
+
+	core.sendRange(sid, client, s, from, to)
+}
+
+// the latest page of a slate, for a view it's just opened in (or a client that's just come)
+func (core *Core) sendLatest(sid, client string, s slate.Slate) {
+	to := int(s.Count())
+
+	from := to - HISTORY
+	if from < 0 {
+		from = 0
+	}
+
+	core.sendRange(sid, client, s, from, to)
+}
+
+// to one client, or every client of the session if there's no client
+func (core *Core) sendRange(sid, client string, s slate.Slate, from, to int) {
+	msgs, err := s.GetRange(from, to-1)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	core.lock.RLock()
+	_, there := core.sessions[sid]
+	core.lock.RUnlock()
+
+	if !there {
+		return
+	}
+
+	core.sendPage(sid, client, s.Name(), from, int(s.Count()), msgs)
+}
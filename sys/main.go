@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"strings"
 
 	logging "github.com/ipfs/go-log/v2"
 
@@ -19,17 +20,21 @@ func init() {
 func main() {
 	var rootPath string
 
+	home, _ := os.UserHomeDir()
+	if command(os.Args[1:], filepath.Join(home, ".slater")) {
+		return
+	}
+
 	if len(os.Args) > 1 {
 		alt := os.Args[1] // alternate root, to run 2 instances for testing
 		if alt != "" {
 			rootPath = alt
 		}
 	} else {
-		home, _ := os.UserHomeDir()
 		rootPath = filepath.Join(home, ".slater")
 	}
 
-	bridge := Bridge.Start()
+	bridge := Bridge.Start(rootPath, allowedOrigins())
 	core := Core.Start(rootPath)
 
 	for {
@@ -38,15 +43,31 @@ func main() {
 			switch uiMsg.(type) {
 			case Bridge.OutputSessionStart:
 				m := uiMsg.(Bridge.OutputSessionStart)
-				core.Input <- Core.InputUISessionStart{Session: m.Session}
+				core.Input <- Core.InputUISessionStart{Session: m.Session, Client: m.Client}
 
 			case Bridge.OutputSessionResume:
 				m := uiMsg.(Bridge.OutputSessionResume)
-				core.Input <- Core.InputUISessionResume{Session: m.Session}
+				core.Input <- Core.InputUISessionResume{Session: m.Session, Client: m.Client}
+
+			case Bridge.OutputSessionQuit:
+				m := uiMsg.(Bridge.OutputSessionQuit)
+				core.Input <- Core.InputUISessionQuit{Session: m.Session, Client: m.Client}
 
 			case Bridge.OutputReceivedMessage:
 				m := uiMsg.(Bridge.OutputReceivedMessage)
 				core.Input <- Core.InputUIMessage{Session: m.Session, Message: m.Message}
+
+			case Bridge.OutputPageRequest:
+				m := uiMsg.(Bridge.OutputPageRequest)
+				core.Input <- Core.InputUIPageRequest{Session: m.Session, Client: m.Client, Slate: m.Slate, Cursor: m.Cursor, Count: m.Count, Before: m.Before}
+
+			case Bridge.OutputReceivedBlob:
+				m := uiMsg.(Bridge.OutputReceivedBlob)
+				core.Input <- Core.InputUIBlob{Session: m.Session, Client: m.Client, Transfer: m.Transfer, Data: m.Data}
+
+			case Bridge.OutputBlobRequest:
+				m := uiMsg.(Bridge.OutputBlobRequest)
+				core.Input <- Core.InputUIBlobRequest{Session: m.Session, Client: m.Client, Transfer: m.Transfer, Blob: m.Blob}
 			}
 
 		case coreMsg := <-core.Output:
@@ -54,7 +75,46 @@ func main() {
 			case Core.OutputUIMessage:
 				m := coreMsg.(Core.OutputUIMessage)
 				bridge.Input <- Bridge.InputSendMessage{Session: m.Session, Message: m.Message}
+
+			case Core.OutputSessionID:
+				m := coreMsg.(Core.OutputSessionID)
+				bridge.Input <- Bridge.InputSendSession{Session: m.Session}
+
+			case Core.OutputAddSlate:
+				m := coreMsg.(Core.OutputAddSlate)
+				bridge.Input <- Bridge.InputSendSlate{Session: m.Session, Slate: m.Slate}
+
+			case Core.OutputPage:
+				m := coreMsg.(Core.OutputPage)
+				bridge.Input <- Bridge.InputSendPage{Session: m.Session, Client: m.Client, Slate: m.Slate, From: m.From, Total: m.Total, Page: m.Page}
+
+			case Core.OutputLayout:
+				m := coreMsg.(Core.OutputLayout)
+				slates := make([]Bridge.LayoutSlate, len(m.Slates))
+				for i, s := range m.Slates {
+					slates[i] = Bridge.LayoutSlate{Slate: s.Slate, Title: s.Title, Open: s.Open, Archived: s.Archived}
+				}
+				bridge.Input <- Bridge.InputSendLayout{Session: m.Session, Slates: slates}
+
+			case Core.OutputBlobStored:
+				m := coreMsg.(Core.OutputBlobStored)
+				bridge.Input <- Bridge.InputBlobStored{Session: m.Session, Client: m.Client, Transfer: m.Transfer, Blob: m.Blob, Err: m.Err}
+
+			case Core.OutputBlob:
+				m := coreMsg.(Core.OutputBlob)
+				bridge.Input <- Bridge.InputSendBlob{Session: m.Session, Client: m.Client, Transfer: m.Transfer, Blob: m.Blob, Size: m.Size, Data: m.Data, Err: m.Err}
 			}
 		}
 	}
 }
+
+// origins besides localhost which may connect to the bridge, separated by commas
+func allowedOrigins() []string {
+	origins := make([]string, 0)
+	for _, origin := range strings.Split(os.Getenv("SLATER_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
@@ -1,3 +1,4 @@
+#include <QFile>
 #include <QProcess>
 #include <QQmlContext>
 #include <QGuiApplication>
@@ -45,13 +46,21 @@ class Core : public QObject {
     void readyReadStandardOutput() {
         qDebug() << "ready";
 
-        QByteArray buf = proc.readAllStandardOutput();
+        // the core prints its port, and the file with the token for the bridge handshake
+        QList<QByteArray> parts = proc.readAllStandardOutput().trimmed().split(' ');
         bool ok;
-        int port = buf.toInt(&ok);
+        int port = parts[0].toInt(&ok);
         if (!ok)
             port = -1;
 
-        emit ready(port);
+        QString token;
+        if (parts.size() > 1) {
+            QFile file(QString(parts[1]));
+            if (file.open(QIODevice::ReadOnly))
+                token = QString(file.readAll().trimmed());
+        }
+
+        emit ready(port, token);
     }
 
     void readyReadStandardError() {
@@ -65,7 +74,7 @@ class Core : public QObject {
 
     signals:
     void start();
-    void ready(int port);
+    void ready(int port, QString token);
     void end(int exitCode);
     void error(QString err);
 };
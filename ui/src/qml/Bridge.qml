@@ -3,8 +3,12 @@ import QtWebSockets
 import Qt.labs.settings
 
 Item {
+    id: bridge
+
     property bool connected: socket.status == WebSocket.Open
     property string dir: Qt.application.arguments[1] || ""
+    property string token: ""
+    property int version: 1 // of the protocol
     
     signal message(variant msg)
     signal timeout()
@@ -15,6 +19,7 @@ Item {
         onTriggered: timeout()
     }
 
+    // (not the token: it's a secret for this launch only, which the core hands over each time)
     Settings {
         property alias port: socket.port
     }
@@ -26,8 +31,9 @@ Item {
             console.log("core started")
         }
 
-        function onReady (port) {
+        function onReady (port, token) {
             console.log("core running on " + port)
+            bridge.token = token
             socket.port = port
             socket.active = true
         }
@@ -98,4 +104,10 @@ Item {
     function sendMessage (msg) {
         socket.sendTextMessage(msg)
     }
+
+    // wrap a message in an envelope of the bridge protocol (docs/bridge.md)
+    function send (envelope) {
+        envelope.v = version
+        sendMessage(JSON.stringify(envelope))
+    }
 }
@@ -57,6 +57,105 @@ InputElement {
                     event: "slate:background:set",
                     background: bg,
                 }
+            } else if (text === "/new" || text.startsWith("/new ") || text.startsWith("/rename ")) {
+                // slates are managed by the core, so these go there (see core/layout.go)
+                var words = text.split(' ')
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: words[0] === "/new" ? "slate:create" : "slate:rename",
+                    title: words.slice(1).join(' '),
+                }
+            } else if (text === "/close" || text === "/archive") {
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: text === "/close" ? "slate:close" : "slate:archive",
+                }
+            } else if (text.startsWith("/open ")) {
+                var info = view.findTitle(text.slice(6).trim())
+                if (!info) return
+                msg = {
+                    slate: info.slate,
+                    author: slate.username,
+                    kind: "slate:open",
+                }
+            } else if (text.startsWith("/move ")) {
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: "slate:move",
+                    index: parseInt(text.slice(6)) - 1, // counting from 1, after setup
+                }
+            } else if (text.startsWith("/script ") && text.indexOf(':') !== -1) {
+                // /script name [kind or event]: source (on one line, with ; between statements)
+                var head = text.slice(8, text.indexOf(':')).trim().split(' ')
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: "script:attach",
+                    name: head[0],
+                    on: head[1] || "*",
+                    source: text.slice(text.indexOf(':') + 1).trim(),
+                }
+            } else if (text.startsWith("/replay ")) {
+                // /replay name, or /replay name [kind or event]: source, for a draft
+                var colon = text.indexOf(':')
+                var parts = text.slice(8, colon === -1 ? undefined : colon).trim().split(' ')
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: "script:replay",
+                    name: parts[0],
+                }
+                if (colon !== -1) {
+                    msg.on = parts[1] || "*"
+                    msg.source = text.slice(colon + 1).trim()
+                }
+            } else if (text.startsWith("/unscript ")) {
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: "script:detach",
+                    name: text.slice(10).trim(),
+                }
+            } else if (text.startsWith("/rollback ")) {
+                // /rollback name version
+                var args = text.slice(10).trim().split(' ')
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: "script:rollback",
+                    name: args[0],
+                    version: parseInt(args[1]),
+                }
+            } else if (text === "/invite" || text === "/uninvite" || text === "/leave" || text === "/audit") {
+                // operators (see core/operator.go)
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: {
+                        "/invite": "operator:invite",
+                        "/uninvite": "operator:revoke",
+                        "/leave": "operator:leave",
+                        "/audit": "operator:audit",
+                    }[text],
+                }
+            } else if (text.startsWith("/accept ")) {
+                // a draft, on an operator's slate
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: "operator:accept",
+                    draft: text.slice(8).trim(),
+                }
+            } else if (text.startsWith("/operate ")) {
+                msg = {
+                    slate: slate.name,
+                    author: slate.username,
+                    kind: "operator:join",
+                    invite: text.slice(9).trim(),
+                }
             } else if (input.prompt) {
                 msg = {
                     slate: slate.name,
@@ -10,6 +10,7 @@ Item {
     anchors.fill: slates
 
     property string name
+    property string title: name
     property string username: 'user' // TODO temporary...
 
     property var backgroundURL: Style.dark ? background.dark : background.light
@@ -78,6 +79,12 @@ Item {
     property var bodies: ([])
     ListModel { id: model }
 
+    // the window of the slate we have, by index on the core's slate (see core/view.go)
+    property int start: 0
+    property int end: 0
+    property int total: 0
+    property bool paging: false
+
     property var elements: ({
         user: {
             messages: {},
@@ -122,7 +129,7 @@ Item {
                 anchors.centerIn: parent
                 verticalAlignment: Text.AlignVCenter
                 textFormat: Text.MarkdownText
-                text: `**${slate.name}**`
+                text: `**${slate.title}**`
             }
         }
 
@@ -145,6 +152,10 @@ Item {
             displayMarginBeginning: headerPane.height
             displayMarginEnd: input.height
             
+            onAtYBeginningChanged: {
+                if (atYBeginning) slate.older()
+            }
+
             property bool scrollDown: true
             //TODO disable scrollDown on scroll back, re-enable on return to bottom (maybe by button also TODO LOL)
 
@@ -255,6 +266,8 @@ Item {
         if (msg.event === "slate:clear") {
             model.clear()
             bodies = []
+            start = end + 1
+            end = start
             return
         }
 
@@ -275,17 +288,7 @@ Item {
             }
         }
 
-        var alignment
-        switch (msg.author) {
-            case 'system':
-                alignment = Qt.AlignLeft;
-                break;
-            case slate.username:
-                alignment = Qt.AlignHCenter;
-                break;
-            default:
-                alignment = Qt.AlignRight;
-        }
+        end += 1
 
         bodies.push(msg) // TODO manage the size of this when we add message list windowing
 
@@ -309,7 +312,28 @@ Item {
             input.prompt = null
         }
 
-        var data = {
+        model.append(element(msg))
+
+        // moved from elems.onCountChanged, because it stopped firing for all items (WTF)
+        if (elems.scrollDown) {
+            elems.currentIndex = elems.count - 1
+        }
+    }
+
+    function element(msg) {
+        var alignment
+        switch (msg.author) {
+            case 'system':
+                alignment = Qt.AlignLeft;
+                break;
+            case slate.username:
+                alignment = Qt.AlignHCenter;
+                break;
+            default:
+                alignment = Qt.AlignRight;
+        }
+
+        return {
             kind: msg.kind,
             time: Qt.formatTime(new Date(msg.sent)),
             align: alignment,
@@ -318,12 +342,36 @@ Item {
             body: msg.body,
             prompt: !!msg.prompt,
         }
+    }
 
-        model.append(data)
+    // a run of messages from index `from` on, joined onto what we have if it's next to it
+    function addPage(from, count, page) {
+        total = count
+        paging = false
 
-        // moved from elems.onCountChanged, because it stopped firing for all items (WTF)
-        if (elems.scrollDown) {
-            elems.currentIndex = elems.count - 1
+        if (model.count === 0 || from > end || from + page.length < start) {
+            model.clear()
+            bodies = []
+            start = from
+            end = from
         }
+
+        if (from < start) {
+            page.slice(0, start - from).reverse().forEach(msg => {
+                bodies.unshift(msg)
+                model.insert(0, element(msg))
+            })
+            start = from
+        }
+
+        page.slice(end - from).forEach(msg => appendMessage(msg))
+    }
+
+    // ask for the page before the one we have, on scrolling back to the top
+    function older() {
+        if (paging || start === 0) return
+
+        paging = true
+        view.pageWanted(slate.name, start)
     }
 }
@@ -4,6 +4,7 @@ import QtQuick.Controls
 
 Pane {
     signal message (msg: variant)
+    signal pageWanted (slate: string, before: int)
 
     anchors.fill: parent
     padding: 0
@@ -19,9 +20,46 @@ Pane {
         anchors.fill: parent
     }
 
+    // every slate in the layout, open or not, as {slate, title, open, archived}
+    property var layout: ([])
+
     function addSlate (id: string) {
-        var src = `Slate{id:${id}; name:"${id}"}`
-        model.append(Qt.createQmlObject(src, slates, "slate"))
+        if (find(id)) return find(id)
+
+        var src = `Slate{name:"${id}"}` // slate ids aren't always valid qml ids
+        var slate = Qt.createQmlObject(src, slates, "slate")
+        model.append(slate)
+        return slate
+    }
+
+    // the setup slate stays first, then the open slates, in order
+    function setLayout (infos) {
+        layout = infos
+
+        var open = infos.filter(info => info.open)
+
+        for (var i=model.count-1; i>=0; --i) {
+            var it = model.get(i)
+            if (it.name !== "setup" && !open.some(info => info.slate === it.name)) {
+                model.remove(i)
+                it.destroy()
+            }
+        }
+
+        open.forEach((info, i) => {
+            var slate = addSlate(info.slate)
+            slate.title = info.title
+
+            var from = indexOf(info.slate)
+            if (from !== i + 1) {
+                model.move(from, i + 1)
+            }
+        })
+    }
+
+    // a slate by title, open or not
+    function findTitle (title: string) {
+        return layout.find(info => info.title === title)
     }
 
     /*
@@ -52,8 +90,14 @@ Pane {
     }
     */
 
-    function addPage (slate: string, page) {
-        console.log("page:\n"+ JSON.stringify(page))
+    function addPage (slate: string, from: int, total: int, page) {
+        var it = find(slate)
+
+        if (!it){
+            return console.log("no such slate!")
+        }
+
+        it.addPage(from, total, page)
     }
 
     function addElement (msg: variant) {
@@ -69,4 +113,11 @@ Pane {
             if (it.name === slate) return it
         }
     }
+
+    function indexOf (slate: string) {
+        for (var i=0; i<model.count; ++i) {
+            if (model.get(i).name === slate) return i
+        }
+        return -1
+    }
 }
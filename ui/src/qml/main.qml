@@ -49,11 +49,19 @@ ApplicationWindow {
                 }
             }
 
-            var msg = JSON.stringify({
-                Kind: msg.kind,
-                Message: msg,
+            bridge.send({
+                kind: "msg",
+                msg: msg,
+            })
+        }
+
+        onPageWanted: function (slate, before) {
+            bridge.send({
+                kind: "page",
+                slate: slate,
+                before: before,
+                count: 50,
             })
-            bridge.sendMessage(msg)
         }
     }
 
@@ -66,6 +74,18 @@ ApplicationWindow {
             var kind = msg.kind
 
             switch (kind) {
+            case "hello":
+                if (settings.session && !Qt.application.arguments[1]) {
+                    sendResume()
+                } else {
+                    sendBegin()
+                }
+                return
+
+            case "error":
+                console.log("bridge error (" + msg.error.code + "): " + msg.error.message)
+                return
+
             case "session":
                 settings.session = msg.session
                 return
@@ -74,11 +94,14 @@ ApplicationWindow {
                 return view.appendMessage(msg.msg)
 
             case "page":
-                return view.addPage(msg.slate, msg.page)
+                return view.addPage(msg.slate, msg.from || 0, msg.total || 0, msg.page || [])
 
             case "slate":
                 return view.addSlate(msg.slate)
 
+            case "layout":
+                return view.setLayout(msg.layout)
+
             //case "element":
               //  return view.addElement(msg)
 
@@ -89,26 +112,25 @@ ApplicationWindow {
 
         onConnectedChanged:
             if (bridge.connected) {
-                if (settings.session && !Qt.application.arguments[1]) {
-                    sendResume()
-                } else {
-                    sendBegin()
-                }
+                send({
+                    kind: "hello",
+                    caps: ["page"]
+                })
             }
 
         function sendBegin () {
-            var msg = JSON.stringify({
-                kind: "begin"
+            send({
+                kind: "begin",
+                token: bridge.token
             })
-            bridge.sendMessage(msg)
         }
 
         function sendResume () {
-            var msg = JSON.stringify({
+            send({
                 kind: "resume",
-                session: settings.session
+                session: settings.session,
+                token: bridge.token
             })
-            bridge.sendMessage(msg)
         }
     }
 }